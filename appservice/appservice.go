@@ -8,6 +8,7 @@ package appservice
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -29,6 +30,7 @@ import (
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/internal/parallel"
 )
 
 // EventChannelSize is the size for the Events channel in Appservice instances.
@@ -56,6 +58,8 @@ func Create() *AppService {
 		OTKCounts:      make(chan *mautrix.OTKCount, OTKChannelSize),
 		DeviceLists:    make(chan *mautrix.DeviceLists, EventChannelSize),
 		QueryHandler:   &QueryHandlerStub{},
+
+		SentTransactions: mautrix.NewTransactionTracker(mautrix.DefaultSentTransactionLimit),
 	}
 
 	as.Router.HandleFunc("/transactions/{txnID}", as.PutTransaction).Methods(http.MethodPut)
@@ -128,6 +132,13 @@ type AppService struct {
 	botIntent  *IntentAPI
 
 	DefaultHTTPRetries int
+	// SuppressPresence and PresenceRateLimit are passed through to all clients created by NewMautrixClient.
+	// See the fields of the same name in mautrix.Client for more info.
+	SuppressPresence  bool
+	PresenceRateLimit time.Duration
+	// SentTransactions is shared by all clients created by NewMautrixClient, so that Client.IsOwnEvent
+	// recognizes events sent by any of the appservice's users.
+	SentTransactions *mautrix.TransactionTracker
 
 	Live  bool
 	Ready bool
@@ -147,13 +158,70 @@ type AppService struct {
 	websocketRequestID    int32
 	// ProcessID is an identifier sent to the websocket proxy for debugging connections
 	ProcessID string
+	// If set, a ping command is sent over the websocket at this interval, and the websocket is closed if there's no
+	// response within WebsocketPongTimeout. This ensures that dead connections are detected (and can be reconnected)
+	// even if nothing is being written to the websocket.
+	WebsocketPingInterval time.Duration
+	// How long to wait for a response to websocket pings. Defaults to DefaultWebsocketPongTimeout.
+	WebsocketPongTimeout time.Duration
 
 	WebsocketTransactionHandler WebsocketTransactionHandler
 
+	// If set, transactions received over HTTP are pushed into this queue and acknowledged immediately, then
+	// processed in the background. See TransactionQueue for details.
+	TransactionQueue TransactionQueue
+	txnQueueLock     sync.Mutex
+	txnQueueWorker   *transactionQueueWorker
+	txnQueueStopped  bool
+
+	// CheckpointPredicate decides which events message send checkpoints should be sent for.
+	// If nil, checkpoints are sent for all events. Bridges don't call the predicate for encrypted events, so the
+	// checkpoints before decryption (e.g. the bridge step and decryption errors) are always sent. Checkpoints after
+	// decryption are checked with the decrypted event, so e.g. the msgtype can be checked.
+	CheckpointPredicate func(evt *event.Event) bool
+	checkpointSends     sync.WaitGroup
+	checkpointLock      sync.Mutex
+	stopping            bool
+
+	// The maximum number of requests that bulk methods like SetPresenceForUsers send in parallel.
+	// Defaults to mautrix.DefaultParallelism.
+	BulkParallelism int
+
 	DoublePuppetValue string
 	GetProfile        func(userID id.UserID, roomID id.RoomID) *event.MemberEventContent
 }
 
+// ShouldSendCheckpoint returns whether message send checkpoints should be sent for the given event
+// according to CheckpointPredicate.
+func (as *AppService) ShouldSendCheckpoint(evt *event.Event) bool {
+	return as.CheckpointPredicate == nil || as.CheckpointPredicate(evt)
+}
+
+// resumeCheckpointSends allows GoCheckpointSend to be used again after the appservice was stopped.
+func (as *AppService) resumeCheckpointSends() {
+	as.checkpointLock.Lock()
+	as.stopping = false
+	as.checkpointLock.Unlock()
+}
+
+// GoCheckpointSend calls the given function in a new goroutine, which StopContext waits for before shutting down.
+// This should be used for sending checkpoints in the background, so that they aren't lost when stopping.
+//
+// If the appservice is already stopping, the function isn't called and false is returned.
+func (as *AppService) GoCheckpointSend(fn func()) bool {
+	as.checkpointLock.Lock()
+	defer as.checkpointLock.Unlock()
+	if as.stopping {
+		return false
+	}
+	as.checkpointSends.Add(1)
+	go func() {
+		defer as.checkpointSends.Done()
+		fn()
+	}()
+	return true
+}
+
 const DoublePuppetKey = "fi.mau.double_puppet_source"
 
 func getDefaultProcessID() string {
@@ -172,6 +240,7 @@ func (as *AppService) PrepareWebsocket() {
 	if as.websocketHandlers == nil {
 		as.websocketHandlers = make(map[string]WebsocketHandler, 32)
 		as.websocketHandlers[WebsocketCommandHTTPProxy] = as.WebsocketHTTPProxy
+		as.websocketHandlers[WebsocketCommandPing] = as.websocketPingHandler
 		as.websocketRequests = make(map[int]chan<- *WebsocketCommand)
 	}
 }
@@ -268,6 +337,30 @@ func (as *AppService) BotIntent() *IntentAPI {
 	return as.botIntent
 }
 
+// ErrUnexpectedBotUserID is returned by EnsureBotRegistered if the homeserver says the as_token belongs to a different
+// user than the bot user in the registration.
+var ErrUnexpectedBotUserID = errors.New("unexpected user ID in whoami response")
+
+// EnsureBotRegistered makes sure that the bot user (the sender_localpart in the registration) is registered, and
+// checks that the homeserver accepts the as_token by calling /whoami as the bot. Registering is skipped if the bot
+// is already registered, so this is safe to call on every startup.
+//
+// If the token isn't accepted, the returned error matches mautrix.MUnknownToken. If the registration request fails
+// with M_EXCLUSIVE, the homeserver domain or sender_localpart likely don't match the registration on the homeserver.
+func (as *AppService) EnsureBotRegistered() error {
+	err := as.BotIntent().EnsureRegistered()
+	if err != nil {
+		return fmt.Errorf("failed to register bot user: %w", err)
+	}
+	resp, err := as.BotClient().Whoami()
+	if err != nil {
+		return fmt.Errorf("failed to validate as_token: %w", err)
+	} else if resp.UserID != as.BotMXID() {
+		return fmt.Errorf("%w: expected %s, got %s", ErrUnexpectedBotUserID, as.BotMXID(), resp.UserID)
+	}
+	return nil
+}
+
 func (as *AppService) SetHomeserverURL(homeserverURL string) error {
 	parsedURL, err := url.Parse(homeserverURL)
 	if err != nil {
@@ -307,6 +400,9 @@ func (as *AppService) NewMautrixClient(userID id.UserID) *mautrix.Client {
 		Log:                 as.Log.With().Str("as_user_id", userID.String()).Logger(),
 		Client:              as.HTTPClient,
 		DefaultHTTPRetries:  as.DefaultHTTPRetries,
+		SuppressPresence:    as.SuppressPresence,
+		PresenceRateLimit:   as.PresenceRateLimit,
+		SentTransactions:    as.SentTransactions,
 	}
 	client.Logger = maulogadapt.ZeroAsMau(&client.Log)
 	return client
@@ -355,3 +451,22 @@ func (as *AppService) BotClient() *mautrix.Client {
 	}
 	return as.botClient
 }
+
+// SetPresenceForUsers sets the presence of many appservice users at once, e.g. to mark all ghosts as offline
+// when the bridge is shutting down. Users are registered first if necessary, like with other IntentAPI methods.
+// At most BulkParallelism updates are sent in parallel.
+//
+// All updates are attempted even if some fail, and the errors are returned combined with errors.Join.
+func (as *AppService) SetPresenceForUsers(presences map[id.UserID]event.Presence) error {
+	return parallel.Run(presences, as.BulkParallelism, func(userID id.UserID, presence event.Presence) error {
+		intent := as.Intent(userID)
+		err := intent.EnsureRegistered()
+		if err == nil {
+			err = intent.SetPresence(presence)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set presence of %s: %w", userID, err)
+		}
+		return nil
+	})
+}
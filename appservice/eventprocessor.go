@@ -9,11 +9,13 @@ package appservice
 import (
 	"encoding/json"
 	"runtime/debug"
+	"sync"
 
 	"github.com/rs/zerolog"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 type ExecMode uint8
@@ -22,14 +24,27 @@ const (
 	AsyncHandlers ExecMode = iota
 	AsyncLoop
 	Sync
+	// PerRoomSync processes the events of each room sequentially in the order they were received,
+	// while different rooms are processed concurrently (up to EventProcessor.MaxRoomWorkers rooms at a time).
+	PerRoomSync
 )
 
+// DefaultMaxRoomWorkers is the number of rooms processed concurrently in the PerRoomSync mode if MaxRoomWorkers is not set.
+const DefaultMaxRoomWorkers = 16
+
 type EventHandler = func(evt *event.Event)
 type OTKHandler = func(otk *mautrix.OTKCount)
 type DeviceListHandler = func(lists *mautrix.DeviceLists, since string)
 
 type EventProcessor struct {
 	ExecMode ExecMode
+	// The maximum number of rooms whose events are processed at the same time in the PerRoomSync mode.
+	// Defaults to DefaultMaxRoomWorkers. Changing this after events have been dispatched has no effect.
+	MaxRoomWorkers int
+
+	roomQueues    map[id.RoomID][]*event.Event
+	roomQueueLock sync.Mutex
+	roomWorkers   chan struct{}
 
 	as       *AppService
 	stop     chan struct{}
@@ -137,6 +152,51 @@ func (ep *EventProcessor) Dispatch(evt *event.Event) {
 		for _, handler := range handlers {
 			ep.callHandler(handler, evt)
 		}
+	case PerRoomSync:
+		ep.queueRoomEvent(evt)
+	}
+}
+
+// queueRoomEvent adds the event to the queue of its room, and starts a worker for the room if there isn't one already.
+func (ep *EventProcessor) queueRoomEvent(evt *event.Event) {
+	ep.roomQueueLock.Lock()
+	defer ep.roomQueueLock.Unlock()
+	if ep.roomQueues == nil {
+		ep.roomQueues = make(map[id.RoomID][]*event.Event)
+		maxWorkers := ep.MaxRoomWorkers
+		if maxWorkers <= 0 {
+			maxWorkers = DefaultMaxRoomWorkers
+		}
+		ep.roomWorkers = make(chan struct{}, maxWorkers)
+	}
+	queue, ok := ep.roomQueues[evt.RoomID]
+	ep.roomQueues[evt.RoomID] = append(queue, evt)
+	if !ok {
+		go ep.runRoomQueue(evt.RoomID)
+	}
+}
+
+// runRoomQueue processes the queued events of a room one by one until the queue is empty.
+func (ep *EventProcessor) runRoomQueue(roomID id.RoomID) {
+	ep.roomWorkers <- struct{}{}
+	defer func() {
+		<-ep.roomWorkers
+	}()
+	for {
+		ep.roomQueueLock.Lock()
+		queue := ep.roomQueues[roomID]
+		if len(queue) == 0 {
+			delete(ep.roomQueues, roomID)
+			ep.roomQueueLock.Unlock()
+			return
+		}
+		evt := queue[0]
+		ep.roomQueues[roomID] = queue[1:]
+		ep.roomQueueLock.Unlock()
+
+		for _, handler := range ep.handlers[evt.Type] {
+			ep.callHandler(handler, evt)
+		}
 	}
 }
 func (ep *EventProcessor) startEvents() {
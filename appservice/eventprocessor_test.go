@@ -0,0 +1,60 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestEventProcessor_PerRoomSync(t *testing.T) {
+	ep := NewEventProcessor(Create())
+	ep.ExecMode = PerRoomSync
+
+	roomA := id.RoomID("!a:example.com")
+	roomB := id.RoomID("!b:example.com")
+	roomBDone := make(chan struct{})
+	var lock sync.Mutex
+	processed := map[id.RoomID][]id.EventID{}
+	var wg sync.WaitGroup
+	ep.On(event.EventMessage, func(evt *event.Event) {
+		defer wg.Done()
+		if evt.ID == "$a1" {
+			// The first event in room A blocks until room B has been processed,
+			// which can only happen if rooms are processed concurrently.
+			select {
+			case <-roomBDone:
+			case <-time.After(time.Second):
+				t.Error("room B wasn't processed while room A was blocked")
+			}
+		}
+		lock.Lock()
+		processed[evt.RoomID] = append(processed[evt.RoomID], evt.ID)
+		if evt.RoomID == roomB && len(processed[roomB]) == 3 {
+			close(roomBDone)
+		}
+		lock.Unlock()
+	})
+
+	for i, evtID := range []id.EventID{"$a1", "$b1", "$a2", "$b2", "$a3", "$b3"} {
+		roomID := roomA
+		if i%2 == 1 {
+			roomID = roomB
+		}
+		wg.Add(1)
+		ep.Dispatch(&event.Event{Type: event.EventMessage, RoomID: roomID, ID: evtID})
+	}
+	wg.Wait()
+	assert.Equal(t, []id.EventID{"$a1", "$a2", "$a3"}, processed[roomA])
+	assert.Equal(t, []id.EventID{"$b1", "$b2", "$b3"}, processed[roomB])
+}
@@ -10,6 +10,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -26,7 +27,15 @@ import (
 )
 
 // Start starts the HTTP server that listens for calls from the Matrix homeserver.
+//
+// An appservice that was stopped with Stop or StopContext can be started again.
 func (as *AppService) Start() {
+	as.resumeCheckpointSends()
+	as.resumeTransactionQueue()
+	if as.TransactionQueue != nil {
+		// Process any transactions left in the queue from the previous run
+		as.startTransactionQueue()
+	}
 	as.server = &http.Server{
 		Handler: as.Router,
 	}
@@ -68,15 +77,46 @@ func (as *AppService) listenTCP() error {
 	}
 }
 
+// Stop stops the appservice using StopContext with a 5 second timeout.
 func (as *AppService) Stop() {
-	if as.server == nil {
-		return
-	}
-
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_ = as.server.Shutdown(ctx)
-	as.server = nil
+	_ = as.StopContext(ctx)
+}
+
+// StopContext stops the HTTP server and processes the transactions left in the TransactionQueue. Then it stops
+// accepting new checkpoint sends and waits for checkpoints that are still being sent (see GoCheckpointSend) before
+// closing the websocket, so they can still be sent over it. If the context is canceled before the queue is drained
+// or the pending sends finish, the websocket is closed anyway and an error is returned.
+//
+// Checkpoint sends and the transaction queue are resumed when Start or StartWebsocket is called again.
+func (as *AppService) StopContext(ctx context.Context) error {
+	var err error
+	if as.server != nil {
+		err = as.server.Shutdown(ctx)
+		as.server = nil
+	}
+	err = errors.Join(err, as.stopTransactionQueue(ctx))
+
+	as.checkpointLock.Lock()
+	as.stopping = true
+	as.checkpointLock.Unlock()
+
+	sendsDone := make(chan struct{})
+	go func() {
+		as.checkpointSends.Wait()
+		close(sendsDone)
+	}()
+	select {
+	case <-sendsDone:
+	case <-ctx.Done():
+		err = errors.Join(err, fmt.Errorf("pending checkpoint sends didn't finish: %w", ctx.Err()))
+	}
+
+	if as.StopWebsocket != nil {
+		as.StopWebsocket(ErrWebsocketManualStop)
+	}
+	return err
 }
 
 // CheckServerToken checks if the given request originated from the Matrix homeserver.
@@ -144,7 +184,7 @@ func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var txn Transaction
-	err = json.Unmarshal(body, &txn)
+	err = mautrix.Unmarshal(body, &txn)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to parse transaction content")
 		Error{
@@ -152,6 +192,29 @@ func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 			HTTPStatus: http.StatusBadRequest,
 			Message:    "Failed to parse body JSON",
 		}.Write(w)
+	} else if err = txn.Validate(); err != nil {
+		log.Error().Err(err).Msg("Rejecting transaction with malformed events")
+		Error{
+			ErrorCode:  ErrBadJSON,
+			HTTPStatus: http.StatusBadRequest,
+			Message:    err.Error(),
+		}.Write(w)
+	} else if as.TransactionQueue != nil {
+		as.startTransactionQueue()
+		err = as.TransactionQueue.Push(txnID, &txn)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to push transaction to queue")
+			Error{
+				ErrorCode:  ErrUnknown,
+				HTTPStatus: http.StatusInternalServerError,
+				Message:    "Failed to store transaction",
+			}.Write(w)
+			return
+		}
+		// The transaction is stored, so it's safe to ignore it if the homeserver resends it.
+		as.txnIDC.MarkProcessed(txnID)
+		as.notifyTransactionQueue()
+		WriteBlankOK(w)
 	} else {
 		as.handleTransaction(ctx, txnID, &txn)
 		WriteBlankOK(w)
@@ -159,6 +222,11 @@ func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 }
 
 func (as *AppService) handleTransaction(ctx context.Context, id string, txn *Transaction) {
+	as.dispatchTransaction(ctx, txn)
+	as.txnIDC.MarkProcessed(id)
+}
+
+func (as *AppService) dispatchTransaction(ctx context.Context, txn *Transaction) {
 	log := zerolog.Ctx(ctx)
 	log.Debug().Object("content", txn).Msg("Starting handling of transaction")
 	if as.Registration.EphemeralEvents {
@@ -184,7 +252,6 @@ func (as *AppService) handleTransaction(ctx context.Context, id string, txn *Tra
 	} else if txn.MSC3202DeviceOTKCount != nil {
 		as.handleOTKCounts(ctx, txn.MSC3202DeviceOTKCount)
 	}
-	as.txnIDC.MarkProcessed(id)
 	log.Debug().Msg("Finished dispatching events from transaction")
 }
 
@@ -0,0 +1,213 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+func putTestTransaction(as *AppService, txnID, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/"+txnID, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer hs_token")
+	w := httptest.NewRecorder()
+	as.Router.ServeHTTP(w, req)
+	return w
+}
+
+func newTransactionTestAppService() *AppService {
+	as := Create()
+	as.Registration = &Registration{ServerToken: "hs_token"}
+	return as
+}
+
+func TestAppService_PutTransaction_RejectsMalformedEvents(t *testing.T) {
+	as := newTransactionTestAppService()
+	w := putTestTransaction(as, "1", `{"events":[
+		{"type":"m.room.message","room_id":"!room:example.com","event_id":"$valid","sender":"@user:example.com","origin_server_ts":1,"content":{}},
+		{"type":"m.room.message","room_id":"!room:example.com","sender":"@user:example.com","origin_server_ts":1,"content":{}}
+	]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "event_id")
+	assert.Len(t, as.Events, 0)
+	assert.False(t, as.txnIDC.IsProcessed("1"))
+
+	w = putTestTransaction(as, "2", `{"events":[
+		{"type":"m.room.message","room_id":"!room:example.com","event_id":"$valid","sender":"@user:example.com","origin_server_ts":1,"content":{}}
+	],"ephemeral":[{"type":"m.typing","room_id":"!room:example.com","content":{"user_ids":[]}}]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	select {
+	case evt := <-as.Events:
+		require.NotNil(t, evt)
+		assert.Equal(t, event.EventMessage, evt.Type)
+	case <-time.After(time.Second):
+		t.Error("valid event wasn't dispatched")
+	}
+}
+
+// blockingTransactionQueue is a MemoryTransactionQueue that doesn't return transactions to the worker until unblocked.
+type blockingTransactionQueue struct {
+	*MemoryTransactionQueue
+	unblock chan struct{}
+}
+
+func (btq *blockingTransactionQueue) Peek() (string, *Transaction, error) {
+	<-btq.unblock
+	return btq.MemoryTransactionQueue.Peek()
+}
+
+func TestAppService_PutTransaction_Queued(t *testing.T) {
+	as := newTransactionTestAppService()
+	queue := &blockingTransactionQueue{MemoryTransactionQueue: NewMemoryTransactionQueue(), unblock: make(chan struct{})}
+	as.TransactionQueue = queue
+
+	body := `{"events":[
+		{"type":"m.room.message","room_id":"!room:example.com","event_id":"$event","sender":"@user:example.com","origin_server_ts":1,"content":{}}
+	]}`
+	w := putTestTransaction(as, "1", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// The transaction must be acknowledged and stored before it's processed
+	assert.Len(t, as.Events, 0)
+	txnID, _, _ := queue.MemoryTransactionQueue.Peek()
+	assert.Equal(t, "1", txnID)
+	// Resending the same transaction must not queue it again
+	assert.Equal(t, http.StatusOK, putTestTransaction(as, "1", body).Code)
+	queue.lock.Lock()
+	assert.Equal(t, []string{"1"}, queue.ids)
+	queue.lock.Unlock()
+
+	close(queue.unblock)
+	select {
+	case evt := <-as.Events:
+		assert.Equal(t, "$event", evt.ID.String())
+	case <-time.After(time.Second):
+		t.Fatal("queued transaction wasn't processed")
+	}
+	require.Eventually(t, func() bool {
+		txnID, _, _ := queue.MemoryTransactionQueue.Peek()
+		return txnID == ""
+	}, time.Second, 10*time.Millisecond)
+	assert.Len(t, as.Events, 0)
+}
+
+func TestAppService_StopContext_DrainsTransactionQueue(t *testing.T) {
+	as := newTransactionTestAppService()
+	as.TransactionQueue = NewMemoryTransactionQueue()
+	for _, txnID := range []string{"1", "2"} {
+		assert.Equal(t, http.StatusOK, putTestTransaction(as, txnID, `{"events":[
+			{"type":"m.room.message","room_id":"!room:example.com","event_id":"$`+txnID+`","sender":"@user:example.com","origin_server_ts":1,"content":{}}
+		]}`).Code)
+	}
+	require.NoError(t, as.StopContext(context.Background()))
+	select {
+	case <-as.txnQueueWorker.done:
+	default:
+		t.Fatal("transaction queue worker is still running after stopping")
+	}
+	txnID, _, err := as.TransactionQueue.Peek()
+	require.NoError(t, err)
+	assert.Empty(t, txnID)
+	require.Len(t, as.Events, 2)
+	assert.Equal(t, "$1", (<-as.Events).ID.String())
+	assert.Equal(t, "$2", (<-as.Events).ID.String())
+}
+
+func TestAppService_TransactionQueue_Resume(t *testing.T) {
+	as := newTransactionTestAppService()
+	as.TransactionQueue = NewMemoryTransactionQueue()
+	require.NoError(t, as.StopContext(context.Background()))
+
+	// Transactions received while stopped are stored, but not processed until the appservice is started again
+	assert.Equal(t, http.StatusOK, putTestTransaction(as, "1", `{"events":[
+		{"type":"m.room.message","room_id":"!room:example.com","event_id":"$1","sender":"@user:example.com","origin_server_ts":1,"content":{}}
+	]}`).Code)
+	assert.Len(t, as.Events, 0)
+
+	as.resumeTransactionQueue()
+	as.startTransactionQueue()
+	select {
+	case evt := <-as.Events:
+		assert.Equal(t, "$1", evt.ID.String())
+	case <-time.After(time.Second):
+		t.Fatal("queued transaction wasn't processed after resuming")
+	}
+	require.NoError(t, as.StopContext(context.Background()))
+}
+
+func TestAppService_PutTransaction_CustomUnmarshal(t *testing.T) {
+	origUnmarshal := mautrix.Unmarshal
+	defer func() {
+		mautrix.Unmarshal = origUnmarshal
+	}()
+	unmarshalCalls := 0
+	mautrix.Unmarshal = func(data []byte, v any) error {
+		unmarshalCalls++
+		return origUnmarshal(data, v)
+	}
+
+	as := newTransactionTestAppService()
+	as.Events = make(chan *event.Event, 1)
+	w := putTestTransaction(as, "1", `{"events":[{"type":"m.room.message","room_id":"!room:example.com","event_id":"$valid","sender":"@user:example.com","origin_server_ts":1,"content":{}}]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, unmarshalCalls)
+}
+
+func TestAppService_StopContext_WaitsForCheckpoints(t *testing.T) {
+	as := newTransactionTestAppService()
+	release := make(chan struct{})
+	var sent atomic.Bool
+	require.True(t, as.GoCheckpointSend(func() {
+		<-release
+		sent.Store(true)
+	}))
+	var wsStopErr error
+	as.StopWebsocket = func(err error) {
+		// The websocket must stay open until pending checkpoints have been sent
+		assert.True(t, sent.Load())
+		wsStopErr = err
+	}
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- as.StopContext(context.Background())
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("StopContext returned before the pending checkpoint was sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.False(t, as.GoCheckpointSend(func() {
+		t.Error("Checkpoint send function called after stopping")
+	}))
+	close(release)
+	require.NoError(t, <-stopped)
+	assert.True(t, sent.Load())
+	assert.ErrorIs(t, wsStopErr, ErrWebsocketManualStop)
+}
+
+func TestAppService_StopContext_Timeout(t *testing.T) {
+	as := newTransactionTestAppService()
+	release := make(chan struct{})
+	defer close(release)
+	require.True(t, as.GoCheckpointSend(func() {
+		<-release
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, as.StopContext(ctx), context.DeadlineExceeded)
+}
@@ -9,8 +9,10 @@ package appservice
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
@@ -46,12 +48,58 @@ func (as *AppService) NewIntentAPI(localpart string) *IntentAPI {
 	}
 }
 
+// SetDoublePuppetToken registers an access token for a real Matrix user. After this, Intent will return a double
+// puppet intent for that user, which uses the given token instead of the appservice token and user_id masquerading.
+//
+// Passing an empty token removes the double puppet, which makes Intent fall back to the normal ghost intent.
+// If the homeserver rejects the token (HTTP 401), it will be removed automatically after the failed request.
+func (as *AppService) SetDoublePuppetToken(userID id.UserID, token string) {
+	as.intentsLock.Lock()
+	defer as.intentsLock.Unlock()
+	if existing, ok := as.intents[userID]; ok && existing.IsCustomPuppet {
+		delete(as.intents, userID)
+	}
+	if token == "" {
+		return
+	}
+	localpart, _, _ := userID.Parse()
+	client := as.NewMautrixClient(userID)
+	client.AccessToken = token
+	client.SetAppServiceUserID = false
+	intent := &IntentAPI{
+		Client:    client,
+		bot:       as.BotClient(),
+		as:        as,
+		Localpart: localpart,
+		UserID:    userID,
+
+		IsCustomPuppet: true,
+	}
+	prevHook := client.ResponseHook
+	client.ResponseHook = func(req *http.Request, resp *http.Response, duration time.Duration) {
+		if prevHook != nil {
+			prevHook(req, resp, duration)
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			as.removeDoublePuppet(intent)
+		}
+	}
+	as.intents[userID] = intent
+}
+
+func (as *AppService) removeDoublePuppet(intent *IntentAPI) {
+	as.intentsLock.Lock()
+	defer as.intentsLock.Unlock()
+	if as.intents[intent.UserID] == intent {
+		as.Log.Warn().
+			Str("user_id", intent.UserID.String()).
+			Msg("Double puppet token was rejected, falling back to ghost intent")
+		delete(as.intents, intent.UserID)
+	}
+}
+
 func (intent *IntentAPI) Register() error {
-	_, _, err := intent.Client.Register(&mautrix.ReqRegister{
-		Username:     intent.Localpart,
-		Type:         mautrix.AuthTypeAppservice,
-		InhibitLogin: true,
-	})
+	_, err := intent.Client.RegisterAppService(intent.Localpart)
 	return err
 }
 
@@ -62,8 +110,8 @@ func (intent *IntentAPI) EnsureRegistered() error {
 		return nil
 	}
 
-	err := intent.Register()
-	if err != nil && !errors.Is(err, mautrix.MUserInUse) {
+	err := intent.Client.EnsureRegistered(intent.Localpart)
+	if err != nil {
 		return fmt.Errorf("failed to ensure registered: %w", err)
 	}
 	intent.as.StateStore.MarkRegistered(intent.UserID)
@@ -167,14 +215,14 @@ func (intent *IntentAPI) SendMassagedMessageEvent(roomID id.RoomID, eventType ev
 	return intent.Client.SendMessageEvent(roomID, eventType, contentJSON, mautrix.ReqSendEvent{Timestamp: ts})
 }
 
-func (intent *IntentAPI) SendStateEvent(roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}) (*mautrix.RespSendEvent, error) {
+func (intent *IntentAPI) SendStateEvent(roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}, extra ...mautrix.ReqSendStateEvent) (*mautrix.RespSendEvent, error) {
 	if eventType != event.StateMember || stateKey != string(intent.UserID) {
 		if err := intent.EnsureJoined(roomID); err != nil {
 			return nil, err
 		}
 	}
 	contentJSON = intent.AddDoublePuppetValue(contentJSON)
-	return intent.Client.SendStateEvent(roomID, eventType, stateKey, contentJSON)
+	return intent.Client.SendStateEvent(roomID, eventType, stateKey, contentJSON, extra...)
 }
 
 func (intent *IntentAPI) SendMassagedStateEvent(roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}, ts int64) (*mautrix.RespSendEvent, error) {
@@ -182,7 +230,7 @@ func (intent *IntentAPI) SendMassagedStateEvent(roomID id.RoomID, eventType even
 		return nil, err
 	}
 	contentJSON = intent.AddDoublePuppetValue(contentJSON)
-	return intent.Client.SendMassagedStateEvent(roomID, eventType, stateKey, contentJSON, ts)
+	return intent.Client.SendStateEvent(roomID, eventType, stateKey, contentJSON, mautrix.ReqSendStateEvent{Timestamp: ts})
 }
 
 func (intent *IntentAPI) StateEvent(roomID id.RoomID, eventType event.Type, stateKey string, outContent interface{}) error {
@@ -387,6 +435,19 @@ func (intent *IntentAPI) SetDisplayName(displayName string) error {
 	return intent.Client.SetDisplayName(displayName)
 }
 
+// SetAvatarFromURL downloads the image at the given URL, uploads it and sets it as the avatar of the user.
+// Set AvatarCache in the client to avoid reuploading the same image, see mautrix.Client.UploadAvatarFromURL for details.
+func (intent *IntentAPI) SetAvatarFromURL(link string) error {
+	if err := intent.EnsureRegistered(); err != nil {
+		return err
+	}
+	mxc, err := intent.Client.UploadAvatarFromURL(link)
+	if err != nil {
+		return err
+	}
+	return intent.SetAvatarURL(mxc)
+}
+
 func (intent *IntentAPI) SetAvatarURL(avatarURL id.ContentURI) error {
 	if err := intent.EnsureRegistered(); err != nil {
 		return err
@@ -0,0 +1,186 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestAppService(t *testing.T, handler http.HandlerFunc) *AppService {
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	as := Create()
+	as.HomeserverDomain = "example.com"
+	as.Registration = &Registration{AppToken: "as_token", SenderLocalpart: "bot"}
+	require.NoError(t, as.SetHomeserverURL(ts.URL))
+	return as
+}
+
+func TestIntentAPI_UserIDQueryParam(t *testing.T) {
+	var lock sync.Mutex
+	seen := map[string]int{}
+	as := newTestAppService(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer as_token", r.Header.Get("Authorization"))
+		lock.Lock()
+		seen[r.URL.Query().Get("user_id")]++
+		lock.Unlock()
+		_, _ = fmt.Fprintf(w, `{"user_id":%q}`, r.URL.Query().Get("user_id"))
+	})
+	alice := as.Intent("@alice:example.com")
+	bob := as.Intent("@bob:example.com")
+	require.NotNil(t, alice)
+	require.NotNil(t, bob)
+	assert.Same(t, alice, as.Intent("@alice:example.com"))
+	assert.NotSame(t, alice.Client, bob.Client)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			resp, err := alice.Whoami()
+			assert.NoError(t, err)
+			assert.Equal(t, id.UserID("@alice:example.com"), resp.UserID)
+		}()
+		go func() {
+			defer wg.Done()
+			resp, err := bob.Whoami()
+			assert.NoError(t, err)
+			assert.Equal(t, id.UserID("@bob:example.com"), resp.UserID)
+		}()
+	}
+	wg.Wait()
+	// Each intent registers itself once before the first request
+	assert.Equal(t, 11, seen["@alice:example.com"])
+	assert.Equal(t, 11, seen["@bob:example.com"])
+}
+
+func TestAppService_SetDoublePuppetToken(t *testing.T) {
+	as := newTestAppService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer puppet_token":
+			assert.False(t, r.URL.Query().Has("user_id"))
+			_, _ = w.Write([]byte(`{"user_id":"@alice:example.com"}`))
+		case "Bearer expired_token":
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid access token passed."}`))
+		default:
+			assert.Equal(t, "Bearer as_token", r.Header.Get("Authorization"))
+			_, _ = fmt.Fprintf(w, `{"user_id":%q}`, r.URL.Query().Get("user_id"))
+		}
+	})
+	as.SetDoublePuppetToken("@alice:example.com", "puppet_token")
+	alice := as.Intent("@alice:example.com")
+	require.NotNil(t, alice)
+	assert.True(t, alice.IsCustomPuppet)
+	_, err := alice.Whoami()
+	assert.NoError(t, err)
+
+	bob := as.Intent("@bob:example.com")
+	assert.False(t, bob.IsCustomPuppet)
+	_, err = bob.Whoami()
+	assert.NoError(t, err)
+
+	as.SetDoublePuppetToken("@alice:example.com", "")
+	assert.False(t, as.Intent("@alice:example.com").IsCustomPuppet)
+
+	as.SetDoublePuppetToken("@alice:example.com", "expired_token")
+	_, err = as.Intent("@alice:example.com").Whoami()
+	assert.ErrorIs(t, err, mautrix.MUnknownToken)
+	assert.False(t, as.Intent("@alice:example.com").IsCustomPuppet)
+}
+
+func TestAppService_SetPresenceForUsers(t *testing.T) {
+	var lock sync.Mutex
+	presences := map[id.UserID]string{}
+	as := newTestAppService(t, func(w http.ResponseWriter, r *http.Request) {
+		userID := r.URL.Query().Get("user_id")
+		if r.URL.Path == "/_matrix/client/v3/register" {
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "/_matrix/client/v3/presence/"+userID+"/status", r.URL.Path)
+		if userID == "@broken:example.com" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"Nope"}`))
+			return
+		}
+		var req mautrix.ReqPresence
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		lock.Lock()
+		presences[id.UserID(userID)] = string(req.Presence)
+		lock.Unlock()
+		_, _ = w.Write([]byte(`{}`))
+	})
+	err := as.SetPresenceForUsers(map[id.UserID]event.Presence{
+		"@alice:example.com":  event.PresenceOffline,
+		"@bob:example.com":    event.PresenceOffline,
+		"@carol:example.com":  event.PresenceUnavailable,
+		"@broken:example.com": event.PresenceOffline,
+	})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	assert.Contains(t, err.Error(), "@broken:example.com")
+	assert.Equal(t, map[id.UserID]string{
+		"@alice:example.com": "offline",
+		"@bob:example.com":   "offline",
+		"@carol:example.com": "unavailable",
+	}, presences)
+}
+
+func TestAppService_EnsureBotRegistered(t *testing.T) {
+	var registered []string
+	whoamiUserID := "@bot:example.com"
+	as := newTestAppService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v3/register":
+			var req mautrix.ReqRegister
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, mautrix.AuthTypeAppservice, req.Type)
+			registered = append(registered, req.Username)
+			if len(registered) > 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"errcode":"M_USER_IN_USE","error":"User ID already taken"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"user_id":"@bot:example.com"}`))
+		case "/_matrix/client/v3/account/whoami":
+			assert.Equal(t, "@bot:example.com", r.URL.Query().Get("user_id"))
+			_, _ = fmt.Fprintf(w, `{"user_id":%q}`, whoamiUserID)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	})
+	require.NoError(t, as.EnsureBotRegistered())
+	assert.Equal(t, []string{"bot"}, registered)
+	assert.True(t, as.StateStore.IsRegistered("@bot:example.com"))
+
+	// Already registered according to the state store, so only whoami is called
+	require.NoError(t, as.EnsureBotRegistered())
+	assert.Len(t, registered, 1)
+
+	// Registered on the server, but not in the state store
+	as.StateStore = mautrix.NewMemoryStateStore().(StateStore)
+	require.NoError(t, as.EnsureBotRegistered())
+	assert.Len(t, registered, 2)
+
+	whoamiUserID = "@someone_else:example.com"
+	assert.ErrorIs(t, as.EnsureBotRegistered(), ErrUnexpectedBotUserID)
+}
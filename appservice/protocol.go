@@ -7,7 +7,6 @@
 package appservice
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
@@ -39,6 +38,39 @@ type Transaction struct {
 	MSC3202FallbackKeys    FallbackKeyMap       `json:"org.matrix.msc3202.device_unused_fallback_key_types,omitempty"`
 }
 
+// Validate checks that all events in the transaction have the fields that every room event must have
+// (type, room_id, event_id, sender and origin_server_ts). Ephemeral and to-device events aren't checked,
+// as they don't have most of those fields.
+//
+// This is only a structural check and doesn't verify event signatures.
+func (txn *Transaction) Validate() error {
+	for i, evt := range txn.Events {
+		var missing []string
+		if evt == nil {
+			return fmt.Errorf("event #%d is null", i)
+		}
+		if evt.Type.Type == "" {
+			missing = append(missing, "type")
+		}
+		if evt.RoomID == "" {
+			missing = append(missing, "room_id")
+		}
+		if evt.ID == "" {
+			missing = append(missing, "event_id")
+		}
+		if evt.Sender == "" {
+			missing = append(missing, "sender")
+		}
+		if evt.Timestamp <= 0 {
+			missing = append(missing, "origin_server_ts")
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("event #%d (%s) is missing required fields: %s", i, evt.ID, strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
+
 func (txn *Transaction) MarshalZerologObject(ctx *zerolog.Event) {
 	ctx.Int("pdu", len(txn.Events))
 	if txn.EphemeralEvents != nil {
@@ -114,7 +146,7 @@ func WriteBlankOK(w http.ResponseWriter) {
 // Respond responds to a HTTP request with a JSON object.
 func Respond(w http.ResponseWriter, data interface{}) error {
 	w.Header().Add("Content-Type", "application/json")
-	dataStr, err := json.Marshal(data)
+	dataStr, err := mautrix.Marshal(data)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,205 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TransactionQueue stores transactions that have been acknowledged to the homeserver, but haven't been processed yet.
+//
+// If AppService.TransactionQueue is set, incoming transactions are pushed to the queue and the homeserver gets a
+// response immediately, instead of only after the events have been dispatched. The transactions are then processed
+// in the background in the order they were received. Implementations should persist the queue, so that transactions
+// that weren't processed before a crash are processed after a restart instead of being lost.
+type TransactionQueue interface {
+	// Push adds a transaction to the end of the queue. The transaction must be stored when this returns,
+	// as the homeserver won't resend it.
+	Push(txnID string, txn *Transaction) error
+	// Peek returns the oldest transaction in the queue without removing it. If the queue is empty, the returned
+	// transaction ID is empty.
+	Peek() (txnID string, txn *Transaction, err error)
+	// Remove removes a transaction from the queue after it has been processed.
+	Remove(txnID string) error
+}
+
+// MemoryTransactionQueue is a TransactionQueue that only stores transactions in memory.
+// Transactions in the queue will be lost if the process crashes.
+type MemoryTransactionQueue struct {
+	lock  sync.Mutex
+	ids   []string
+	queue map[string]*Transaction
+}
+
+var _ TransactionQueue = (*MemoryTransactionQueue)(nil)
+
+func NewMemoryTransactionQueue() *MemoryTransactionQueue {
+	return &MemoryTransactionQueue{queue: make(map[string]*Transaction)}
+}
+
+func (mtq *MemoryTransactionQueue) Push(txnID string, txn *Transaction) error {
+	mtq.lock.Lock()
+	defer mtq.lock.Unlock()
+	if _, exists := mtq.queue[txnID]; !exists {
+		mtq.ids = append(mtq.ids, txnID)
+		mtq.queue[txnID] = txn
+	}
+	return nil
+}
+
+func (mtq *MemoryTransactionQueue) Peek() (string, *Transaction, error) {
+	mtq.lock.Lock()
+	defer mtq.lock.Unlock()
+	if len(mtq.ids) == 0 {
+		return "", nil, nil
+	}
+	return mtq.ids[0], mtq.queue[mtq.ids[0]], nil
+}
+
+func (mtq *MemoryTransactionQueue) Remove(txnID string) error {
+	mtq.lock.Lock()
+	defer mtq.lock.Unlock()
+	if _, exists := mtq.queue[txnID]; !exists {
+		return nil
+	}
+	delete(mtq.queue, txnID)
+	for i, queuedID := range mtq.ids {
+		if queuedID == txnID {
+			mtq.ids = append(mtq.ids[:i], mtq.ids[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// transactionQueueErrorBackoff is how long the transaction queue worker waits before retrying after a queue error.
+var transactionQueueErrorBackoff = 5 * time.Second
+
+// transactionQueueWorker is the state of a transaction queue worker goroutine.
+type transactionQueueWorker struct {
+	signal   chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// startTransactionQueue starts the background worker that processes transactions from the TransactionQueue.
+// Transactions left in the queue from a previous run are processed first. Calling this multiple times is safe.
+// After stopTransactionQueue, the worker isn't started again until resumeTransactionQueue is called.
+func (as *AppService) startTransactionQueue() {
+	as.txnQueueLock.Lock()
+	defer as.txnQueueLock.Unlock()
+	if as.txnQueueStopped {
+		return
+	} else if as.txnQueueWorker != nil {
+		select {
+		case <-as.txnQueueWorker.done:
+			// The previous worker was stopped, a new one can be started
+		default:
+			return
+		}
+	}
+	worker := &transactionQueueWorker{
+		signal: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	as.txnQueueWorker = worker
+	go as.processTransactionQueue(worker)
+}
+
+// resumeTransactionQueue allows the transaction queue worker to be started again after stopTransactionQueue.
+func (as *AppService) resumeTransactionQueue() {
+	as.txnQueueLock.Lock()
+	as.txnQueueStopped = false
+	as.txnQueueLock.Unlock()
+}
+
+// stopTransactionQueue tells the transaction queue worker to stop after processing the transactions that are still
+// in the queue, and waits until it has stopped or the context is canceled.
+func (as *AppService) stopTransactionQueue(ctx context.Context) error {
+	as.txnQueueLock.Lock()
+	// Make sure the worker won't be started after this
+	as.txnQueueStopped = true
+	worker := as.txnQueueWorker
+	as.txnQueueLock.Unlock()
+	if worker == nil {
+		return nil
+	}
+	worker.stopOnce.Do(func() {
+		close(worker.stop)
+	})
+	select {
+	case <-worker.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("transaction queue wasn't drained: %w", ctx.Err())
+	}
+}
+
+// waitBackoff waits before retrying after a queue error. It returns false if the worker is
+// being stopped.
+func (worker *transactionQueueWorker) waitBackoff() bool {
+	select {
+	case <-time.After(transactionQueueErrorBackoff):
+		return true
+	case <-worker.stop:
+		return false
+	}
+}
+
+// notifyTransactionQueue wakes up the transaction queue worker after a new transaction has been pushed.
+func (as *AppService) notifyTransactionQueue() {
+	as.txnQueueLock.Lock()
+	worker := as.txnQueueWorker
+	as.txnQueueLock.Unlock()
+	if worker == nil {
+		return
+	}
+	select {
+	case worker.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (as *AppService) processTransactionQueue(worker *transactionQueueWorker) {
+	defer close(worker.done)
+	log := as.Log.With().Str("component", "transaction queue").Logger()
+	for {
+		txnID, txn, err := as.TransactionQueue.Peek()
+		if err != nil {
+			log.Err(err).Msg("Failed to get next transaction from queue")
+			if !worker.waitBackoff() {
+				return
+			}
+			continue
+		} else if txnID == "" {
+			select {
+			case <-worker.signal:
+				continue
+			case <-worker.stop:
+				log.Debug().Msg("Transaction queue drained, stopping worker")
+				return
+			}
+		}
+		txnLog := log.With().Str("transaction_id", txnID).Logger()
+		as.dispatchTransaction(txnLog.WithContext(context.Background()), txn)
+		for {
+			err = as.TransactionQueue.Remove(txnID)
+			if err == nil {
+				break
+			}
+			txnLog.Err(err).Msg("Failed to remove processed transaction from queue")
+			if !worker.waitBackoff() {
+				return
+			}
+		}
+	}
+}
@@ -117,8 +117,12 @@ var (
 
 	ErrWebsocketNotConnected = errors.New("websocket not connected")
 	ErrWebsocketClosed       = errors.New("websocket closed before response received")
+	ErrWebsocketPingTimeout  = errors.New("websocket ping timed out")
 )
 
+// DefaultWebsocketPongTimeout is the default value for AppService.WebsocketPongTimeout.
+const DefaultWebsocketPongTimeout = 10 * time.Second
+
 func (mwcc MeowWebsocketCloseCode) String() string {
 	switch mwcc {
 	case MeowServerShuttingDown:
@@ -259,7 +263,25 @@ func (as *AppService) unknownCommandHandler(cmd WebsocketCommand) (bool, interfa
 	return false, fmt.Errorf("unknown request type")
 }
 
+// WebsocketCommandPing is the command used to check that the other side of the websocket is alive.
+// The appservice responds to pings with the current timestamp by default.
+const WebsocketCommandPing = "ping"
+
+// WebsocketPingData is the data of ping commands and their responses.
+type WebsocketPingData struct {
+	Timestamp int64 `json:"timestamp"`
+}
+
+func (as *AppService) websocketPingHandler(cmd WebsocketCommand) (bool, interface{}) {
+	return true, &WebsocketPingData{Timestamp: time.Now().UnixMilli()}
+}
+
+// SetWebsocketCommandHandler sets the handler for incoming websocket commands of the given type.
+//
+// If the command has a request ID, the data returned by the handler is sent back as a response (or an error if ok is false)
+// with the same request ID, which allows the other side to wait for the response like RequestWebsocket does.
 func (as *AppService) SetWebsocketCommandHandler(cmd string, handler WebsocketHandler) {
+	as.PrepareWebsocket()
 	as.websocketHandlersLock.Lock()
 	as.websocketHandlers[cmd] = handler
 	as.websocketHandlersLock.Unlock()
@@ -268,6 +290,10 @@ func (as *AppService) SetWebsocketCommandHandler(cmd string, handler WebsocketHa
 type WebsocketTransactionHandler func(ctx context.Context, msg WebsocketMessage) (bool, any)
 
 func (as *AppService) defaultHandleWebsocketTransaction(ctx context.Context, msg WebsocketMessage) (bool, any) {
+	if err := msg.Transaction.Validate(); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Rejecting transaction with malformed events")
+		return false, err
+	}
 	if msg.TxnID == "" || !as.txnIDC.IsProcessed(msg.TxnID) {
 		as.handleTransaction(ctx, msg.TxnID, &msg.Transaction)
 	} else {
@@ -278,6 +304,43 @@ func (as *AppService) defaultHandleWebsocketTransaction(ctx context.Context, msg
 	return true, &WebsocketTransactionResponse{TxnID: msg.TxnID}
 }
 
+// pingWebsocket sends ping commands over the websocket at WebsocketPingInterval until the stop channel is closed.
+// If a ping isn't responded to in time, the websocket is stopped with ErrWebsocketPingTimeout.
+func (as *AppService) pingWebsocket(stopFunc func(error), stop <-chan struct{}) {
+	ticker := time.NewTicker(as.WebsocketPingInterval)
+	defer ticker.Stop()
+	timeout := as.WebsocketPongTimeout
+	if timeout <= 0 {
+		timeout = DefaultWebsocketPongTimeout
+	}
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		start := time.Now()
+		err := as.RequestWebsocket(ctx, &WebsocketRequest{
+			Command: WebsocketCommandPing,
+			Data:    &WebsocketPingData{Timestamp: start.UnixMilli()},
+		}, nil)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			as.Log.Warn().Dur("timeout", timeout).Msg("No response to websocket ping, closing websocket")
+			stopFunc(fmt.Errorf("%w: no response in %s", ErrWebsocketPingTimeout, timeout))
+			return
+		} else if errors.Is(err, ErrWebsocketNotConnected) || errors.Is(err, ErrWebsocketClosed) {
+			return
+		} else if err != nil {
+			// An error response still means that the connection is alive
+			as.Log.Debug().Err(err).Msg("Websocket ping returned error")
+		} else {
+			as.Log.Trace().Dur("duration", time.Since(start)).Msg("Websocket ping returned success")
+		}
+	}
+}
+
 func (as *AppService) consumeWebsocket(stopFunc func(error), ws *websocket.Conn) {
 	defer stopFunc(ErrWebsocketUnknownError)
 	ctx := context.Background()
@@ -384,6 +447,8 @@ func (as *AppService) StartWebsocket(baseURL string, onConnect func()) error {
 	if as.StopWebsocket != nil {
 		as.StopWebsocket(ErrWebsocketOverridden)
 	}
+	as.resumeCheckpointSends()
+	as.resumeTransactionQueue()
 	closeChan := make(chan error)
 	closeChanOnce := sync.Once{}
 	stopFunc := func(err error) {
@@ -405,6 +470,10 @@ func (as *AppService) StartWebsocket(baseURL string, onConnect func()) error {
 	as.Log.Debug().Msg("Appservice transaction websocket opened")
 
 	go as.consumeWebsocket(stopFunc, ws)
+	stopPinger := make(chan struct{})
+	if as.WebsocketPingInterval > 0 {
+		go as.pingWebsocket(stopFunc, stopPinger)
+	}
 
 	var onConnectDone atomic.Bool
 	if onConnect != nil {
@@ -417,6 +486,7 @@ func (as *AppService) StartWebsocket(baseURL string, onConnect func()) error {
 	}
 
 	closeErr := <-closeChan
+	close(stopPinger)
 	if !onConnectDone.Load() {
 		as.Log.Warn().Msg("Websocket closed before onConnect returned, things may explode")
 	}
@@ -426,8 +496,10 @@ func (as *AppService) StartWebsocket(baseURL string, onConnect func()) error {
 		as.ws = nil
 	}
 
+	as.wsWriteLock.Lock()
 	_ = ws.SetWriteDeadline(time.Now().Add(3 * time.Second))
 	err = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	as.wsWriteLock.Unlock()
 	if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
 		as.Log.Warn().Err(err).Msg("Error writing close message to websocket")
 	}
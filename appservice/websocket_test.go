@@ -0,0 +1,161 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestWebsocketAppService creates an appservice whose homeserver upgrades websocket requests and passes the
+// server side of the connection to the given function.
+func newTestWebsocketAppService(t *testing.T, serverFunc func(conn *websocket.Conn)) *AppService {
+	upgrader := websocket.Upgrader{}
+	return newTestAppService(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		serverFunc(conn)
+	})
+}
+
+func TestAppService_WebsocketCommandHandler(t *testing.T) {
+	responses := make(chan WebsocketCommand, 2)
+	as := newTestWebsocketAppService(t, func(conn *websocket.Conn) {
+		for _, cmd := range []string{
+			`{"id":5,"command":"echo","data":{"hello":"world"}}`,
+			`{"id":6,"command":"ping","data":{"timestamp":1}}`,
+		} {
+			if !assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(cmd))) {
+				return
+			}
+		}
+		for i := 0; i < 2; i++ {
+			var resp WebsocketCommand
+			if !assert.NoError(t, conn.ReadJSON(&resp)) {
+				return
+			}
+			responses <- resp
+		}
+	})
+	as.SetWebsocketCommandHandler("echo", func(cmd WebsocketCommand) (bool, interface{}) {
+		return true, cmd.Data
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- as.StartWebsocket("", nil)
+	}()
+	received := map[int]WebsocketCommand{}
+	for i := 0; i < 2; i++ {
+		select {
+		case resp := <-responses:
+			received[resp.ReqID] = resp
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for websocket responses")
+		}
+	}
+	assert.Equal(t, "response", received[5].Command)
+	assert.JSONEq(t, `{"hello":"world"}`, string(received[5].Data))
+	assert.Equal(t, "response", received[6].Command)
+	var ping WebsocketPingData
+	require.NoError(t, json.Unmarshal(received[6].Data, &ping))
+	assert.Greater(t, ping.Timestamp, int64(1))
+
+	select {
+	case err := <-done:
+		assert.False(t, errors.Is(err, ErrWebsocketManualStop))
+	case <-time.After(5 * time.Second):
+		t.Fatal("websocket didn't stop after the server closed the connection")
+	}
+}
+
+func TestAppService_WebsocketPingTimeout(t *testing.T) {
+	receivedPing := make(chan struct{}, 1)
+	as := newTestWebsocketAppService(t, func(conn *websocket.Conn) {
+		// Read commands without ever responding, like a half-open connection would.
+		for {
+			var cmd WebsocketCommand
+			if conn.ReadJSON(&cmd) != nil {
+				return
+			}
+			if cmd.Command == WebsocketCommandPing {
+				select {
+				case receivedPing <- struct{}{}:
+				default:
+				}
+			}
+		}
+	})
+	as.WebsocketPingInterval = 20 * time.Millisecond
+	as.WebsocketPongTimeout = 50 * time.Millisecond
+
+	done := make(chan error, 1)
+	go func() {
+		done <- as.StartWebsocket("", nil)
+	}()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, ErrWebsocketPingTimeout)
+	case <-time.After(5 * time.Second):
+		t.Fatal("websocket wasn't closed after ping timeout")
+	}
+	select {
+	case <-receivedPing:
+	default:
+		t.Error("server didn't receive a ping")
+	}
+	assert.False(t, as.HasWebsocket())
+}
+
+func TestAppService_StartWebsocket_ResumesCheckpointSends(t *testing.T) {
+	as := newTestWebsocketAppService(t, func(conn *websocket.Conn) {
+		var cmd WebsocketCommand
+		_ = conn.ReadJSON(&cmd)
+	})
+	require.NoError(t, as.StopContext(context.Background()))
+	assert.False(t, as.GoCheckpointSend(func() {}))
+
+	connected := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- as.StartWebsocket("", func() {
+			close(connected)
+		})
+	}()
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for websocket to connect")
+	}
+	sent := make(chan struct{})
+	assert.True(t, as.GoCheckpointSend(func() {
+		close(sent)
+	}))
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("checkpoint wasn't sent after restarting")
+	}
+	as.StopWebsocket(ErrWebsocketManualStop)
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, ErrWebsocketManualStop)
+	case <-time.After(5 * time.Second):
+		t.Fatal("websocket didn't stop")
+	}
+}
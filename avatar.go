@@ -0,0 +1,95 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// AvatarCache stores the content URIs of avatars uploaded by SetAvatarFromURL, so that the same image isn't uploaded
+// multiple times. The cache is keyed by the SHA-256 hash of the image data.
+type AvatarCache interface {
+	// GetAvatarMXC returns the content URI of a previously uploaded avatar, or an empty ContentURI if there isn't one.
+	GetAvatarMXC(hash [32]byte) id.ContentURI
+	// SetAvatarMXC stores the content URI that the avatar with the given hash was uploaded to.
+	SetAvatarMXC(hash [32]byte, mxc id.ContentURI)
+}
+
+// MemoryAvatarCache is a simple in-memory AvatarCache.
+type MemoryAvatarCache struct {
+	lock  sync.RWMutex
+	cache map[[32]byte]id.ContentURI
+}
+
+var _ AvatarCache = (*MemoryAvatarCache)(nil)
+
+func NewMemoryAvatarCache() *MemoryAvatarCache {
+	return &MemoryAvatarCache{cache: make(map[[32]byte]id.ContentURI)}
+}
+
+func (mac *MemoryAvatarCache) GetAvatarMXC(hash [32]byte) id.ContentURI {
+	mac.lock.RLock()
+	defer mac.lock.RUnlock()
+	return mac.cache[hash]
+}
+
+func (mac *MemoryAvatarCache) SetAvatarMXC(hash [32]byte, mxc id.ContentURI) {
+	mac.lock.Lock()
+	mac.cache[hash] = mxc
+	mac.lock.Unlock()
+}
+
+// UploadAvatarFromURL downloads the image at the given URL and uploads it to the homeserver. If AvatarCache is set
+// and the same image has already been uploaded, the previously uploaded content URI is returned instead.
+func (cli *Client) UploadAvatarFromURL(link string) (id.ContentURI, error) {
+	resp, err := cli.Client.Get(link)
+	if err != nil {
+		return id.ContentURI{}, fmt.Errorf("failed to download avatar: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return id.ContentURI{}, fmt.Errorf("failed to download avatar: unexpected status code %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return id.ContentURI{}, fmt.Errorf("failed to read avatar: %w", err)
+	}
+	hash := sha256.Sum256(data)
+	if cli.AvatarCache != nil {
+		if cached := cli.AvatarCache.GetAvatarMXC(hash); !cached.IsEmpty() {
+			return cached, nil
+		}
+	}
+	mimeType := resp.Header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	uploaded, err := cli.UploadBytes(data, mimeType)
+	if err != nil {
+		return id.ContentURI{}, fmt.Errorf("failed to upload avatar: %w", err)
+	}
+	if cli.AvatarCache != nil {
+		cli.AvatarCache.SetAvatarMXC(hash, uploaded.ContentURI)
+	}
+	return uploaded.ContentURI, nil
+}
+
+// SetAvatarFromURL downloads the image at the given URL, uploads it to the homeserver and sets it as the avatar
+// of the user. See UploadAvatarFromURL for details on how uploads are deduplicated.
+func (cli *Client) SetAvatarFromURL(link string) error {
+	mxc, err := cli.UploadAvatarFromURL(link)
+	if err != nil {
+		return err
+	}
+	return cli.SetAvatarURL(mxc)
+}
@@ -695,12 +695,9 @@ func (br *Bridge) stop() {
 	if br.Crypto != nil {
 		br.Crypto.Stop()
 	}
-	waitForWS := false
-	if br.AS.StopWebsocket != nil {
-		br.ZLog.Debug().Msg("Stopping application service websocket")
-		br.AS.StopWebsocket(appservice.ErrWebsocketManualStop)
-		waitForWS = true
-	}
+	waitForWS := br.AS.StopWebsocket != nil
+	br.ZLog.Debug().Msg("Stopping application service and flushing pending checkpoints")
+	// This also stops the websocket after pending checkpoints have been sent
 	br.AS.Stop()
 	sendStopSignal(br.wsStopPinger)
 	sendStopSignal(br.wsShortCircuitReconnectBackoff)
@@ -0,0 +1,81 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/status"
+)
+
+func TestBridge_SendBridgeState_Websocket(t *testing.T) {
+	commands := make(chan appservice.WebsocketCommand, 1)
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		var cmd appservice.WebsocketCommand
+		if !assert.NoError(t, conn.ReadJSON(&cmd)) {
+			return
+		}
+		commands <- cmd
+	}))
+	defer ts.Close()
+
+	as := appservice.Create()
+	as.HomeserverDomain = "example.com"
+	as.Registration = &appservice.Registration{AppToken: "as_token", SenderLocalpart: "bot"}
+	require.NoError(t, as.SetHomeserverURL(ts.URL))
+	br := &Bridge{AS: as, Websocket: true}
+
+	connected := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- as.StartWebsocket("", func() {
+			close(connected)
+		})
+	}()
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for websocket to connect")
+	}
+
+	state := status.BridgeState{StateEvent: status.StateConnected}.Fill(nil)
+	require.NoError(t, br.SendBridgeState(context.Background(), &state))
+	assert.Same(t, &state, br.latestState)
+
+	select {
+	case cmd := <-commands:
+		assert.Equal(t, "bridge_status", cmd.Command)
+		var sent status.BridgeState
+		require.NoError(t, json.Unmarshal(cmd.Data, &sent))
+		assert.Equal(t, status.StateConnected, sent.StateEvent)
+		assert.Equal(t, state.TTL, sent.TTL)
+	case <-time.After(5 * time.Second):
+		t.Fatal("bridge state wasn't sent over the websocket")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("websocket didn't stop after the server closed the connection")
+	}
+}
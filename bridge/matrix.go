@@ -70,7 +70,7 @@ func NewMatrixHandler(br *Bridge) *MatrixHandler {
 
 func (mx *MatrixHandler) sendBridgeCheckpoint(evt *event.Event) {
 	if !evt.Mautrix.CheckpointSent {
-		go mx.bridge.SendMessageSuccessCheckpoint(evt, status.MsgStepBridge, 0)
+		mx.bridge.SendMessageSuccessCheckpoint(evt, status.MsgStepBridge, 0)
 	}
 }
 
@@ -570,7 +570,7 @@ func (mx *MatrixHandler) HandleMessage(evt *event.Event) {
 		}
 		if hasCommandPrefix || evt.RoomID == user.GetManagementRoomID() {
 			go mx.bridge.CommandProcessor.Handle(evt.RoomID, evt.ID, user, content.Body, content.RelatesTo.GetReplyTo())
-			go mx.bridge.SendMessageSuccessCheckpoint(evt, status.MsgStepCommand, 0)
+			mx.bridge.SendMessageSuccessCheckpoint(evt, status.MsgStepCommand, 0)
 			if mx.bridge.Config.Bridge.EnableMessageStatusEvents() {
 				statusEvent := &event.BeeperMessageStatusEventContent{
 					// TODO: network
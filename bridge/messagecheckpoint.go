@@ -26,11 +26,17 @@ func (br *Bridge) SendMessageErrorCheckpoint(evt *event.Event, step status.Messa
 }
 
 func (br *Bridge) SendMessageCheckpoint(evt *event.Event, step status.MessageCheckpointStep, err error, s status.MessageCheckpointStatus, retryNum int) {
+	// The predicate can't see the real type of encrypted events, so it's only applied to them after decryption
+	if evt.Type != event.EventEncrypted && !br.AS.ShouldSendCheckpoint(evt) {
+		return
+	}
 	checkpoint := status.NewMessageCheckpoint(evt, step, s, retryNum)
 	if err != nil {
 		checkpoint.Info = err.Error()
 	}
-	go br.SendRawMessageCheckpoint(checkpoint)
+	br.AS.GoCheckpointSend(func() {
+		br.SendRawMessageCheckpoint(checkpoint)
+	})
 }
 
 func (br *Bridge) SendRawMessageCheckpoint(cp *status.MessageCheckpoint) {
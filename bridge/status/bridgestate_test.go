@@ -0,0 +1,60 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package status_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mau.fi/util/jsontime"
+
+	"maunium.net/go/mautrix/bridge/status"
+)
+
+func TestBridgeState_ShouldDeduplicate(t *testing.T) {
+	prev := status.BridgeState{StateEvent: status.StateConnected}.Fill(nil)
+	same := status.BridgeState{StateEvent: status.StateConnected}.Fill(nil)
+	assert.True(t, prev.ShouldDeduplicate(&same))
+
+	different := status.BridgeState{StateEvent: status.StateTransientDisconnect}.Fill(nil)
+	assert.False(t, prev.ShouldDeduplicate(&different))
+
+	withError := status.BridgeState{StateEvent: status.StateConnected, Error: "foo"}.Fill(nil)
+	assert.False(t, prev.ShouldDeduplicate(&withError))
+
+	withInfo := status.BridgeState{StateEvent: status.StateConnected, Info: map[string]any{"foo": "bar"}}.Fill(nil)
+	assert.False(t, prev.ShouldDeduplicate(&withInfo))
+
+	expired := prev
+	expired.Timestamp = jsontime.Unix{Time: time.Now().Add(-time.Duration(expired.TTL+1) * time.Second)}
+	assert.False(t, expired.ShouldDeduplicate(&same))
+
+	var nilState *status.BridgeState
+	assert.False(t, nilState.ShouldDeduplicate(&same))
+}
+
+func TestBridgeState_SendHTTP(t *testing.T) {
+	var received map[string]any
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer as_token", r.Header.Get("Authorization"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	state := status.BridgeState{StateEvent: status.StateBadCredentials, Error: "bad-password", RemoteID: "1234"}.Fill(nil)
+	assert.NoError(t, state.SendHTTP(context.Background(), ts.URL, "as_token"))
+	assert.Equal(t, "BAD_CREDENTIALS", received["state_event"])
+	assert.Equal(t, "bad-password", received["error"])
+	assert.Equal(t, "1234", received["remote_id"])
+	assert.EqualValues(t, 3600, received["ttl"])
+}
@@ -144,6 +144,23 @@ var CheckpointTypes = map[event.Type]struct{}{
 	//event.CallNegotiate:    {},
 }
 
+// ExcludeMessageTypes returns a checkpoint predicate that rejects m.room.message events with any of the given
+// msgtypes and allows everything else. This can be used as the CheckpointPredicate in an appservice to e.g. not
+// send checkpoints for notices.
+func ExcludeMessageTypes(msgTypes ...event.MessageType) func(evt *event.Event) bool {
+	excluded := make(map[event.MessageType]struct{}, len(msgTypes))
+	for _, msgType := range msgTypes {
+		excluded[msgType] = struct{}{}
+	}
+	return func(evt *event.Event) bool {
+		if evt.Type != event.EventMessage {
+			return true
+		}
+		_, isExcluded := excluded[evt.Content.AsMessage().MsgType]
+		return !isExcluded
+	}
+}
+
 func NewMessageCheckpoint(evt *event.Event, step MessageCheckpointStep, status MessageCheckpointStatus, retryNum int) *MessageCheckpoint {
 	checkpoint := MessageCheckpoint{
 		EventID:    evt.ID,
@@ -0,0 +1,37 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package status_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/event"
+)
+
+func newMessageEvent(msgType event.MessageType) *event.Event {
+	return &event.Event{
+		Type:    event.EventMessage,
+		Content: event.Content{Parsed: &event.MessageEventContent{MsgType: msgType, Body: "hi"}},
+	}
+}
+
+func TestAppService_ShouldSendCheckpoint_ExcludeNotices(t *testing.T) {
+	as := appservice.Create()
+	assert.True(t, as.ShouldSendCheckpoint(newMessageEvent(event.MsgNotice)))
+	assert.True(t, as.ShouldSendCheckpoint(&event.Event{Type: event.StateMember}))
+
+	as.CheckpointPredicate = status.ExcludeMessageTypes(event.MsgNotice)
+	assert.False(t, as.ShouldSendCheckpoint(newMessageEvent(event.MsgNotice)))
+	assert.True(t, as.ShouldSendCheckpoint(newMessageEvent(event.MsgText)))
+	assert.True(t, as.ShouldSendCheckpoint(&event.Event{Type: event.EventReaction}))
+	// Types outside CheckpointTypes (e.g. decrypted events of other types) must not be dropped
+	assert.True(t, as.ShouldSendCheckpoint(&event.Event{Type: event.StateMember}))
+}
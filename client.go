@@ -10,18 +10,24 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
 	"maunium.net/go/maulogger/v2/maulogadapt"
 
+	"maunium.net/go/mautrix/crypto/canonicaljson"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/internal/parallel"
 	"maunium.net/go/mautrix/pushrules"
 )
 
@@ -57,23 +63,94 @@ type Client struct {
 	StateStore    StateStore
 	Crypto        CryptoHelper
 
+	// The HTTP client used for /sync requests. If nil, Client is used, with the timeout extended to cover the
+	// long-poll timeout parameter. If set, the timeout of this client must be longer than the long-poll timeout
+	// (plus some buffer for the server to respond), or zero to rely on the long-poll timeout only.
+	SyncClient *http.Client
+
 	Log zerolog.Logger
 	// Deprecated: switch to the zerolog instance in Log
 	Logger Logger
 
+	// RequestHook is called before each HTTP request (including retries). The Authorization and User-Agent headers
+	// are only added when the request is sent (see NewClientWithHTTPClient), so they aren't visible in the hook yet.
+	// If the hook sets either header, the value set by the hook is used instead of the default.
 	RequestHook  func(req *http.Request)
 	ResponseHook func(req *http.Request, resp *http.Response, duration time.Duration)
-
+	// OnRequest and OnResponse are called before and after each HTTP request (including retries) with the method
+	// and the path normalized using NormalizePath, which makes them suitable for recording metrics without
+	// depending on a specific metrics library. If the request failed without a response, statusCode is 0.
+	OnRequest  func(method, path string)
+	OnResponse func(method, path string, statusCode int, duration time.Duration)
+	// SoftLogoutHook is called when a request fails because the session was soft logged out
+	// (i.e. the error response has "soft_logout": true). The error is still returned to the caller too.
+	SoftLogoutHook func(err HTTPError)
+
+	// The presence to set while syncing. Must be one of the presence constants in the event package.
+	// If empty, the set_presence parameter isn't sent and the server will mark the user as online.
+	// Bots that sync in the background should usually set this to event.PresenceOffline.
 	SyncPresence event.Presence
+	// The long-poll timeout to use for /sync requests in Sync. Defaults to 30 seconds.
+	SyncTimeout time.Duration
+	// If set, SyncRequestHook is called before each /sync request made by Sync. It can be used to observe the
+	// since token, or to change request parameters like the timeout or presence for individual requests.
+	SyncRequestHook func(req *ReqSync)
+	// If true, Sync loads the next_batch token from Store, but doesn't save new tokens there. This is useful for
+	// short-lived clients that share a store with a persistent client and mustn't change its sync position.
+	DontSaveNextBatch bool
+
+	// Set to true to make SetPresence and UserTyping silently do nothing.
+	SuppressPresence bool
+	// If set, SetPresence and UserTyping send at most one update per this interval (per room for typing).
+	// Updates made within the interval are dropped rather than delayed, so nothing is sent in the background,
+	// but the last update in a burst may be lost. Presence and typing time out on the server, so callers that
+	// refresh them periodically will converge to the latest state.
+	PresenceRateLimit time.Duration
+	presenceLimiter   presenceLimiter
+
+	// The maximum number of requests that bulk methods like MarkReadMultiple send in parallel.
+	// Defaults to DefaultParallelism.
+	BulkParallelism int
+
+	// If set, SetAvatarFromURL will use this to avoid uploading the same avatar image multiple times.
+	AvatarCache AvatarCache
+
+	// If set, sends of message and state events are queued per room, so that events sent to the same room from
+	// different goroutines are sent one at a time in the order they were queued. See RoomSendQueue for details.
+	RoomSendQueue *RoomSendQueue
+
+	// If set, the transaction IDs of events sent with SendMessageEvent and SendRawEvent are recorded here,
+	// so that IsOwnEvent can recognize their remote echoes.
+	SentTransactions *TransactionTracker
+
+	// If set, the members of rooms are cached here. See EnableMemberCache and GetCachedMembers.
+	MemberCache *MemberCache
+
+	// The path prefix to use for the media repository endpoints (upload, download, config and URL previews).
+	// Defaults to DefaultMediaPrefix, i.e. /_matrix/media/v3.
+	MediaPrefix []string
+
+	// The unstable prefix to use for ReportRoom, e.g. org.matrix.msc4151. If empty, the stable v3 endpoint is used.
+	ReportRoomUnstablePrefix string
 
 	StreamSyncMinAge time.Duration
 
 	// Number of times that mautrix will retry any HTTP request
-	// if the request fails entirely or returns a HTTP gateway error (502-504)
+	// if the request fails entirely or returns a HTTP gateway error (502-504).
+	// Requests that fail entirely (e.g. due to the connection being reset) are only retried for idempotent methods
+	// (i.e. not POST), as it's not known whether the server received the request.
 	DefaultHTTPRetries int
+	// How long to wait before the first retry. The wait time is doubled after each attempt. Defaults to 4 seconds.
+	DefaultHTTPBackoff time.Duration
 	// Set to true to disable automatically sleeping on 429 errors.
 	IgnoreRateLimit bool
 
+	// If set, RequestInterceptor is called before each HTTP request is sent. If it returns handled=true,
+	// the request isn't sent, and the returned body and status code are used as the response instead.
+	// This is mostly useful for mocking specific endpoints in tests without running a HTTP server.
+	// The body parameter is nil if the request has no body or if the body is a stream that can't be reread.
+	RequestInterceptor func(method, url string, body []byte) (responseBody []byte, statusCode int, handled bool)
+
 	txnID int32
 
 	// Should the ?user_id= query parameter be set in requests?
@@ -81,6 +158,9 @@ type Client struct {
 	SetAppServiceUserID bool
 
 	syncingID uint32 // Identifies the current Sync. Only one Sync can be active at any given time.
+
+	versionsCache *RespVersions
+	versionsLock  sync.Mutex
 }
 
 type ClientWellKnown struct {
@@ -100,15 +180,37 @@ type IdentityServerInfo struct {
 // Use ParseUserID to extract the server name from a user ID.
 // https://spec.matrix.org/v1.2/client-server-api/#server-discovery
 func DiscoverClientAPI(serverName string) (*ClientWellKnown, error) {
+	var wellKnown ClientWellKnown
+	if found, err := fetchWellKnown(serverName, "client", &wellKnown); err != nil || !found {
+		return nil, err
+	}
+	return &wellKnown, nil
+}
+
+// DiscoverSupport fetches the server admin contacts and support page published by a Matrix server.
+// If the server doesn't publish support information, both the response and the error will be nil.
+// https://spec.matrix.org/v1.10/client-server-api/#getwell-knownmatrixsupport
+func DiscoverSupport(serverName string) (*RespWellKnownSupport, error) {
+	var support RespWellKnownSupport
+	if found, err := fetchWellKnown(serverName, "support", &support); err != nil || !found {
+		return nil, err
+	}
+	return &support, nil
+}
+
+func fetchWellKnown(serverName, name string, output interface{}) (found bool, err error) {
 	wellKnownURL := url.URL{
 		Scheme: "https",
 		Host:   serverName,
-		Path:   "/.well-known/matrix/client",
+		Path:   "/.well-known/matrix/" + name,
 	}
+	return fetchWellKnownURL(wellKnownURL.String(), output)
+}
 
-	req, err := http.NewRequest("GET", wellKnownURL.String(), nil)
+func fetchWellKnownURL(wellKnownURL string, output interface{}) (found bool, err error) {
+	req, err := http.NewRequest("GET", wellKnownURL, nil)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
 	req.Header.Set("Accept", "application/json")
@@ -117,26 +219,25 @@ func DiscoverClientAPI(serverName string) (*ClientWellKnown, error) {
 	client := &http.Client{Timeout: 30 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound {
-		return nil, nil
+		return false, nil
 	}
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	var wellKnown ClientWellKnown
-	err = json.Unmarshal(data, &wellKnown)
+	err = json.Unmarshal(data, output)
 	if err != nil {
-		return nil, errors.New(".well-known response not JSON")
+		return false, errors.New(".well-known response not JSON")
 	}
 
-	return &wellKnown, nil
+	return true, nil
 }
 
 // SetCredentials sets the user ID and access token on this client instance.
@@ -169,6 +270,9 @@ func (cli *Client) Sync() error {
 }
 
 func (cli *Client) SyncWithContext(ctx context.Context) error {
+	if cli.SyncPresence != "" && !cli.SyncPresence.IsValid() {
+		return fmt.Errorf("%w: %q", ErrInvalidPresence, cli.SyncPresence)
+	}
 	// Mark the client as syncing.
 	// We will keep syncing until the syncing state changes. Either because
 	// Sync is called or StopSync is called.
@@ -176,34 +280,61 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 	nextBatch := cli.Store.LoadNextBatch(cli.UserID)
 	filterID := cli.Store.LoadFilterID(cli.UserID)
 	if filterID == "" {
-		filterJSON := cli.Syncer.GetFilterJSON(cli.UserID)
-		resFilter, err := cli.CreateFilter(filterJSON)
+		var err error
+		filterID, err = cli.createSyncFilter()
 		if err != nil {
 			return err
 		}
-		filterID = resFilter.FilterID
-		cli.Store.SaveFilterID(cli.UserID, filterID)
 	}
 	lastSuccessfulSync := time.Now().Add(-cli.StreamSyncMinAge - 1*time.Hour)
+	recreatedFilter := false
 	for {
 		streamResp := false
 		if cli.StreamSyncMinAge > 0 && time.Since(lastSuccessfulSync) > cli.StreamSyncMinAge {
 			cli.Log.Debug().Msg("Last sync is old, will stream next response")
 			streamResp = true
 		}
-		resSync, err := cli.FullSyncRequest(ReqSync{
-			Timeout:        30000,
+		reqFilter := filterID
+		if nextBatch == "" {
+			reqFilter = cli.initialSyncFilter(filterID)
+		}
+		req := ReqSync{
+			Timeout:        int(cli.syncTimeout().Milliseconds()),
 			Since:          nextBatch,
-			FilterID:       filterID,
+			FilterID:       reqFilter,
 			FullState:      false,
 			SetPresence:    cli.SyncPresence,
 			Context:        ctx,
 			StreamResponse: streamResp,
-		})
+		}
+		if cli.SyncRequestHook != nil {
+			cli.SyncRequestHook(&req)
+		}
+		resSync, err := cli.FullSyncRequest(req)
 		if err != nil {
 			if ctx.Err() != nil {
 				return ctx.Err()
 			}
+			if isInvalidSyncParamError(err) {
+				// The server rejected the request parameters. The stored filter may have been deleted,
+				// or the since token may be from before the server was restored from a backup.
+				// Try recreating the filter first, and if that doesn't help, fall back to an initial sync.
+				if !recreatedFilter {
+					cli.Log.Warn().Err(err).Str("filter_id", filterID).Msg("Sync failed with invalid parameter error, recreating filter")
+					recreatedFilter = true
+					cli.Store.SaveFilterID(cli.UserID, "")
+					filterID, err = cli.createSyncFilter()
+					if err != nil {
+						return err
+					}
+					continue
+				} else if nextBatch != "" {
+					cli.Log.Warn().Err(err).Str("since", nextBatch).Msg("Sync failed with invalid parameter error, resetting since token")
+					nextBatch = ""
+					cli.saveNextBatch("")
+					continue
+				}
+			}
 			duration, err2 := cli.Syncer.OnFailedSync(resSync, err)
 			if err2 != nil {
 				return err2
@@ -216,6 +347,7 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 			}
 		}
 		lastSuccessfulSync = time.Now()
+		recreatedFilter = false
 
 		// Check that the syncing state hasn't changed
 		// Either because we've stopped syncing or another sync has been started.
@@ -227,7 +359,7 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 		// Save the token now *before* processing it. This means it's possible
 		// to not process some events, but it means that we won't get constantly stuck processing
 		// a malformed/buggy event which keeps making us panic.
-		cli.Store.SaveNextBatch(cli.UserID, resSync.NextBatch)
+		cli.saveNextBatch(resSync.NextBatch)
 		if err = cli.Syncer.ProcessResponse(resSync, nextBatch); err != nil {
 			return err
 		}
@@ -236,6 +368,191 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 	}
 }
 
+func (cli *Client) saveNextBatch(nextBatch string) {
+	if !cli.DontSaveNextBatch {
+		cli.Store.SaveNextBatch(cli.UserID, nextBatch)
+	}
+}
+
+// DefaultSyncTimeout is the long-poll timeout used by Sync if Client.SyncTimeout isn't set.
+const DefaultSyncTimeout = 30 * time.Second
+
+func (cli *Client) syncTimeout() time.Duration {
+	if cli.SyncTimeout > 0 {
+		return cli.SyncTimeout
+	}
+	return DefaultSyncTimeout
+}
+
+// initialSyncFilter returns the value for the filter parameter of the initial sync. If the syncer implements
+// InitialSyncFilterer, the initial filter is sent inline, otherwise the normal filter ID is used.
+func (cli *Client) initialSyncFilter(filterID string) string {
+	filterer, ok := cli.Syncer.(InitialSyncFilterer)
+	if !ok {
+		return filterID
+	}
+	initialFilter := filterer.GetInitialFilterJSON(cli.UserID)
+	if initialFilter == nil {
+		return filterID
+	}
+	filterJSON, err := json.Marshal(initialFilter)
+	if err != nil {
+		cli.Log.Warn().Err(err).Msg("Failed to marshal initial sync filter")
+		return filterID
+	}
+	return string(filterJSON)
+}
+
+func (cli *Client) createSyncFilter() (string, error) {
+	resFilter, err := cli.CreateFilter(cli.Syncer.GetFilterJSON(cli.UserID))
+	if err != nil {
+		return "", err
+	}
+	if cli.Store != nil {
+		cli.Store.SaveFilterID(cli.UserID, resFilter.FilterID)
+	}
+	return resFilter.FilterID, nil
+}
+
+// isInvalidSyncParamError checks if the given /sync error means that the server rejected the filter ID or since token.
+func isInvalidSyncParamError(err error) bool {
+	var httpErr HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RespError == nil || !(httpErr.IsStatus(http.StatusBadRequest) || httpErr.IsStatus(http.StatusNotFound)) {
+		return false
+	}
+	switch httpErr.RespError.ErrCode {
+	case "M_UNKNOWN", MInvalidParam.ErrCode, MNotFound.ErrCode:
+		return true
+	default:
+		return false
+	}
+}
+
+// SyncOnce makes a single /sync request without processing the response. The filter ID is loaded from Store,
+// or created using the Syncer's filter if there's no stored filter. If Syncer is nil, no filter is used.
+// The set_presence parameter is taken from SyncPresence.
+//
+// Unlike Sync, this doesn't save the next_batch token, so the caller must pass it in the since parameter of the next call.
+func (cli *Client) SyncOnce(since string, timeout int) (*RespSync, error) {
+	if cli.SyncPresence != "" && !cli.SyncPresence.IsValid() {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPresence, cli.SyncPresence)
+	}
+	var filterID string
+	if cli.Store != nil {
+		filterID = cli.Store.LoadFilterID(cli.UserID)
+	}
+	if filterID == "" && cli.Syncer != nil {
+		var err error
+		filterID, err = cli.createSyncFilter()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cli.FullSyncRequest(ReqSync{
+		Timeout:     timeout,
+		Since:       since,
+		FilterID:    filterID,
+		SetPresence: cli.SyncPresence,
+	})
+}
+
+// syncSingleRoom makes a one-off /sync request with an inline filter that only includes the given room.
+// The returned room is nil if the user isn't joined to the room.
+func (cli *Client) syncSingleRoom(roomID id.RoomID, timelineLimit int) (*SyncJoinedRoom, error) {
+	excludeAll := FilterPart{NotTypes: []event.Type{{Type: "*"}}}
+	filter := &Filter{
+		AccountData: excludeAll,
+		Presence:    excludeAll,
+		Room: RoomFilter{
+			Rooms:       []id.RoomID{roomID},
+			AccountData: excludeAll,
+			Ephemeral:   excludeAll,
+			State:       FilterPart{LazyLoadMembers: true},
+			Timeline:    FilterPart{Limit: timelineLimit},
+		},
+	}
+	filterJSON, err := json.Marshal(filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal filter: %w", err)
+	}
+	resp, err := cli.FullSyncRequest(ReqSync{FilterID: string(filterJSON)})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Rooms.Join[roomID], nil
+}
+
+// GetMemberCount returns the number of joined and invited members in the given room without fetching the full member
+// list when possible. The counts are taken from the room summary of a one-off lazy-loading /sync request that only
+// includes the given room. If the server doesn't return the counts, the joined and invited members are fetched instead.
+func (cli *Client) GetMemberCount(roomID id.RoomID) (joined int, invited int, err error) {
+	room, err := cli.syncSingleRoom(roomID, 1)
+	if err != nil {
+		return 0, 0, err
+	} else if room != nil && room.Summary.JoinedMemberCount != nil && room.Summary.InvitedMemberCount != nil {
+		return *room.Summary.JoinedMemberCount, *room.Summary.InvitedMemberCount, nil
+	}
+	joinedMembers, err := cli.JoinedMembers(roomID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get joined members: %w", err)
+	}
+	invitedMembers, err := cli.Members(roomID, ReqMembers{Membership: event.MembershipInvite})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get invited members: %w", err)
+	}
+	return len(joinedMembers.Joined), len(invitedMembers.Chunk), nil
+}
+
+// FullStateSync makes a single /sync request with full_state=true using the stored next_batch token and filter,
+// which returns the complete current state of every room the user is in. This can be used to recover from drifted
+// or corrupted local state, e.g. after a long downtime.
+//
+// This is expensive for both the client and the server, as the state of every room is included in the response,
+// so it should only be used when necessary. The response isn't passed to the Syncer and the next_batch token isn't saved.
+func (cli *Client) FullStateSync() (*RespSync, error) {
+	var since, filterID string
+	if cli.Store != nil {
+		since = cli.Store.LoadNextBatch(cli.UserID)
+		filterID = cli.Store.LoadFilterID(cli.UserID)
+	}
+	return cli.FullSyncRequest(ReqSync{
+		Since:       since,
+		FilterID:    filterID,
+		FullState:   true,
+		SetPresence: cli.SyncPresence,
+	})
+}
+
+// FetchRoomLatest fetches the latest timeline events in the given room using a one-off /sync request with a filter that
+// only includes that room. The filter is sent inline, so this doesn't affect the filter or next_batch stored for Sync.
+//
+// The returned events have their room ID set, but the content is not parsed.
+func (cli *Client) FetchRoomLatest(roomID id.RoomID, limit int) ([]*event.Event, error) {
+	room, err := cli.syncSingleRoom(roomID, limit)
+	if err != nil || room == nil {
+		return nil, err
+	}
+	for _, evt := range room.Timeline.Events {
+		evt.RoomID = roomID
+	}
+	return room.Timeline.Events, nil
+}
+
+// SyncAsync starts syncing in a new goroutine. The returned channel will receive the return value of Sync
+// once it exits, e.g. after StopSync is called. The channel is buffered, so it doesn't have to be read.
+func (cli *Client) SyncAsync() <-chan error {
+	return cli.SyncAsyncWithContext(context.Background())
+}
+
+// SyncAsyncWithContext is like SyncAsync, but the given context can also be used to stop syncing.
+func (cli *Client) SyncAsyncWithContext(ctx context.Context) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cli.SyncWithContext(ctx)
+	}()
+	return done
+}
+
 func (cli *Client) incrementSyncingID() uint32 {
 	return atomic.AddUint32(&cli.syncingID, 1)
 }
@@ -255,12 +572,18 @@ type contextKey int
 const (
 	LogBodyContextKey contextKey = iota
 	LogRequestIDContextKey
+	// requestClientContextKey stores the Client that is making a request, so that clientTransport uses the headers
+	// of that client even if the HTTP client (and therefore the transport) is shared with a Clone.
+	requestClientContextKey
 )
 
 func (cli *Client) RequestStart(req *http.Request) {
 	if cli.RequestHook != nil {
 		cli.RequestHook(req)
 	}
+	if cli.OnRequest != nil {
+		cli.OnRequest(req.Method, NormalizePath(req.URL.EscapedPath()))
+	}
 }
 
 func (cli *Client) LogRequestDone(req *http.Request, resp *http.Response, err error, handlerErr error, contentLength int, duration time.Duration) {
@@ -277,6 +600,13 @@ func (cli *Client) LogRequestDone(req *http.Request, resp *http.Response, err er
 		Str("method", req.Method).
 		Str("url", req.URL.String()).
 		Dur("duration", duration)
+	if cli.OnResponse != nil {
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		cli.OnResponse(req.Method, NormalizePath(req.URL.EscapedPath()), statusCode, duration)
+	}
 	if resp != nil {
 		if cli.ResponseHook != nil {
 			cli.ResponseHook(req, resp, duration)
@@ -325,6 +655,8 @@ type FullRequest struct {
 	SensitiveContent bool
 	Handler          ClientResponseHandler
 	Logger           *zerolog.Logger
+	// The HTTP client to use for the request. Defaults to Client.Client.
+	Client *http.Client
 }
 
 var requestID int32
@@ -337,7 +669,7 @@ func (params *FullRequest) compileRequest() (*http.Request, error) {
 		params.Context = context.Background()
 	}
 	if params.RequestJSON != nil {
-		jsonStr, err := json.Marshal(params.RequestJSON)
+		jsonStr, err := Marshal(params.RequestJSON)
 		if err != nil {
 			return nil, HTTPError{
 				Message:      "failed to marshal JSON",
@@ -356,6 +688,8 @@ func (params *FullRequest) compileRequest() (*http.Request, error) {
 		params.RequestLength = int64(len(params.RequestBytes))
 	} else if params.RequestLength > 0 && params.RequestBody != nil {
 		logBody = fmt.Sprintf("<%d bytes>", params.RequestLength)
+	} else if params.RequestBody != nil {
+		logBody = "<unknown length>"
 	} else if params.Method != http.MethodGet && params.Method != http.MethodHead {
 		params.RequestJSON = struct{}{}
 		logBody = params.RequestJSON
@@ -411,11 +745,17 @@ func (cli *Client) MakeFullRequest(params FullRequest) ([]byte, error) {
 	if params.Handler == nil {
 		params.Handler = handleNormalResponse
 	}
-	req.Header.Set("User-Agent", cli.UserAgent)
-	if len(cli.AccessToken) > 0 {
-		req.Header.Set("Authorization", "Bearer "+cli.AccessToken)
+	if params.Client == nil {
+		params.Client = cli.Client
 	}
-	return cli.executeCompiledRequest(req, params.MaxAttempts-1, 4*time.Second, params.ResponseJSON, params.Handler)
+	return cli.executeCompiledRequest(req, params.MaxAttempts-1, cli.initialBackoff(), params.ResponseJSON, params.Handler, params.Client)
+}
+
+func (cli *Client) initialBackoff() time.Duration {
+	if cli.DefaultHTTPBackoff > 0 {
+		return cli.DefaultHTTPBackoff
+	}
+	return 4 * time.Second
 }
 
 func (cli *Client) cliOrContextLog(ctx context.Context) *zerolog.Logger {
@@ -426,7 +766,7 @@ func (cli *Client) cliOrContextLog(ctx context.Context) *zerolog.Logger {
 	return log
 }
 
-func (cli *Client) doRetry(req *http.Request, cause error, retries int, backoff time.Duration, responseJSON interface{}, handler ClientResponseHandler) ([]byte, error) {
+func (cli *Client) doRetry(req *http.Request, cause error, retries int, backoff time.Duration, responseJSON interface{}, handler ClientResponseHandler, client *http.Client) ([]byte, error) {
 	log := zerolog.Ctx(req.Context())
 	if req.Body != nil {
 		if req.GetBody == nil {
@@ -444,7 +784,7 @@ func (cli *Client) doRetry(req *http.Request, cause error, retries int, backoff
 		Int("retry_in_seconds", int(backoff.Seconds())).
 		Msg("Request failed, retrying")
 	time.Sleep(backoff)
-	return cli.executeCompiledRequest(req, retries-1, backoff*2, responseJSON, handler)
+	return cli.executeCompiledRequest(req, retries-1, backoff*2, responseJSON, handler, client)
 }
 
 func readRequestBody(req *http.Request, res *http.Response) ([]byte, error) {
@@ -454,13 +794,23 @@ func readRequestBody(req *http.Request, res *http.Response) ([]byte, error) {
 			Request:  req,
 			Response: res,
 
-			Message:      "failed to read response body",
+			Message:      fmt.Sprintf("failed to read response body (HTTP %d)", res.StatusCode),
 			WrappedError: err,
 		}
 	}
 	return contents, nil
 }
 
+// closeResponseBody discards the body of a response that isn't going to be read.
+// A small amount of data is drained first, so that the connection can be reused.
+func closeResponseBody(res *http.Response) {
+	if res == nil || res.Body == nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+	_ = res.Body.Close()
+}
+
 func closeTemp(log *zerolog.Logger, file *os.File) {
 	_ = file.Close()
 	err := os.Remove(file.Name())
@@ -494,7 +844,7 @@ func handleNormalResponse(req *http.Request, res *http.Response, responseJSON in
 		return nil, err
 	} else if responseJSON == nil {
 		return contents, nil
-	} else if err = json.Unmarshal(contents, &responseJSON); err != nil {
+	} else if err = Unmarshal(contents, &responseJSON); err != nil {
 		return nil, HTTPError{
 			Request:  req,
 			Response: res,
@@ -515,7 +865,7 @@ func ParseErrorResponse(req *http.Request, res *http.Response) ([]byte, error) {
 	}
 
 	respErr := &RespError{}
-	if _ = json.Unmarshal(contents, respErr); respErr.ErrCode == "" {
+	if _ = Unmarshal(contents, respErr); respErr.ErrCode == "" {
 		respErr = nil
 	}
 
@@ -556,17 +906,113 @@ func (cli *Client) shouldRetry(res *http.Response) bool {
 		(res.StatusCode == http.StatusTooManyRequests && !cli.IgnoreRateLimit)
 }
 
-func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backoff time.Duration, responseJSON interface{}, handler ClientResponseHandler) ([]byte, error) {
+// isIdempotentRequest checks if the request can be safely retried after a network error, in which case it's not known
+// whether the server received the request. POST requests may have side effects, so they're not considered idempotent,
+// while e.g. PUTs for sending events include a transaction ID, which prevents duplicate sends.
+func isIdempotentRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+// clientTransport is a http.RoundTripper that adds the User-Agent and Authorization headers of a Client to requests.
+// The headers are read when the request is sent, so changing the access token affects requests that are being retried too.
+//
+// If the request was made by a different Client sharing the same HTTP client (e.g. a Clone), the headers of that
+// client are used instead.
+type clientTransport struct {
+	cli  *Client
+	base http.RoundTripper
+}
+
+func (ct *clientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cli := ct.cli
+	if reqCli, ok := req.Context().Value(requestClientContextKey).(*Client); ok {
+		cli = reqCli
+	}
+	req = req.Clone(req.Context())
+	cli.setRequestHeaders(req)
+	base := ct.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
+
+// wrapHTTPClient returns a shallow copy of the given HTTP client with a clientTransport installed.
+// The underlying transport (and therefore the connection pool) is shared with the original client.
+func (cli *Client) wrapHTTPClient(client *http.Client) *http.Client {
+	wrapped := *client
+	wrapped.Transport = &clientTransport{cli: cli, base: client.Transport}
+	return &wrapped
+}
+
+// setRequestHeaders sets the User-Agent and Authorization headers, unless the request already has them.
+// The Authorization header is only added to requests going to the homeserver, as the HTTP client is also used
+// for fetching external URLs (e.g. in UploadLink).
+func (cli *Client) setRequestHeaders(req *http.Request) {
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", cli.UserAgent)
+	}
+	isHomeserver := cli.HomeserverURL == nil || req.URL.Host == cli.HomeserverURL.Host
+	if len(cli.AccessToken) > 0 && isHomeserver && req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "Bearer "+cli.AccessToken)
+	}
+}
+
+// doRequest sends the request using the given HTTP client, unless the RequestInterceptor handles it.
+func (cli *Client) doRequest(req *http.Request, client *http.Client) (*http.Response, error) {
+	if _, ok := client.Transport.(*clientTransport); ok {
+		req = req.WithContext(context.WithValue(req.Context(), requestClientContextKey, cli))
+	} else {
+		// The HTTP client was replaced with one that doesn't add the headers automatically.
+		cli.setRequestHeaders(req)
+	}
+	if cli.RequestInterceptor == nil {
+		return client.Do(req)
+	}
+	var body []byte
+	if req.GetBody != nil {
+		bodyReader, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		body, err = io.ReadAll(bodyReader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	respBody, statusCode, handled := cli.RequestInterceptor(req.Method, req.URL.String(), body)
+	if !handled {
+		return client.Do(req)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(respBody)),
+		ContentLength: int64(len(respBody)),
+		Request:       req,
+	}, nil
+}
+
+func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backoff time.Duration, responseJSON interface{}, handler ClientResponseHandler, client *http.Client) ([]byte, error) {
 	cli.RequestStart(req)
 	startTime := time.Now()
-	res, err := cli.Client.Do(req)
+	res, err := cli.doRequest(req, client)
 	duration := time.Now().Sub(startTime)
-	if res != nil {
-		defer res.Body.Close()
-	}
 	if err != nil {
-		if retries > 0 {
-			return cli.doRetry(req, err, retries, backoff, responseJSON, handler)
+		// http.Client.Do can return a response together with an error (e.g. when CheckRedirect fails).
+		// The response is only included in the returned error for context, the body isn't needed.
+		closeResponseBody(res)
+		if retries > 0 && isIdempotentRequest(req) && req.Context().Err() == nil {
+			return cli.doRetry(req, err, retries, backoff, responseJSON, handler, client)
 		}
 		err = HTTPError{
 			Request:  req,
@@ -579,17 +1025,25 @@ func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backof
 		return nil, err
 	}
 
+	defer res.Body.Close()
+
 	if retries > 0 && cli.shouldRetry(res) {
 		if res.StatusCode == http.StatusTooManyRequests {
 			backoff = parseBackoffFromResponse(req, res, time.Now(), backoff)
 		}
-		return cli.doRetry(req, fmt.Errorf("HTTP %d", res.StatusCode), retries, backoff, responseJSON, handler)
+		// Close the body before sleeping, so the connection isn't held open for the whole retry chain
+		closeResponseBody(res)
+		return cli.doRetry(req, fmt.Errorf("HTTP %d", res.StatusCode), retries, backoff, responseJSON, handler, client)
 	}
 
 	var body []byte
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
 		body, err = ParseErrorResponse(req, res)
 		cli.LogRequestDone(req, res, nil, nil, len(body), duration)
+		var httpErr HTTPError
+		if cli.SoftLogoutHook != nil && errors.As(err, &httpErr) && httpErr.RespError != nil && httpErr.RespError.SoftLogout {
+			cli.SoftLogoutHook(httpErr)
+		}
 	} else {
 		body, err = handler(req, res, responseJSON)
 		cli.LogRequestDone(req, res, nil, err, len(body), duration)
@@ -604,6 +1058,14 @@ func (cli *Client) Whoami() (resp *RespWhoami, err error) {
 	return
 }
 
+// RequestOpenIDToken requests an OpenID token that can be used to prove the user's identity to a third party, such as
+// an integration manager or a widget. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3useruseridopenidrequest_token
+func (cli *Client) RequestOpenIDToken() (resp *RespOpenIDToken, err error) {
+	urlPath := cli.BuildClientURL("v3", "user", cli.UserID, "openid", "request_token")
+	_, err = cli.MakeRequest("POST", urlPath, struct{}{}, &resp)
+	return
+}
+
 // CreateFilter makes an HTTP request according to https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3useruseridfilter
 func (cli *Client) CreateFilter(filter *Filter) (resp *RespCreateFilter, err error) {
 	urlPath := cli.BuildClientURL("v3", "user", cli.UserID, "filter")
@@ -611,6 +1073,16 @@ func (cli *Client) CreateFilter(filter *Filter) (resp *RespCreateFilter, err err
 	return
 }
 
+// GetFilter fetches a previously created filter. See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3useruseridfilterfilterid
+//
+// The filter is returned as raw JSON, so it can be inspected as-is or unmarshaled into a Filter.
+// If the filter doesn't exist (e.g. a stale filter ID from a SyncStore), the error will match MNotFound with errors.Is.
+func (cli *Client) GetFilter(filterID string) (resp json.RawMessage, err error) {
+	urlPath := cli.BuildClientURL("v3", "user", cli.UserID, "filter", filterID)
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
 // SyncRequest makes an HTTP request according to https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3sync
 func (cli *Client) SyncRequest(timeout int, since, filterID string, fullState bool, setPresence event.Presence, ctx context.Context) (resp *RespSync, err error) {
 	return cli.FullSyncRequest(ReqSync{
@@ -632,6 +1104,9 @@ type ReqSync struct {
 
 	Context        context.Context
 	StreamResponse bool
+	// If set, the response is decoded incrementally and rooms are passed to the handler one by one
+	// instead of being stored in the returned RespSync. See DecodeSyncStream for more info.
+	StreamHandler *SyncStreamHandler
 }
 
 func (req *ReqSync) BuildQuery() map[string]string {
@@ -655,6 +1130,9 @@ func (req *ReqSync) BuildQuery() map[string]string {
 
 // FullSyncRequest makes an HTTP request according to https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3sync
 func (cli *Client) FullSyncRequest(req ReqSync) (resp *RespSync, err error) {
+	if req.SetPresence != "" && !req.SetPresence.IsValid() {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPresence, req.SetPresence)
+	}
 	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "sync"}, req.BuildQuery())
 	fullReq := FullRequest{
 		Method:       http.MethodGet,
@@ -664,17 +1142,23 @@ func (cli *Client) FullSyncRequest(req ReqSync) (resp *RespSync, err error) {
 		// We don't want automatic retries for SyncRequest, the Sync() wrapper handles those.
 		MaxAttempts: 1,
 	}
-	if req.StreamResponse {
+	if req.StreamHandler != nil {
+		fullReq.Handler = func(_ *http.Request, res *http.Response, _ interface{}) ([]byte, error) {
+			resp, err = DecodeSyncStream(res.Body, req.StreamHandler)
+			return nil, err
+		}
+	} else if req.StreamResponse {
 		fullReq.Handler = streamResponse
 	}
-	start := time.Now()
-	_, err = cli.MakeFullRequest(fullReq)
-	duration := time.Now().Sub(start)
 	timeout := time.Duration(req.Timeout) * time.Millisecond
 	buffer := 10 * time.Second
 	if req.Since == "" {
 		buffer = 1 * time.Minute
 	}
+	fullReq.Client = cli.longPollClient(timeout + buffer)
+	start := time.Now()
+	_, err = cli.MakeFullRequest(fullReq)
+	duration := time.Now().Sub(start)
 	if err == nil && duration > timeout+buffer {
 		cli.cliOrContextLog(fullReq.Context).Warn().
 			Str("since", req.Since).
@@ -685,6 +1169,20 @@ func (cli *Client) FullSyncRequest(req ReqSync) (resp *RespSync, err error) {
 	return
 }
 
+// longPollClient returns an HTTP client whose timeout won't cut off long-polling requests that take up to the given
+// duration. SyncClient is returned as-is if set. Otherwise, if the timeout of Client.Client is too short, a copy is
+// made that shares the same transport.
+func (cli *Client) longPollClient(duration time.Duration) *http.Client {
+	if cli.SyncClient != nil {
+		return cli.SyncClient
+	} else if cli.Client.Timeout == 0 || cli.Client.Timeout > duration {
+		return cli.Client
+	}
+	clientCopy := *cli.Client
+	clientCopy.Timeout += duration
+	return &clientCopy
+}
+
 // RegisterAvailable checks if a username is valid and available for registration on the server.
 //
 // See https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3registeravailable for more details
@@ -789,6 +1287,29 @@ func (cli *Client) RegisterDummy(req *ReqRegister) (*RespRegister, error) {
 	return res, nil
 }
 
+// RegisterAppService registers a user in the appservice's namespace using the m.login.application_service login type.
+// See https://spec.matrix.org/v1.2/application-service-api/#server-admin-style-permissions
+//
+// The request is made with inhibit_login set, so the response won't contain an access token.
+func (cli *Client) RegisterAppService(username string) (*RespRegister, error) {
+	res, _, err := cli.Register(&ReqRegister{
+		Username:     username,
+		Type:         AuthTypeAppservice,
+		InhibitLogin: true,
+	})
+	return res, err
+}
+
+// EnsureRegistered registers the given username with RegisterAppService,
+// treating an M_USER_IN_USE error as success (i.e. the user already exists).
+func (cli *Client) EnsureRegistered(username string) error {
+	_, err := cli.RegisterAppService(username)
+	if err != nil && !errors.Is(err, MUserInUse) {
+		return err
+	}
+	return nil
+}
+
 // GetLoginFlows fetches the login flows that the homeserver supports using https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3login
 func (cli *Client) GetLoginFlows() (resp *RespLoginFlows, err error) {
 	urlPath := cli.BuildClientURL("v3", "login")
@@ -796,6 +1317,25 @@ func (cli *Client) GetLoginFlows() (resp *RespLoginFlows, err error) {
 	return
 }
 
+// GetAuthMetadata fetches the metadata of the OpenID Connect provider that the homeserver delegates authentication to
+// (MSC2965/MSC3861). If the server doesn't support the full metadata endpoint, the older auth_issuer endpoint is used,
+// in which case only the Issuer field is filled. If the server supports neither, it uses legacy Matrix authentication,
+// and this returns nil without an error.
+func (cli *Client) GetAuthMetadata() (resp *RespAuthMetadata, err error) {
+	urlPath := cli.BuildClientURL("unstable", "org.matrix.msc2965", "auth_metadata")
+	_, err = cli.MakeRequest(http.MethodGet, urlPath, nil, &resp)
+	if !IsEndpointNotSupported(err) {
+		return
+	}
+	resp = nil
+	urlPath = cli.BuildClientURL("unstable", "org.matrix.msc2965", "auth_issuer")
+	_, err = cli.MakeRequest(http.MethodGet, urlPath, nil, &resp)
+	if IsEndpointNotSupported(err) {
+		return nil, nil
+	}
+	return
+}
+
 // Login a user to the homeserver according to https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3login
 func (cli *Client) Login(req *ReqLogin) (resp *RespLogin, err error) {
 	_, err = cli.MakeFullRequest(FullRequest{
@@ -815,23 +1355,32 @@ func (cli *Client) Login(req *ReqLogin) (resp *RespLogin, err error) {
 			Str("device_id", cli.DeviceID.String()).
 			Msg("Stored credentials after login")
 	}
-	if req.StoreHomeserverURL && err == nil && resp.WellKnown != nil && len(resp.WellKnown.Homeserver.BaseURL) > 0 {
-		var urlErr error
-		cli.HomeserverURL, urlErr = url.Parse(resp.WellKnown.Homeserver.BaseURL)
-		if urlErr != nil {
-			cli.Log.Warn().
-				Err(urlErr).
-				Str("homeserver_url", resp.WellKnown.Homeserver.BaseURL).
-				Msg("Failed to parse homeserver URL in login response")
-		} else {
-			cli.Log.Debug().
-				Str("homeserver_url", cli.HomeserverURL.String()).
-				Msg("Updated homeserver URL after login")
-		}
+	if req.StoreHomeserverURL && err == nil {
+		cli.ApplyWellKnown(resp.WellKnown)
 	}
 	return
 }
 
+// ApplyWellKnown updates HomeserverURL to the homeserver base URL in the given .well-known data, e.g. the well_known
+// field in a login response. Nothing is changed if the data doesn't contain a valid base URL.
+func (cli *Client) ApplyWellKnown(wk *ClientWellKnown) {
+	if wk == nil || len(wk.Homeserver.BaseURL) == 0 {
+		return
+	}
+	hsURL, err := url.Parse(wk.Homeserver.BaseURL)
+	if err != nil {
+		cli.Log.Warn().
+			Err(err).
+			Str("homeserver_url", wk.Homeserver.BaseURL).
+			Msg("Failed to parse homeserver URL in well-known data")
+		return
+	}
+	cli.HomeserverURL = hsURL
+	cli.Log.Debug().
+		Str("homeserver_url", cli.HomeserverURL.String()).
+		Msg("Updated homeserver URL from well-known data")
+}
+
 // Logout the current user. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3logout
 // This does not clear the credentials from the client instance. See ClearCredentials() instead.
 func (cli *Client) Logout() (resp *RespLogout, err error) {
@@ -849,12 +1398,79 @@ func (cli *Client) LogoutAll() (resp *RespLogout, err error) {
 }
 
 // Versions returns the list of supported Matrix versions on this homeserver. See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientversions
+//
+// This always makes a request to the server. The response is also stored in the cache used by CachedVersions.
 func (cli *Client) Versions() (resp *RespVersions, err error) {
+	resp, err = cli.fetchVersions()
+	if err == nil {
+		cli.versionsLock.Lock()
+		cli.versionsCache = resp
+		cli.versionsLock.Unlock()
+	}
+	return
+}
+
+func (cli *Client) fetchVersions() (resp *RespVersions, err error) {
 	urlPath := cli.BuildClientURL("versions")
 	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
 	return
 }
 
+// CachedVersions returns the list of supported Matrix versions on this homeserver. The versions are only fetched from
+// the server if they haven't been fetched before, or if the cache was cleared with InvalidateVersionsCache.
+//
+// The cache lock is not held while fetching, so concurrent calls with an empty cache may each make a request.
+func (cli *Client) CachedVersions() (*RespVersions, error) {
+	cli.versionsLock.Lock()
+	cached := cli.versionsCache
+	cli.versionsLock.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+	resp, err := cli.fetchVersions()
+	if err != nil {
+		return nil, err
+	}
+	cli.versionsLock.Lock()
+	defer cli.versionsLock.Unlock()
+	if cli.versionsCache == nil {
+		cli.versionsCache = resp
+	}
+	return cli.versionsCache, nil
+}
+
+// InvalidateVersionsCache clears the cached versions, so that the next call to CachedVersions fetches them again.
+// This should be called if the homeserver may have been upgraded.
+func (cli *Client) InvalidateVersionsCache() {
+	cli.versionsLock.Lock()
+	cli.versionsCache = nil
+	cli.versionsLock.Unlock()
+}
+
+// SupportsVersion checks if the homeserver advertises support for the given spec version (e.g. v1.7) in /versions.
+// The versions are cached, see CachedVersions for details.
+func (cli *Client) SupportsVersion(version string) (bool, error) {
+	parsed, err := ParseSpecVersion(version)
+	if err != nil {
+		return false, err
+	}
+	versions, err := cli.CachedVersions()
+	if err != nil {
+		return false, err
+	}
+	return versions.Contains(parsed), nil
+}
+
+// SupportsUnstableFeature checks if the homeserver has enabled the given unstable feature flag in /versions.
+// The versions are cached, see CachedVersions for details.
+func (cli *Client) SupportsUnstableFeature(feature string) (bool, error) {
+	versions, err := cli.CachedVersions()
+	if err != nil {
+		return false, err
+	}
+	return versions.UnstableFeatures[feature], nil
+}
+
 // Capabilities returns capabilities on this homeserver. See https://spec.matrix.org/v1.3/client-server-api/#capabilities-negotiation
 func (cli *Client) Capabilities() (resp *RespCapabilities, err error) {
 	urlPath := cli.BuildClientURL("v3", "capabilities")
@@ -999,6 +1615,59 @@ func (cli *Client) SetRoomAccountData(roomID id.RoomID, name string, data interf
 	return nil
 }
 
+func (cli *Client) getIgnoredUserList() (*event.IgnoredUserListEventContent, error) {
+	var content event.IgnoredUserListEventContent
+	err := cli.GetAccountData(event.AccountDataIgnoredUserList.Type, &content)
+	if err != nil && !errors.Is(err, MNotFound) {
+		return nil, err
+	}
+	if content.IgnoredUsers == nil {
+		content.IgnoredUsers = make(map[id.UserID]event.IgnoredUser)
+	}
+	return &content, nil
+}
+
+// GetIgnoredUsers returns the list of users that the user has ignored, as stored in the m.ignored_user_list account data.
+// See https://spec.matrix.org/v1.2/client-server-api/#ignoring-users
+func (cli *Client) GetIgnoredUsers() ([]id.UserID, error) {
+	content, err := cli.getIgnoredUserList()
+	if err != nil {
+		return nil, err
+	}
+	userIDs := make([]id.UserID, 0, len(content.IgnoredUsers))
+	for userID := range content.IgnoredUsers {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Slice(userIDs, func(i, j int) bool {
+		return userIDs[i] < userIDs[j]
+	})
+	return userIDs, nil
+}
+
+// IgnoreUser adds the given user to the ignored user list. Nothing is sent if the user is already ignored.
+func (cli *Client) IgnoreUser(userID id.UserID) error {
+	content, err := cli.getIgnoredUserList()
+	if err != nil {
+		return err
+	} else if _, alreadyIgnored := content.IgnoredUsers[userID]; alreadyIgnored {
+		return nil
+	}
+	content.IgnoredUsers[userID] = event.IgnoredUser{}
+	return cli.SetAccountData(event.AccountDataIgnoredUserList.Type, content)
+}
+
+// UnignoreUser removes the given user from the ignored user list. Nothing is sent if the user isn't ignored.
+func (cli *Client) UnignoreUser(userID id.UserID) error {
+	content, err := cli.getIgnoredUserList()
+	if err != nil {
+		return err
+	} else if _, ignored := content.IgnoredUsers[userID]; !ignored {
+		return nil
+	}
+	delete(content.IgnoredUsers, userID)
+	return cli.SetAccountData(event.AccountDataIgnoredUserList.Type, content)
+}
+
 type ReqSendEvent struct {
 	Timestamp     int64
 	TransactionID string
@@ -1008,6 +1677,11 @@ type ReqSendEvent struct {
 	MeowEventID id.EventID
 }
 
+type ReqSendStateEvent struct {
+	// The timestamp to use for the event. Only available for appservices.
+	Timestamp int64
+}
+
 // SendMessageEvent sends a message event into a room. See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3roomsroomidsendeventtypetxnid
 // contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
 func (cli *Client) SendMessageEvent(roomID id.RoomID, eventType event.Type, contentJSON interface{}, extra ...ReqSendEvent) (resp *RespSendEvent, err error) {
@@ -1022,6 +1696,8 @@ func (cli *Client) SendMessageEvent(roomID id.RoomID, eventType event.Type, cont
 	} else {
 		txnID = cli.TxnID()
 	}
+	// Track the transaction before sending, as the echo may come down sync before the send request returns
+	cli.trackSentTransaction(txnID)
 
 	queryParams := map[string]string{}
 	if req.Timestamp > 0 {
@@ -1031,26 +1707,81 @@ func (cli *Client) SendMessageEvent(roomID id.RoomID, eventType event.Type, cont
 		queryParams["fi.mau.event_id"] = req.MeowEventID.String()
 	}
 
-	if !req.DontEncrypt && cli.Crypto != nil && eventType != event.EventReaction && eventType != event.EventEncrypted && cli.StateStore.IsEncrypted(roomID) {
-		contentJSON, err = cli.Crypto.Encrypt(roomID, eventType, contentJSON)
-		if err != nil {
-			err = fmt.Errorf("failed to encrypt event: %w", err)
-			return
+	err = cli.queueRoomSend(roomID, func() error {
+		if !req.DontEncrypt && cli.Crypto != nil && eventType != event.EventReaction && eventType != event.EventEncrypted && cli.StateStore.IsEncrypted(roomID) {
+			var err error
+			contentJSON, err = cli.Crypto.Encrypt(roomID, eventType, contentJSON)
+			if err != nil {
+				return fmt.Errorf("failed to encrypt event: %w", err)
+			}
+			eventType = event.EventEncrypted
 		}
-		eventType = event.EventEncrypted
-	}
 
-	urlData := ClientURLPath{"v3", "rooms", roomID, "send", eventType.String(), txnID}
-	urlPath := cli.BuildURLWithQuery(urlData, queryParams)
-	_, err = cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
+		urlData := ClientURLPath{"v3", "rooms", roomID, "send", eventType.String(), txnID}
+		urlPath := cli.BuildURLWithQuery(urlData, queryParams)
+		_, err := cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
+		return err
+	})
+	return
+}
+
+// SendRawEvent sends a message event with pre-serialized content into a room. Unlike SendMessageEvent, the content is
+// sent verbatim without being re-marshaled, which preserves key order and any custom fields. If txnID is empty, a new
+// transaction ID is generated.
+//
+// If the room is encrypted and a crypto helper is set, the content will still be encrypted, which necessarily means
+// it's re-serialized inside the encrypted payload.
+func (cli *Client) SendRawEvent(roomID id.RoomID, eventType event.Type, rawContent json.RawMessage, txnID string) (resp *RespSendEvent, err error) {
+	if len(txnID) == 0 {
+		txnID = cli.TxnID()
+	}
+	cli.trackSentTransaction(txnID)
+	err = cli.queueRoomSend(roomID, func() error {
+		if cli.Crypto != nil && eventType != event.EventReaction && eventType != event.EventEncrypted && cli.StateStore.IsEncrypted(roomID) {
+			encrypted, err := cli.Crypto.Encrypt(roomID, eventType, rawContent)
+			if err != nil {
+				return fmt.Errorf("failed to encrypt event: %w", err)
+			}
+			_, err = cli.MakeRequest("PUT", cli.BuildClientURL("v3", "rooms", roomID, "send", event.EventEncrypted.String(), txnID), encrypted, &resp)
+			return err
+		}
+		_, err := cli.MakeFullRequest(FullRequest{
+			Method:       "PUT",
+			URL:          cli.BuildClientURL("v3", "rooms", roomID, "send", eventType.String(), txnID),
+			Headers:      http.Header{"Content-Type": {"application/json"}},
+			RequestBytes: rawContent,
+			ResponseJSON: &resp,
+		})
+		return err
+	})
 	return
 }
 
+// queueRoomSend calls fn through the RoomSendQueue if one is set, or directly otherwise.
+func (cli *Client) queueRoomSend(roomID id.RoomID, fn func() error) error {
+	if cli.RoomSendQueue == nil {
+		return fn()
+	}
+	return cli.RoomSendQueue.Do(context.Background(), roomID, fn)
+}
+
 // SendStateEvent sends a state event into a room. See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3roomsroomidstateeventtypestatekey
 // contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
-func (cli *Client) SendStateEvent(roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}) (resp *RespSendEvent, err error) {
-	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "state", eventType.String(), stateKey)
-	_, err = cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
+func (cli *Client) SendStateEvent(roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}, extra ...ReqSendStateEvent) (resp *RespSendEvent, err error) {
+	var req ReqSendStateEvent
+	if len(extra) > 0 {
+		req = extra[0]
+	}
+
+	queryParams := map[string]string{}
+	if req.Timestamp > 0 {
+		queryParams["ts"] = strconv.FormatInt(req.Timestamp, 10)
+	}
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "rooms", roomID, "state", eventType.String(), stateKey}, queryParams)
+	err = cli.queueRoomSend(roomID, func() error {
+		_, err := cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
+		return err
+	})
 	if err == nil && cli.StateStore != nil {
 		cli.updateStoreWithOutgoingEvent(roomID, eventType, stateKey, contentJSON)
 	}
@@ -1059,15 +1790,35 @@ func (cli *Client) SendStateEvent(roomID id.RoomID, eventType event.Type, stateK
 
 // SendMassagedStateEvent sends a state event into a room with a custom timestamp. See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3roomsroomidstateeventtypestatekey
 // contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
+//
+// Deprecated: use SendStateEvent with ReqSendStateEvent.Timestamp instead.
 func (cli *Client) SendMassagedStateEvent(roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}, ts int64) (resp *RespSendEvent, err error) {
-	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "rooms", roomID, "state", eventType.String(), stateKey}, map[string]string{
-		"ts": strconv.FormatInt(ts, 10),
-	})
-	_, err = cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
-	if err == nil && cli.StateStore != nil {
-		cli.updateStoreWithOutgoingEvent(roomID, eventType, stateKey, contentJSON)
+	return cli.SendStateEvent(roomID, eventType, stateKey, contentJSON, ReqSendStateEvent{Timestamp: ts})
+}
+
+// SendStateEventIfChanged sends a state event into a room, unless the current state event with the same type and state
+// key already has the same content. The contents are compared as canonical JSON, so the order of keys doesn't matter,
+// but e.g. empty fields that the server omits will count as a difference. The returned bool is true if the event was sent.
+func (cli *Client) SendStateEventIfChanged(roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}) (*RespSendEvent, bool, error) {
+	var current json.RawMessage
+	err := cli.StateEvent(roomID, eventType, stateKey, &current)
+	if err != nil && !errors.Is(err, MNotFound) {
+		return nil, false, fmt.Errorf("failed to get current state: %w", err)
+	} else if err == nil {
+		currentCanonical, err := canonicaljson.CanonicalJSON(current)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to canonicalize current state: %w", err)
+		}
+		newCanonical, err := canonicaljson.Marshal(contentJSON)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to marshal new state: %w", err)
+		}
+		if bytes.Equal(currentCanonical, newCanonical) {
+			return nil, false, nil
+		}
 	}
-	return
+	resp, err := cli.SendStateEvent(roomID, eventType, stateKey, contentJSON)
+	return resp, err == nil, err
 }
 
 // SendText sends an m.room.message event into the given room with a msgtype of m.text
@@ -1121,6 +1872,29 @@ func (cli *Client) RedactEvent(roomID id.RoomID, eventID id.EventID, extra ...Re
 	return
 }
 
+// ReportEvent reports an event to the server admins. The score must be between -100 (most offensive) and 0 (inoffensive).
+// See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3roomsroomidreporteventid
+func (cli *Client) ReportEvent(roomID id.RoomID, eventID id.EventID, reason string, score int) error {
+	if score < -100 || score > 0 {
+		return fmt.Errorf("%w (got %d)", ErrInvalidReportScore, score)
+	}
+	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "report", eventID)
+	_, err := cli.MakeRequest("POST", urlPath, &ReqReport{Reason: reason, Score: score}, nil)
+	return err
+}
+
+// ReportRoom reports an entire room to the server admins. See https://github.com/matrix-org/matrix-spec-proposals/pull/4151
+//
+// Servers that only implement the unstable version of the endpoint can be used by setting ReportRoomUnstablePrefix.
+func (cli *Client) ReportRoom(roomID id.RoomID, reason string) error {
+	path := ClientURLPath{"v3", "rooms", roomID, "report"}
+	if cli.ReportRoomUnstablePrefix != "" {
+		path = ClientURLPath{"unstable", cli.ReportRoomUnstablePrefix, "rooms", roomID, "report"}
+	}
+	_, err := cli.MakeRequest("POST", cli.BuildURL(path), &ReqReportRoom{Reason: reason}, nil)
+	return err
+}
+
 // CreateRoom creates a new Matrix room. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3createroom
 //
 //	resp, err := cli.CreateRoom(&mautrix.ReqCreateRoom{
@@ -1149,6 +1923,18 @@ func (cli *Client) CreateRoom(req *ReqCreateRoom) (resp *RespCreateRoom, err err
 	return
 }
 
+// CreateDMWith creates a direct chat room with the given user. The room is created with the trusted_private_chat
+// preset, which gives the invited user the same power level as the creator.
+//
+// This doesn't update the m.direct account data event, which clients use to find direct chats.
+func (cli *Client) CreateDMWith(userID id.UserID) (*RespCreateRoom, error) {
+	return cli.CreateRoom(&ReqCreateRoom{
+		Preset:   "trusted_private_chat",
+		IsDirect: true,
+		Invite:   []id.UserID{userID},
+	})
+}
+
 // LeaveRoom leaves the given room. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3roomsroomidleave
 func (cli *Client) LeaveRoom(roomID id.RoomID, optionalReq ...*ReqLeave) (resp *RespLeaveRoom, err error) {
 	req := &ReqLeave{}
@@ -1219,11 +2005,49 @@ func (cli *Client) UnbanUser(roomID id.RoomID, req *ReqUnbanUser) (resp *RespUnb
 	return
 }
 
+// SetRoomMemberProfile sets the per-room displayname and avatar of a user by sending a new m.room.member event.
+// The current member event is fetched first, so that the membership and any other fields are preserved.
+// Empty values remove the per-room displayname or avatar. The user must be joined to the room.
+//
+// Users can normally only change their own member events, but appservices can use this to set per-room profiles
+// for their ghost users.
+func (cli *Client) SetRoomMemberProfile(roomID id.RoomID, userID id.UserID, displayName string, avatarURL id.ContentURIString) error {
+	var content map[string]interface{}
+	err := cli.StateEvent(roomID, event.StateMember, userID.String(), &content)
+	if err != nil {
+		return fmt.Errorf("failed to get current member event: %w", err)
+	} else if membership, _ := content["membership"].(string); event.Membership(membership) != event.MembershipJoin {
+		return fmt.Errorf("%s isn't joined to %s (membership: %q)", userID, roomID, membership)
+	}
+	if displayName != "" {
+		content["displayname"] = displayName
+	} else {
+		delete(content, "displayname")
+	}
+	if avatarURL != "" {
+		content["avatar_url"] = avatarURL
+	} else {
+		delete(content, "avatar_url")
+	}
+	_, err = cli.SendStateEvent(roomID, event.StateMember, userID.String(), content)
+	return err
+}
+
 // UserTyping sets the typing status of the user. See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3roomsroomidtypinguserid
+//
+// If SuppressPresence is set, or if PresenceRateLimit is set and a typing update was sent to the same room recently,
+// the request is silently dropped and both the response and the error are nil.
 func (cli *Client) UserTyping(roomID id.RoomID, typing bool, timeout time.Duration) (resp *RespTyping, err error) {
+	limiterKey := "typing:" + roomID.String()
+	if cli.SuppressPresence || !cli.presenceLimiter.allow(limiterKey, cli.PresenceRateLimit) {
+		return nil, nil
+	}
 	req := ReqTyping{Typing: typing, Timeout: timeout.Milliseconds()}
 	u := cli.BuildClientURL("v3", "rooms", roomID, "typing", cli.UserID)
 	_, err = cli.MakeRequest("PUT", u, req, &resp)
+	if err != nil {
+		cli.presenceLimiter.forget(limiterKey)
+	}
 	return
 }
 
@@ -1240,10 +2064,22 @@ func (cli *Client) GetOwnPresence() (resp *RespPresence, err error) {
 	return cli.GetPresence(cli.UserID)
 }
 
+// SetPresence sets the user's presence. See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3presenceuseridstatus
+//
+// If SuppressPresence is set, or if PresenceRateLimit is set and presence was set recently, the request is silently
+// dropped and nil is returned.
 func (cli *Client) SetPresence(status event.Presence) (err error) {
+	if !status.IsValid() {
+		return fmt.Errorf("%w: %q", ErrInvalidPresence, status)
+	} else if cli.SuppressPresence || !cli.presenceLimiter.allow("presence", cli.PresenceRateLimit) {
+		return nil
+	}
 	req := ReqPresence{Presence: status}
 	u := cli.BuildClientURL("v3", "presence", cli.UserID, "status")
 	_, err = cli.MakeRequest("PUT", u, req, nil)
+	if err != nil {
+		cli.presenceLimiter.forget("presence")
+	}
 	return
 }
 
@@ -1292,6 +2128,200 @@ func (cli *Client) StateEvent(roomID id.RoomID, eventType event.Type, stateKey s
 	return
 }
 
+// optionalStateEvent is like StateEvent, but doesn't return an error if the state event doesn't exist.
+func (cli *Client) optionalStateEvent(roomID id.RoomID, eventType event.Type, stateKey string, outContent interface{}) error {
+	err := cli.StateEvent(roomID, eventType, stateKey, outContent)
+	if errors.Is(err, MNotFound) {
+		return nil
+	}
+	return err
+}
+
+// GetRoomName gets the name of the given room from the m.room.name state event.
+// If the room doesn't have a name, the canonical alias is returned instead. If neither exist, the name is empty.
+func (cli *Client) GetRoomName(roomID id.RoomID) (string, error) {
+	var content event.RoomNameEventContent
+	err := cli.optionalStateEvent(roomID, event.StateRoomName, "", &content)
+	if err != nil || content.Name != "" {
+		return content.Name, err
+	}
+	var aliasContent event.CanonicalAliasEventContent
+	err = cli.optionalStateEvent(roomID, event.StateCanonicalAlias, "", &aliasContent)
+	return string(aliasContent.Alias), err
+}
+
+// SetRoomName sets the name of the given room by sending a m.room.name state event.
+func (cli *Client) SetRoomName(roomID id.RoomID, name string) (*RespSendEvent, error) {
+	return cli.SendStateEvent(roomID, event.StateRoomName, "", &event.RoomNameEventContent{Name: name})
+}
+
+// GetRoomTopic gets the topic of the given room from the m.room.topic state event.
+// If the room doesn't have a topic, the returned topic is empty.
+func (cli *Client) GetRoomTopic(roomID id.RoomID) (string, error) {
+	var content event.TopicEventContent
+	err := cli.optionalStateEvent(roomID, event.StateTopic, "", &content)
+	return content.Topic, err
+}
+
+// SetRoomTopic sets the topic of the given room by sending a m.room.topic state event.
+func (cli *Client) SetRoomTopic(roomID id.RoomID, topic string) (*RespSendEvent, error) {
+	return cli.SendStateEvent(roomID, event.StateTopic, "", &event.TopicEventContent{Topic: topic})
+}
+
+// GetRoomAvatar gets the avatar URL of the given room from the m.room.avatar state event.
+// If the room doesn't have an avatar, the returned URL is empty.
+func (cli *Client) GetRoomAvatar(roomID id.RoomID) (id.ContentURI, error) {
+	var content event.RoomAvatarEventContent
+	err := cli.optionalStateEvent(roomID, event.StateRoomAvatar, "", &content)
+	return content.URL, err
+}
+
+// SetRoomAvatar sets the avatar of the given room by sending a m.room.avatar state event.
+func (cli *Client) SetRoomAvatar(roomID id.RoomID, avatarURL id.ContentURI) (*RespSendEvent, error) {
+	return cli.SendStateEvent(roomID, event.StateRoomAvatar, "", &event.RoomAvatarEventContent{URL: avatarURL})
+}
+
+// GetCanonicalAlias gets the canonical alias and alternative aliases of the given room from the m.room.canonical_alias
+// state event. If the room doesn't have a canonical alias, both return values are empty.
+//
+// Note that this is room state, which is separate from the alias directory managed with CreateAlias and DeleteAlias.
+func (cli *Client) GetCanonicalAlias(roomID id.RoomID) (id.RoomAlias, []id.RoomAlias, error) {
+	var content event.CanonicalAliasEventContent
+	err := cli.optionalStateEvent(roomID, event.StateCanonicalAlias, "", &content)
+	return content.Alias, content.AltAliases, err
+}
+
+// SetCanonicalAlias sets the canonical alias and alternative aliases of the given room by sending a
+// m.room.canonical_alias state event. The aliases must already point at the room in the alias directory
+// (see CreateAlias), otherwise the server will reject the event.
+func (cli *Client) SetCanonicalAlias(roomID id.RoomID, alias id.RoomAlias, altAliases []id.RoomAlias) (*RespSendEvent, error) {
+	return cli.SendStateEvent(roomID, event.StateCanonicalAlias, "", &event.CanonicalAliasEventContent{
+		Alias:      alias,
+		AltAliases: altAliases,
+	})
+}
+
+// GetJoinRule gets the join rule and allow conditions of the given room from the m.room.join_rules state event.
+// If the room doesn't have a join rules event, the join rule defaults to invite.
+func (cli *Client) GetJoinRule(roomID id.RoomID) (*event.JoinRulesEventContent, error) {
+	var content event.JoinRulesEventContent
+	err := cli.optionalStateEvent(roomID, event.StateJoinRules, "", &content)
+	if err != nil {
+		return nil, err
+	} else if content.JoinRule == "" {
+		content.JoinRule = event.JoinRuleInvite
+	}
+	return &content, nil
+}
+
+// SetJoinRule sets the join rule of the given room by sending a m.room.join_rules state event. The allow conditions
+// (e.g. membership in a parent space) can only be specified for the restricted and knock_restricted join rules.
+func (cli *Client) SetJoinRule(roomID id.RoomID, rule event.JoinRule, allow []event.JoinRuleAllow) (*RespSendEvent, error) {
+	if !rule.IsValid() {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidJoinRule, rule)
+	} else if len(allow) > 0 && !rule.IsRestricted() {
+		return nil, fmt.Errorf("%w: allow conditions can't be used with %q", ErrInvalidJoinRule, rule)
+	}
+	return cli.SendStateEvent(roomID, event.StateJoinRules, "", &event.JoinRulesEventContent{
+		JoinRule: rule,
+		Allow:    allow,
+	})
+}
+
+// GetHistoryVisibility gets the history visibility of the given room from the m.room.history_visibility state event.
+// If the room doesn't have a history visibility event, the visibility defaults to shared.
+func (cli *Client) GetHistoryVisibility(roomID id.RoomID) (event.HistoryVisibility, error) {
+	var content event.HistoryVisibilityEventContent
+	err := cli.optionalStateEvent(roomID, event.StateHistoryVisibility, "", &content)
+	if err == nil && content.HistoryVisibility == "" {
+		content.HistoryVisibility = event.HistoryVisibilityShared
+	}
+	return content.HistoryVisibility, err
+}
+
+// SetHistoryVisibility sets the history visibility of the given room by sending a m.room.history_visibility state event.
+func (cli *Client) SetHistoryVisibility(roomID id.RoomID, visibility event.HistoryVisibility) (*RespSendEvent, error) {
+	return cli.SendStateEvent(roomID, event.StateHistoryVisibility, "", &event.HistoryVisibilityEventContent{
+		HistoryVisibility: visibility,
+	})
+}
+
+// GetEncryptionEvent gets the m.room.encryption state event of the given room. If the room isn't encrypted,
+// both the content and the error will be nil.
+func (cli *Client) GetEncryptionEvent(roomID id.RoomID) (*event.EncryptionEventContent, error) {
+	var content event.EncryptionEventContent
+	err := cli.optionalStateEvent(roomID, event.StateEncryption, "", &content)
+	if err != nil || content.Algorithm == "" {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// EnableEncryption enables Megolm encryption in the given room by sending a m.room.encryption state event.
+// Zero rotation periods are omitted from the event, which means clients will use the defaults of one week
+// and 100 messages. Note that encryption can't be disabled after it has been enabled.
+func (cli *Client) EnableEncryption(roomID id.RoomID, rotationPeriodMillis int64, rotationPeriodMessages int) (*RespSendEvent, error) {
+	if rotationPeriodMillis < 0 {
+		return nil, fmt.Errorf("invalid rotation period %d ms: must not be negative", rotationPeriodMillis)
+	} else if rotationPeriodMessages < 0 {
+		return nil, fmt.Errorf("invalid rotation period %d messages: must not be negative", rotationPeriodMessages)
+	}
+	return cli.SendStateEvent(roomID, event.StateEncryption, "", &event.EncryptionEventContent{
+		Algorithm:              id.AlgorithmMegolmV1,
+		RotationPeriodMillis:   rotationPeriodMillis,
+		RotationPeriodMessages: rotationPeriodMessages,
+	})
+}
+
+// GetRoomTombstone gets the m.room.tombstone state event of the given room. If the room hasn't been replaced,
+// both the content and the error will be nil.
+func (cli *Client) GetRoomTombstone(roomID id.RoomID) (*event.TombstoneEventContent, error) {
+	var content event.TombstoneEventContent
+	err := cli.optionalStateEvent(roomID, event.StateTombstone, "", &content)
+	if err != nil || content.ReplacementRoom == "" {
+		// Either there is no tombstone, or it has no replacement room, which is invalid and doesn't point anywhere
+		return nil, err
+	}
+	return &content, nil
+}
+
+// FollowTombstone checks if the given room has been replaced with a tombstone, and joins the replacement room if so.
+// The returned room ID is the replacement room, or empty if the room hasn't been replaced.
+func (cli *Client) FollowTombstone(roomID id.RoomID) (id.RoomID, error) {
+	tombstone, err := cli.GetRoomTombstone(roomID)
+	if err != nil || tombstone == nil {
+		return "", err
+	}
+	_, err = cli.JoinRoomByID(tombstone.ReplacementRoom)
+	if err != nil {
+		return "", fmt.Errorf("failed to join replacement room %s: %w", tombstone.ReplacementRoom, err)
+	}
+	return tombstone.ReplacementRoom, nil
+}
+
+// GetRoomVersion gets the version of the given room from its m.room.create event.
+// The room_version field is missing in rooms created before room versions existed, which means the version is "1".
+func (cli *Client) GetRoomVersion(roomID id.RoomID) (string, error) {
+	var content event.CreateEventContent
+	err := cli.StateEvent(roomID, event.StateCreate, "", &content)
+	if err != nil {
+		return "", err
+	} else if content.RoomVersion == "" {
+		return "1", nil
+	}
+	return content.RoomVersion, nil
+}
+
+// IsSpace checks if the given room is a space, i.e. if the type in its m.room.create event is m.space.
+func (cli *Client) IsSpace(roomID id.RoomID) (bool, error) {
+	var content event.CreateEventContent
+	err := cli.StateEvent(roomID, event.StateCreate, "", &content)
+	if err != nil {
+		return false, err
+	}
+	return content.Type == event.RoomTypeSpace, nil
+}
+
 // parseRoomStateArray parses a JSON array as a stream and stores the events inside it in a room state map.
 func parseRoomStateArray(_ *http.Request, res *http.Response, responseJSON interface{}) ([]byte, error) {
 	response := make(RoomStateMap)
@@ -1353,7 +2383,7 @@ func (cli *Client) State(roomID id.RoomID) (stateMap RoomStateMap, err error) {
 
 // GetMediaConfig fetches the configuration of the content repository, such as upload limitations.
 func (cli *Client) GetMediaConfig() (resp *RespMediaConfig, err error) {
-	u := cli.BuildURL(MediaURLPath{"v3", "config"})
+	u := cli.BuildURL(cli.mediaURLPath("config"))
 	_, err = cli.MakeRequest("GET", u, nil, &resp)
 	return
 }
@@ -1370,8 +2400,51 @@ func (cli *Client) UploadLink(link string) (*RespMediaUpload, error) {
 	return cli.Upload(res.Body, res.Header.Get("Content-Type"), res.ContentLength)
 }
 
+// GetDownloadURL returns the HTTP URL for downloading the given media. The URL doesn't include any authentication,
+// so on servers that require authentication for media, it can't be used directly e.g. in HTML.
 func (cli *Client) GetDownloadURL(mxcURL id.ContentURI) string {
-	return cli.BuildURLWithQuery(MediaURLPath{"v3", "download", mxcURL.Homeserver, mxcURL.FileID}, map[string]string{"allow_redirect": "true"})
+	return cli.BuildURLWithQuery(cli.mediaURLPath("download", mxcURL.Homeserver, mxcURL.FileID), map[string]string{"allow_redirect": "true"})
+}
+
+// GetThumbnailURL returns the HTTP URL for a thumbnail of the given media. The method should be "crop" or "scale".
+//
+// Like with GetDownloadURL, the URL doesn't include any authentication.
+func (cli *Client) GetThumbnailURL(mxcURL id.ContentURI, width, height int, method string) string {
+	query := map[string]string{
+		"width":          strconv.Itoa(width),
+		"height":         strconv.Itoa(height),
+		"allow_redirect": "true",
+	}
+	if method != "" {
+		query["method"] = method
+	}
+	return cli.BuildURLWithQuery(cli.mediaURLPath("thumbnail", mxcURL.Homeserver, mxcURL.FileID), query)
+}
+
+// ParseDownloadURL parses the given mxc:// URI and returns the HTTP URL for downloading it. See GetDownloadURL.
+func (cli *Client) ParseDownloadURL(mxcURL string) (string, error) {
+	parsed, err := parseNonEmptyContentURI(mxcURL)
+	if err != nil {
+		return "", err
+	}
+	return cli.GetDownloadURL(parsed), nil
+}
+
+// ParseThumbnailURL parses the given mxc:// URI and returns the HTTP URL for a thumbnail of it. See GetThumbnailURL.
+func (cli *Client) ParseThumbnailURL(mxcURL string, width, height int, method string) (string, error) {
+	parsed, err := parseNonEmptyContentURI(mxcURL)
+	if err != nil {
+		return "", err
+	}
+	return cli.GetThumbnailURL(parsed, width, height, method), nil
+}
+
+func parseNonEmptyContentURI(mxcURL string) (id.ContentURI, error) {
+	parsed, err := id.ParseContentURI(mxcURL)
+	if err == nil && parsed.IsEmpty() {
+		err = id.InvalidContentURI
+	}
+	return parsed, err
 }
 
 func (cli *Client) Download(mxcURL id.ContentURI) (io.ReadCloser, error) {
@@ -1386,6 +2459,36 @@ func (cli *Client) DownloadContext(ctx context.Context, mxcURL id.ContentURI) (i
 	return resp.Body, nil
 }
 
+// MediaMeta contains the metadata of downloaded media from the response headers.
+type MediaMeta struct {
+	ContentType string
+	// The length of the content, or -1 if unknown.
+	ContentLength int64
+	// The filename from the Content-Disposition header, or empty if there is none.
+	Filename string
+}
+
+// DownloadWithMeta downloads the given media and returns the body along with the content type, length and filename.
+func (cli *Client) DownloadWithMeta(mxcURL id.ContentURI) (io.ReadCloser, *MediaMeta, error) {
+	return cli.DownloadWithMetaContext(context.Background(), mxcURL)
+}
+
+func (cli *Client) DownloadWithMetaContext(ctx context.Context, mxcURL id.ContentURI) (io.ReadCloser, *MediaMeta, error) {
+	resp, err := cli.downloadContext(ctx, mxcURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := &MediaMeta{
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentLength: resp.ContentLength,
+	}
+	// mime.ParseMediaType also decodes RFC 5987 encoded filename* parameters into filename
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		meta.Filename = params["filename"]
+	}
+	return resp.Body, meta, nil
+}
+
 func (cli *Client) doMediaRetry(req *http.Request, cause error, retries int, backoff time.Duration) (*http.Response, error) {
 	log := zerolog.Ctx(req.Context())
 	if req.Body != nil {
@@ -1410,7 +2513,7 @@ func (cli *Client) doMediaRetry(req *http.Request, cause error, retries int, bac
 func (cli *Client) doMediaRequest(req *http.Request, retries int, backoff time.Duration) (*http.Response, error) {
 	cli.RequestStart(req)
 	startTime := time.Now()
-	res, err := cli.Client.Do(req)
+	res, err := cli.doRequest(req, cli.Client)
 	duration := time.Now().Sub(startTime)
 	if err != nil {
 		if retries > 0 {
@@ -1431,17 +2534,19 @@ func (cli *Client) doMediaRequest(req *http.Request, retries int, backoff time.D
 		if res.StatusCode == http.StatusTooManyRequests {
 			backoff = parseBackoffFromResponse(req, res, time.Now(), backoff)
 		}
+		closeResponseBody(res)
 		return cli.doMediaRetry(req, fmt.Errorf("HTTP %d", res.StatusCode), retries, backoff)
 	}
 
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
 		var body []byte
 		body, err = ParseErrorResponse(req, res)
+		closeResponseBody(res)
 		cli.LogRequestDone(req, res, err, nil, len(body), duration)
-	} else {
-		cli.LogRequestDone(req, res, nil, nil, -1, duration)
+		return nil, err
 	}
-	return res, err
+	cli.LogRequestDone(req, res, nil, nil, -1, duration)
+	return res, nil
 }
 
 func (cli *Client) downloadContext(ctx context.Context, mxcURL id.ContentURI) (*http.Response, error) {
@@ -1454,7 +2559,7 @@ func (cli *Client) downloadContext(ctx context.Context, mxcURL id.ContentURI) (*
 		return nil, err
 	}
 	req.Header.Set("User-Agent", cli.UserAgent+" (media downloader)")
-	return cli.doMediaRequest(req, cli.DefaultHTTPRetries, 4*time.Second)
+	return cli.doMediaRequest(req, cli.DefaultHTTPRetries, cli.initialBackoff())
 }
 
 func (cli *Client) DownloadBytes(mxcURL id.ContentURI) ([]byte, error) {
@@ -1470,6 +2575,43 @@ func (cli *Client) DownloadBytesContext(ctx context.Context, mxcURL id.ContentUR
 	return io.ReadAll(resp.Body)
 }
 
+// DownloadTo downloads the given media and streams it into the given writer without buffering the whole file in memory.
+func (cli *Client) DownloadTo(mxcURL id.ContentURI, w io.Writer) (int64, error) {
+	return cli.DownloadToContext(context.Background(), mxcURL, w)
+}
+
+func (cli *Client) DownloadToContext(ctx context.Context, mxcURL id.ContentURI, w io.Writer) (int64, error) {
+	resp, err := cli.downloadContext(ctx, mxcURL)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
+
+// DownloadToFile downloads the given media and streams it into a file at the given path.
+// If the download fails, the partially written file is removed.
+func (cli *Client) DownloadToFile(mxcURL id.ContentURI, path string) (int64, error) {
+	return cli.DownloadToFileContext(context.Background(), mxcURL, path)
+}
+
+func (cli *Client) DownloadToFileContext(ctx context.Context, mxcURL id.ContentURI, path string) (written int64, err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file: %w", err)
+	}
+	defer func() {
+		closeErr := file.Close()
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to close file: %w", closeErr)
+		}
+		if err != nil {
+			_ = os.Remove(path)
+		}
+	}()
+	return cli.DownloadToContext(ctx, mxcURL, file)
+}
+
 // CreateMXC creates a blank Matrix content URI to allow uploading the content asynchronously later.
 //
 // See https://spec.matrix.org/v1.7/client-server-api/#post_matrixmediav1create
@@ -1485,7 +2627,7 @@ func (cli *Client) CreateMXC() (*RespCreateMXC, error) {
 }
 
 // UploadAsync creates a blank content URI with CreateMXC, starts uploading the data in the background
-// and returns the created MXC immediately.
+// and returns the created MXC immediately. SupportsAsyncUploads can be used to check if the server supports this.
 //
 // See https://spec.matrix.org/v1.7/client-server-api/#post_matrixmediav1create
 // and https://spec.matrix.org/v1.7/client-server-api/#put_matrixmediav3uploadservernamemediaid
@@ -1505,6 +2647,32 @@ func (cli *Client) UploadAsync(req ReqUploadMedia) (*RespCreateMXC, error) {
 	return resp, nil
 }
 
+// UploadToMXC uploads the given data to a content URI previously created with CreateMXC.
+// The content length doesn't need to be known in advance, the data is streamed to the server.
+//
+// See https://spec.matrix.org/v1.7/client-server-api/#put_matrixmediav3uploadservernamemediaid
+func (cli *Client) UploadToMXC(mxc id.ContentURI, content io.Reader, contentType string) error {
+	if mxc.IsEmpty() {
+		return errors.New("content URI must be set")
+	}
+	_, err := cli.UploadMedia(ReqUploadMedia{
+		MXC:         mxc,
+		Content:     content,
+		ContentType: contentType,
+	})
+	return err
+}
+
+// SupportsAsyncUploads checks if the homeserver advertises support for creating content URIs before uploading the
+// data, i.e. CreateMXC, UploadToMXC and UploadAsync. The versions are cached, see CachedVersions for details.
+func (cli *Client) SupportsAsyncUploads() (bool, error) {
+	versions, err := cli.CachedVersions()
+	if err != nil {
+		return false, err
+	}
+	return versions.Supports(FeatureAsyncUploads), nil
+}
+
 func (cli *Client) UploadBytes(data []byte, contentType string) (*RespMediaUpload, error) {
 	return cli.UploadBytesWithName(data, contentType, "")
 }
@@ -1616,10 +2784,10 @@ func (cli *Client) UploadMedia(data ReqUploadMedia) (*RespMediaUpload, error) {
 		}
 		return cli.uploadMediaToURL(data)
 	}
-	u, _ := url.Parse(cli.BuildURL(MediaURLPath{"v3", "upload"}))
+	u, _ := url.Parse(cli.BuildURL(cli.mediaURLPath("upload")))
 	method := http.MethodPost
 	if !data.MXC.IsEmpty() {
-		u, _ = url.Parse(cli.BuildURL(MediaURLPath{"v3", "upload", data.MXC.Homeserver, data.MXC.FileID}))
+		u, _ = url.Parse(cli.BuildURL(cli.mediaURLPath("upload", data.MXC.Homeserver, data.MXC.FileID)))
 		method = http.MethodPut
 	}
 	if len(data.FileName) > 0 {
@@ -1650,7 +2818,7 @@ func (cli *Client) UploadMedia(data ReqUploadMedia) (*RespMediaUpload, error) {
 //
 // See https://spec.matrix.org/v1.2/client-server-api/#get_matrixmediav3preview_url
 func (cli *Client) GetURLPreview(url string) (*RespPreviewURL, error) {
-	reqURL := cli.BuildURLWithQuery(MediaURLPath{"v3", "preview_url"}, map[string]string{
+	reqURL := cli.BuildURLWithQuery(cli.mediaURLPath("preview_url"), map[string]string{
 		"url": url,
 	})
 	var output RespPreviewURL
@@ -1695,6 +2863,21 @@ func (cli *Client) Members(roomID id.RoomID, req ...ReqMembers) (resp *RespMembe
 	}
 	u := cli.BuildURLWithQuery(ClientURLPath{"v3", "rooms", roomID, "members"}, query)
 	_, err = cli.MakeRequest("GET", u, nil, &resp)
+	if err == nil {
+		for _, evt := range resp.Chunk {
+			evt.Type.Class = event.StateEventType
+			_ = evt.Content.ParseRaw(evt.Type)
+		}
+	}
+	if err == nil && cli.MemberCache != nil && len(extra.At) == 0 && len(extra.NotMembership) == 0 {
+		if len(extra.Membership) == 0 {
+			cli.MemberCache.Replace(roomID, resp.Chunk, true)
+		} else {
+			for _, evt := range resp.Chunk {
+				cli.MemberCache.Set(roomID, id.UserID(evt.GetStateKey()), evt.Content.AsMember())
+			}
+		}
+	}
 	if err == nil && cli.StateStore != nil {
 		var clearMemberships []event.Membership
 		if extra.Membership != "" {
@@ -1794,6 +2977,45 @@ func (cli *Client) Context(roomID id.RoomID, eventID id.EventID, filter *FilterP
 	return
 }
 
+// GetRelations returns one page of events that relate to the given event.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv1roomsroomidrelationseventid
+func (cli *Client) GetRelations(roomID id.RoomID, eventID id.EventID, req *ReqGetRelations) (resp *RespGetRelations, err error) {
+	if req == nil {
+		req = &ReqGetRelations{}
+	}
+	urlPath := cli.BuildURLWithQuery(append(ClientURLPath{"v1", "rooms", roomID, "relations", eventID}, req.PathSuffix()...), req.Query())
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// MaxRelationPages is the maximum number of pages that GetAllRelations will fetch.
+var MaxRelationPages = 50
+
+// GetAllRelations returns every event that relates to the given event by following next_batch until there are no
+// more pages. The relation type and event type are optional, but the event type can only be used with a relation type.
+//
+// At most MaxRelationPages pages are fetched to avoid infinite loops on events with huge numbers of relations.
+// If the limit is reached, the events fetched so far are returned along with ErrTooManyRelationPages.
+func (cli *Client) GetAllRelations(roomID id.RoomID, eventID id.EventID, relType event.RelationType, eventType event.Type) ([]*event.Event, error) {
+	req := &ReqGetRelations{
+		RelationType: relType,
+		EventType:    eventType,
+	}
+	var events []*event.Event
+	for i := 0; i < MaxRelationPages; i++ {
+		resp, err := cli.GetRelations(roomID, eventID, req)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, resp.Chunk...)
+		if resp.NextBatch == "" || len(resp.Chunk) == 0 {
+			return events, nil
+		}
+		req.From = resp.NextBatch
+	}
+	return events, fmt.Errorf("%w (fetched %d pages)", ErrTooManyRelationPages, MaxRelationPages)
+}
+
 func (cli *Client) GetEvent(roomID id.RoomID, eventID id.EventID) (resp *event.Event, err error) {
 	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "event", eventID)
 	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
@@ -1804,6 +3026,23 @@ func (cli *Client) MarkRead(roomID id.RoomID, eventID id.EventID) (err error) {
 	return cli.SendReceipt(roomID, eventID, event.ReceiptTypeRead, nil)
 }
 
+// DefaultParallelism is the default value for Client.BulkParallelism.
+const DefaultParallelism = parallel.DefaultLimit
+
+// MarkReadMultiple sends read receipts to many rooms at once, e.g. to catch up with the last known read positions
+// when a bridge starts. At most BulkParallelism receipts are sent in parallel.
+//
+// All receipts are attempted even if some fail, and the errors are returned combined with errors.Join.
+func (cli *Client) MarkReadMultiple(positions map[id.RoomID]id.EventID) error {
+	return parallel.Run(positions, cli.BulkParallelism, func(roomID id.RoomID, eventID id.EventID) error {
+		err := cli.MarkRead(roomID, eventID)
+		if err != nil {
+			return fmt.Errorf("failed to mark %s as read in %s: %w", eventID, roomID, err)
+		}
+		return nil
+	})
+}
+
 // MarkReadWithContent sends a read receipt including custom data.
 //
 // Deprecated: Use SendReceipt instead.
@@ -1891,6 +3130,37 @@ func (cli *Client) DeleteAlias(alias id.RoomAlias) (resp *RespAliasDelete, err e
 	return
 }
 
+// SetRoomDirectoryVisibility sets whether the room is published in the homeserver's public room directory.
+// The visibility must be "public" or "private". See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3directorylistroomroomid
+func (cli *Client) SetRoomDirectoryVisibility(roomID id.RoomID, visibility string) error {
+	urlPath := cli.BuildClientURL("v3", "directory", "list", "room", roomID)
+	_, err := cli.MakeRequest(http.MethodPut, urlPath, &ReqRoomDirectoryVisibility{Visibility: visibility}, nil)
+	return err
+}
+
+// TeardownRoom cleans up a room that is no longer used, e.g. a bridge portal that is being deleted: the given aliases
+// are deleted, the room is removed from the public room directory, and finally the room is left.
+//
+// Every step is attempted even if previous steps fail, and all errors are returned combined with errors.Join.
+func (cli *Client) TeardownRoom(roomID id.RoomID, aliases []id.RoomAlias) error {
+	var errs []error
+	for _, alias := range aliases {
+		_, err := cli.DeleteAlias(alias)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete alias %s: %w", alias, err))
+		}
+	}
+	err := cli.SetRoomDirectoryVisibility(roomID, "private")
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove room from directory: %w", err))
+	}
+	_, err = cli.LeaveRoom(roomID)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to leave room: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
 func (cli *Client) GetAliases(roomID id.RoomID) (resp *RespAliasList, err error) {
 	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "aliases")
 	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
@@ -1987,12 +3257,124 @@ func (cli *Client) UploadCrossSigningKeys(keys *UploadCrossSigningKeysReq, uiaCa
 	return err
 }
 
+// makeUIARequest makes a POST request to an endpoint that requires user-interactive authentication.
+// If the server responds with a UIA challenge, the callback is called with it, and the request is retried with the
+// auth data returned by the callback stored in *auth. The flow ends when the request succeeds or the callback returns nil.
+func (cli *Client) makeUIARequest(urlPath string, reqJSON interface{}, auth *interface{}, respJSON interface{}, uiaCallback UIACallback) error {
+	for {
+		content, err := cli.MakeFullRequest(FullRequest{
+			Method:           http.MethodPost,
+			URL:              urlPath,
+			RequestJSON:      reqJSON,
+			ResponseJSON:     respJSON,
+			SensitiveContent: *auth != nil,
+		})
+		var httpErr HTTPError
+		if uiaCallback == nil || !errors.As(err, &httpErr) || !httpErr.IsStatus(http.StatusUnauthorized) {
+			return err
+		}
+		var uiAuthResp RespUserInteractive
+		if jsonErr := json.Unmarshal(content, &uiAuthResp); jsonErr != nil {
+			return fmt.Errorf("failed to decode UIA response: %w", jsonErr)
+		} else if len(uiAuthResp.Flows) == 0 {
+			// Not a UIA response, e.g. an invalid access token
+			return err
+		}
+		newAuth := uiaCallback(&uiAuthResp)
+		if newAuth == nil {
+			return err
+		}
+		*auth = newAuth
+	}
+}
+
+// DeactivateAccount deactivates the current user's account. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3accountdeactivate
+//
+// The endpoint requires user-interactive authentication, so a callback must be provided that produces the auth data
+// for the UIA response (or nil to end the flow). Appservices can pass nil as the callback.
+// A nil request is treated as an empty one.
+func (cli *Client) DeactivateAccount(req *ReqDeactivate, uiaCallback UIACallback) (resp *RespDeactivate, err error) {
+	if req == nil {
+		req = &ReqDeactivate{}
+	}
+	resp = &RespDeactivate{}
+	err = cli.makeUIARequest(cli.BuildClientURL("v3", "account", "deactivate"), req, &req.Auth, resp, uiaCallback)
+	if err != nil {
+		resp = nil
+	}
+	return
+}
+
+// ChangePassword changes the current user's password. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3accountpassword
+//
+// The endpoint requires user-interactive authentication, so a callback must be provided that produces the auth data
+// for the UIA response (or nil to end the flow). The callback is called again if the server rejects the auth data,
+// e.g. when the current password was wrong. The callback is a parameter (like in DeactivateAccount and
+// UploadCrossSigningKeys) rather than auth data in the request, because the auth data must include the session ID
+// from the server's UIA response, which isn't known before the first request.
+func (cli *Client) ChangePassword(req *ReqChangePassword, uiaCallback UIACallback) error {
+	if req == nil {
+		return errors.New("password change request must not be nil")
+	}
+	return cli.makeUIARequest(cli.BuildClientURL("v3", "account", "password"), req, &req.Auth, nil, uiaCallback)
+}
+
 func (cli *Client) UploadSignatures(req *ReqUploadSignatures) (resp *RespUploadSignatures, err error) {
 	urlPath := cli.BuildClientURL("v3", "keys", "signatures", "upload")
 	_, err = cli.MakeRequest("POST", urlPath, req, &resp)
 	return
 }
 
+// GetNotifications fetches the list of events that the user has been notified about.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3notifications
+//
+// The from parameter is the pagination token from the NextToken field of a previous response, or empty to start
+// from the latest notification. The limit is optional (zero means the server default). The only parameter can be set
+// to "highlight" to only get notifications that highlight the user.
+func (cli *Client) GetNotifications(from string, limit int, only string) (resp *RespNotifications, err error) {
+	query := map[string]string{}
+	if from != "" {
+		query["from"] = from
+	}
+	if limit > 0 {
+		query["limit"] = strconv.Itoa(limit)
+	}
+	if only != "" {
+		query["only"] = only
+	}
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "notifications"}, query)
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	if err == nil {
+		for _, notif := range resp.Notifications {
+			if notif.Event != nil {
+				notif.Event.RoomID = notif.RoomID
+			}
+		}
+	}
+	return
+}
+
+// GetPushers gets the list of pushers of the current user. See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3pushers
+func (cli *Client) GetPushers() (resp *RespPushers, err error) {
+	urlPath := cli.BuildClientURL("v3", "pushers")
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// SetPusher creates, updates or deletes a pusher. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3pushersset
+//
+// To delete a pusher, set Kind to nil (or use DeletePusher).
+func (cli *Client) SetPusher(req *ReqSetPusher) error {
+	urlPath := cli.BuildClientURL("v3", "pushers", "set")
+	_, err := cli.MakeRequest("POST", urlPath, req, nil)
+	return err
+}
+
+// DeletePusher deletes the pusher with the given app ID and push key.
+func (cli *Client) DeletePusher(appID, pushKey string) error {
+	return cli.SetPusher(&ReqSetPusher{Pusher: Pusher{AppID: appID, PushKey: pushKey}})
+}
+
 // GetPushRules returns the push notification rules for the global scope.
 func (cli *Client) GetPushRules() (*pushrules.PushRuleset, error) {
 	return cli.GetScopedPushRules("global")
@@ -2039,7 +3421,11 @@ func (cli *Client) PutPushRule(scope string, kind pushrules.PushRuleType, ruleID
 //
 // Deprecated: MSC2716 has been abandoned, so this is now Beeper-specific. BeeperBatchSend should be used instead.
 func (cli *Client) BatchSend(roomID id.RoomID, req *ReqBatchSend) (resp *RespBatchSend, err error) {
-	path := ClientURLPath{"unstable", "org.matrix.msc2716", "rooms", roomID, "batch_send"}
+	prefix := req.UnstablePrefix
+	if prefix == "" {
+		prefix = "org.matrix.msc2716"
+	}
+	path := ClientURLPath{"unstable", prefix, "rooms", roomID, "batch_send"}
 	query := map[string]string{
 		"prev_event_id": req.PrevEventID.String(),
 	}
@@ -2098,8 +3484,38 @@ func (cli *Client) TxnID() string {
 	return fmt.Sprintf("mautrix-go_%d_%d", time.Now().UnixNano(), txnID)
 }
 
+// AppendUserAgent adds the given product token (e.g. "my-bot/1.0") to the end of the User-Agent header,
+// keeping the existing mautrix-go identifier.
+func (cli *Client) AppendUserAgent(product string) {
+	if cli.UserAgent == "" {
+		cli.UserAgent = product
+	} else {
+		cli.UserAgent = cli.UserAgent + " " + product
+	}
+}
+
+// NewHTTPClient creates an HTTP client tuned for making requests to a single Matrix homeserver.
+//
+// The client has its own connection pool with a higher idle connection limit per host than the default transport,
+// and HTTP/2 is enabled. The timeout is meant for normal requests: FullSyncRequest automatically extends it by the
+// long-poll timeout of the /sync request, so it's safe to use a timeout shorter than the long-poll duration.
+func NewHTTPClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 32
+	transport.ForceAttemptHTTP2 = true
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
 // NewClient creates a new Matrix Client ready for syncing
 func NewClient(homeserverURL string, userID id.UserID, accessToken string) (*Client, error) {
+	return NewClientWithHTTPClient(homeserverURL, userID, accessToken, NewHTTPClient(180*time.Second))
+}
+
+// NewClientWithHTTPClient creates a new Matrix Client that uses the given HTTP client for requests.
+//
+// The Client gets a copy of the HTTP client with a transport that adds the User-Agent and Authorization headers
+// to every request, so the given client itself is not modified.
+func NewClientWithHTTPClient(homeserverURL string, userID id.UserID, accessToken string, httpClient *http.Client) (*Client, error) {
 	hsURL, err := ParseAndNormalizeBaseURL(homeserverURL)
 	if err != nil {
 		return nil, err
@@ -2109,14 +3525,39 @@ func NewClient(homeserverURL string, userID id.UserID, accessToken string) (*Cli
 		UserAgent:     DefaultUserAgent,
 		HomeserverURL: hsURL,
 		UserID:        userID,
-		Client:        &http.Client{Timeout: 180 * time.Second},
 		Syncer:        NewDefaultSyncer(),
 		Log:           zerolog.Nop(),
 		// By default, use an in-memory store which will never save filter ids / next batch tokens to disk.
 		// The client will work with this storer: it just won't remember across restarts.
 		// In practice, a database backend should be used.
-		Store: NewMemorySyncStore(),
+		Store:            NewMemorySyncStore(),
+		SentTransactions: NewTransactionTracker(DefaultSentTransactionLimit),
 	}
+	cli.Client = cli.wrapHTTPClient(httpClient)
 	cli.Logger = maulogadapt.ZeroAsMau(&cli.Log)
 	return cli, nil
 }
+
+// Clone returns a shallow copy of the client, e.g. for making requests as a different appservice user
+// or with a different access token.
+//
+// The copy shares the HTTP clients, stores, syncer and other configuration with the original client,
+// but has its own transaction ID counter, sync state and presence rate limiter. The HTTP client is shared as-is:
+// if it was created by NewClient, its transport adds the headers of whichever client is making the request,
+// so the original client's access token won't be used for the clone's requests.
+func (cli *Client) Clone() *Client {
+	clone := &Client{}
+	// All exported fields are configuration that is shared with the clone, while the unexported fields are
+	// per-instance state (including locks, which is why this can't just be a struct copy).
+	src := reflect.ValueOf(cli).Elem()
+	dst := reflect.ValueOf(clone).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if src.Type().Field(i).IsExported() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	cli.versionsLock.Lock()
+	clone.versionsCache = cli.versionsCache
+	cli.versionsLock.Unlock()
+	return clone
+}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"context"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/tidwall/gjson"
 )
 
@@ -68,3 +71,34 @@ func TestBackoffFromResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestFetchWellKnownURL_Support(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/matrix/support" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{
+			"contacts": [
+				{"matrix_id": "@admin:example.com", "email_address": "admin@example.com", "role": "m.role.admin"},
+				{"email_address": "security@example.com", "role": "m.role.security"}
+			],
+			"support_page": "https://example.com/support"
+		}`))
+	}))
+	defer ts.Close()
+
+	var support RespWellKnownSupport
+	found, err := fetchWellKnownURL(ts.URL+"/.well-known/matrix/support", &support)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, "https://example.com/support", support.SupportPage)
+	assert.Equal(t, []SupportContact{
+		{MatrixID: "@admin:example.com", EmailAddress: "admin@example.com", Role: SupportContactRoleAdmin},
+		{EmailAddress: "security@example.com", Role: SupportContactRoleSecurity},
+	}, support.Contacts)
+
+	found, err = fetchWellKnownURL(ts.URL+"/.well-known/matrix/client", &ClientWellKnown{})
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
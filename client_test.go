@@ -0,0 +1,2067 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestClient_EnsureRegistered_UserInUse(t *testing.T) {
+	var reqBody map[string]any
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/register", r.URL.Path)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&reqBody))
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"errcode":"M_USER_IN_USE","error":"User ID already taken."}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "", "as_token")
+	require.NoError(t, err)
+	_, err = cli.RegisterAppService("ghost")
+	assert.True(t, errors.Is(err, mautrix.MUserInUse))
+	assert.Equal(t, "m.login.application_service", reqBody["type"])
+	assert.Equal(t, "ghost", reqBody["username"])
+	assert.Equal(t, true, reqBody["inhibit_login"])
+
+	assert.NoError(t, cli.EnsureRegistered("ghost"))
+}
+
+func TestClient_EnsureRegistered_OtherError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"errcode":"M_EXCLUSIVE","error":"User ID is not in the appservice namespace"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "", "as_token")
+	require.NoError(t, err)
+	err = cli.EnsureRegistered("ghost")
+	assert.True(t, errors.Is(err, mautrix.MExclusive))
+}
+
+func TestClient_SetPresence_RateLimit(t *testing.T) {
+	var lock sync.Mutex
+	var sent []string
+	getSent := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, sent...)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		lock.Lock()
+		if presence, ok := req["presence"]; ok {
+			sent = append(sent, fmt.Sprint(presence))
+		} else {
+			sent = append(sent, fmt.Sprintf("typing:%v", req["typing"]))
+		}
+		lock.Unlock()
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.PresenceRateLimit = 200 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, cli.SetPresence(event.PresenceOnline))
+	}
+	assert.Equal(t, []string{"online"}, getSent())
+
+	// Alternating values within the interval are dropped too, per key
+	for _, presence := range []event.Presence{event.PresenceOffline, event.PresenceOnline, event.PresenceUnavailable} {
+		assert.NoError(t, cli.SetPresence(presence))
+	}
+	for _, typing := range []bool{true, false, true, false, true} {
+		_, err = cli.UserTyping("!room:example.com", typing, 5*time.Second)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"online", "typing:true"}, getSent())
+	// The dropped updates are not sent later
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, []string{"online", "typing:true"}, getSent())
+
+	// After the interval, the next update is sent immediately
+	assert.NoError(t, cli.SetPresence(event.PresenceUnavailable))
+	assert.Equal(t, []string{"online", "typing:true", "unavailable"}, getSent())
+
+	cli.SuppressPresence = true
+	time.Sleep(300 * time.Millisecond)
+	assert.NoError(t, cli.SetPresence(event.PresenceOffline))
+	resp, err := cli.UserTyping("!room:example.com", false, 5*time.Second)
+	assert.NoError(t, err)
+	assert.Nil(t, resp)
+	assert.Equal(t, []string{"online", "typing:true", "unavailable"}, getSent())
+}
+
+func TestClient_SetPresence_RateLimitFailure(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"Nope"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.PresenceRateLimit = time.Minute
+	assert.ErrorIs(t, cli.SetPresence(event.PresenceOnline), mautrix.MForbidden)
+	// A failed update doesn't use up the token
+	assert.NoError(t, cli.SetPresence(event.PresenceOnline))
+	assert.NoError(t, cli.SetPresence(event.PresenceOnline))
+	assert.Equal(t, 2, requests)
+}
+
+func TestClient_SyncExemptFromHTTPTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		if r.URL.Path == "/_matrix/client/v3/sync" {
+			_, _ = w.Write([]byte(`{"next_batch":"s1"}`))
+		} else {
+			_, _ = w.Write([]byte(`{"user_id":"@user:example.com"}`))
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClientWithHTTPClient(ts.URL, "@user:example.com", "token", mautrix.NewHTTPClient(100*time.Millisecond))
+	require.NoError(t, err)
+	resp, err := cli.FullSyncRequest(mautrix.ReqSync{Since: "s0", Timeout: 1000})
+	require.NoError(t, err)
+	assert.Equal(t, "s1", resp.NextBatch)
+
+	_, err = cli.Whoami()
+	assert.Error(t, err)
+}
+
+type countingTransport struct {
+	count int
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ct.count++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClient_SyncClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/v3/sync" {
+			_, _ = w.Write([]byte(`{"next_batch":"s1"}`))
+		} else {
+			_, _ = w.Write([]byte(`{"user_id":"@user:example.com"}`))
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	regular := &countingTransport{}
+	syncing := &countingTransport{}
+	cli.Client = &http.Client{Transport: regular}
+	cli.SyncClient = &http.Client{Transport: syncing}
+
+	_, err = cli.SyncRequest(0, "", "", false, event.PresenceOnline, context.Background())
+	require.NoError(t, err)
+	_, err = cli.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, 1, syncing.count)
+	assert.Equal(t, 1, regular.count)
+}
+
+func TestClient_Sync_RecoverInvalidFilterAndSince(t *testing.T) {
+	var filters int
+	var syncs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/v3/user/@user:example.com/filter" {
+			filters++
+			_, _ = fmt.Fprintf(w, `{"filter_id":"%d"}`, filters)
+			return
+		}
+		query := r.URL.Query()
+		syncs = append(syncs, query.Get("filter")+"/"+query.Get("since"))
+		switch {
+		case query.Get("filter") == "stale":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"No such filter"}`))
+		case query.Get("since") == "stale":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"Invalid stream token"}`))
+		default:
+			_, _ = w.Write([]byte(`{"next_batch":"s1"}`))
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.Store.SaveFilterID(cli.UserID, "stale")
+	cli.Store.SaveNextBatch(cli.UserID, "stale")
+	cli.Syncer.(*mautrix.DefaultSyncer).InitialTimelineLimit = 0
+	cli.Syncer.(mautrix.ExtensibleSyncer).OnSync(func(resp *mautrix.RespSync, since string) bool {
+		cli.StopSync()
+		return true
+	})
+	require.NoError(t, cli.Sync())
+	assert.Equal(t, []string{"stale/stale", "1/stale", "1/", "1/s1"}, syncs)
+	assert.Equal(t, "1", cli.Store.LoadFilterID(cli.UserID))
+	assert.Equal(t, "s1", cli.Store.LoadNextBatch(cli.UserID))
+}
+
+func TestClient_GetFilter(t *testing.T) {
+	filters := map[string][]byte{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "/_matrix/client/v3/user/@user:example.com/filter"
+		if r.Method == http.MethodPost && r.URL.Path == prefix {
+			body, _ := io.ReadAll(r.Body)
+			filterID := strconv.Itoa(len(filters) + 1)
+			filters[filterID] = body
+			_, _ = fmt.Fprintf(w, `{"filter_id":%q}`, filterID)
+		} else if data, ok := filters[strings.TrimPrefix(r.URL.Path, prefix+"/")]; ok && r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"No such filter"}`))
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	filter := &mautrix.Filter{Room: mautrix.RoomFilter{Timeline: mautrix.FilterPart{Limit: 5}}}
+	created, err := cli.CreateFilter(filter)
+	require.NoError(t, err)
+	raw, err := cli.GetFilter(created.FilterID)
+	require.NoError(t, err)
+	var fetched mautrix.Filter
+	require.NoError(t, json.Unmarshal(raw, &fetched))
+	assert.Equal(t, 5, fetched.Room.Timeline.Limit)
+
+	_, err = cli.GetFilter("404")
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+}
+
+func TestClient_GetRoomName(t *testing.T) {
+	state := map[string]string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := state[strings.TrimPrefix(r.URL.Path, "/_matrix/client/v3/rooms/!room:example.com/state/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Event not found."}`))
+			return
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	const roomID = id.RoomID("!room:example.com")
+
+	name, err := cli.GetRoomName(roomID)
+	assert.NoError(t, err)
+	assert.Equal(t, "", name)
+	topic, err := cli.GetRoomTopic(roomID)
+	assert.NoError(t, err)
+	assert.Equal(t, "", topic)
+	avatar, err := cli.GetRoomAvatar(roomID)
+	assert.NoError(t, err)
+	assert.True(t, avatar.IsEmpty())
+
+	state["m.room.canonical_alias/"] = `{"alias":"#room:example.com"}`
+	name, err = cli.GetRoomName(roomID)
+	assert.NoError(t, err)
+	assert.Equal(t, "#room:example.com", name)
+
+	state["m.room.name/"] = `{"name":"Room"}`
+	state["m.room.topic/"] = `{"topic":"Topic"}`
+	state["m.room.avatar/"] = `{"url":"mxc://example.com/avatar"}`
+	name, err = cli.GetRoomName(roomID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Room", name)
+	topic, err = cli.GetRoomTopic(roomID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Topic", topic)
+	avatar, err = cli.GetRoomAvatar(roomID)
+	assert.NoError(t, err)
+	assert.Equal(t, "mxc://example.com/avatar", avatar.String())
+}
+
+func TestClient_SetCanonicalAlias(t *testing.T) {
+	var bodies []map[string]any
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/state/m.room.canonical_alias/", r.URL.Path)
+		var body map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		bodies = append(bodies, body)
+		_, _ = w.Write([]byte(`{"event_id":"$event"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	_, err = cli.SetCanonicalAlias("!room:example.com", "#room:example.com", nil)
+	require.NoError(t, err)
+	_, err = cli.SetCanonicalAlias("!room:example.com", "#room:example.com", []id.RoomAlias{"#alt:example.com"})
+	require.NoError(t, err)
+	require.Len(t, bodies, 2)
+	assert.Equal(t, map[string]any{"alias": "#room:example.com"}, bodies[0])
+	assert.Equal(t, map[string]any{"alias": "#room:example.com", "alt_aliases": []any{"#alt:example.com"}}, bodies[1])
+}
+
+func TestClient_SoftLogout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		if r.Header.Get("Authorization") == "Bearer soft" {
+			_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Access token has expired","soft_logout":true}`))
+		} else {
+			_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid access token passed."}`))
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "soft")
+	require.NoError(t, err)
+	var hookCalls int
+	cli.SoftLogoutHook = func(err mautrix.HTTPError) {
+		hookCalls++
+	}
+	_, err = cli.Whoami()
+	var httpErr mautrix.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.ErrorIs(t, err, mautrix.MUnknownToken)
+	assert.True(t, httpErr.RespError.SoftLogout)
+	assert.Equal(t, 1, hookCalls)
+
+	cli.AccessToken = "hard"
+	_, err = cli.Whoami()
+	require.ErrorAs(t, err, &httpErr)
+	assert.False(t, httpErr.RespError.SoftLogout)
+	assert.Equal(t, 1, hookCalls)
+}
+
+func TestClient_CreateDMWith(t *testing.T) {
+	var reqBody map[string]any
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/createRoom", r.URL.Path)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&reqBody))
+		_, _ = w.Write([]byte(`{"room_id":"!dm:example.com"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	resp, err := cli.CreateDMWith("@friend:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!dm:example.com"), resp.RoomID)
+	assert.Equal(t, map[string]any{
+		"preset":    "trusted_private_chat",
+		"is_direct": true,
+		"invite":    []any{"@friend:example.com"},
+	}, reqBody)
+}
+
+func TestClient_DeactivateAccount(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/_matrix/client/v3/account/deactivate", r.URL.Path)
+		var body map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "id.example.com", body["id_server"])
+		auth, ok := body["auth"].(map[string]any)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"flows":[{"stages":["m.login.password"]}],"session":"abc"}`))
+			return
+		}
+		assert.Equal(t, "m.login.password", auth["type"])
+		assert.Equal(t, "abc", auth["session"])
+		assert.Equal(t, "hunter2", auth["password"])
+		_, _ = w.Write([]byte(`{"id_server_unbind_result":"success"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	var callbacks int
+	resp, err := cli.DeactivateAccount(&mautrix.ReqDeactivate{IDServer: "id.example.com"}, func(uia *mautrix.RespUserInteractive) interface{} {
+		callbacks++
+		assert.True(t, uia.HasSingleStageFlow(mautrix.AuthTypePassword))
+		return &mautrix.ReqUIAuthLogin{
+			BaseAuthData: mautrix.BaseAuthData{Type: mautrix.AuthTypePassword, Session: uia.Session},
+			User:         "@user:example.com",
+			Password:     "hunter2",
+		}
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "success", resp.IDServerUnbindResult)
+	assert.Equal(t, 1, callbacks)
+	assert.Equal(t, 2, requests)
+
+	_, err = cli.DeactivateAccount(&mautrix.ReqDeactivate{IDServer: "id.example.com"}, func(uia *mautrix.RespUserInteractive) interface{} {
+		return nil
+	})
+	assert.Error(t, err)
+}
+
+func TestClient_DeactivateAccount_NilRequest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.NotNil(t, body)
+		_, _ = w.Write([]byte(`{"id_server_unbind_result":"no-support"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	resp, err := cli.DeactivateAccount(nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "no-support", resp.IDServerUnbindResult)
+}
+
+func TestClient_ChangePassword(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/_matrix/client/v3/account/password", r.URL.Path)
+		var body map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "correct horse", body["new_password"])
+		assert.Equal(t, true, body["logout_devices"])
+		auth, _ := body["auth"].(map[string]any)
+		switch {
+		case auth == nil:
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"flows":[{"stages":["m.login.password"]}],"session":"abc"}`))
+		case auth["password"] != "hunter2":
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"Invalid password","flows":[{"stages":["m.login.password"]}],"session":"abc"}`))
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	passwords := []string{"wrong", "hunter2"}
+	var uiaErrors []string
+	err = cli.ChangePassword(&mautrix.ReqChangePassword{NewPassword: "correct horse", LogoutDevices: true}, func(uia *mautrix.RespUserInteractive) interface{} {
+		uiaErrors = append(uiaErrors, uia.ErrCode)
+		password := passwords[0]
+		passwords = passwords[1:]
+		return &mautrix.ReqUIAuthLogin{
+			BaseAuthData: mautrix.BaseAuthData{Type: mautrix.AuthTypePassword, Session: uia.Session},
+			User:         "@user:example.com",
+			Password:     password,
+		}
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", "M_FORBIDDEN"}, uiaErrors)
+	assert.Equal(t, 3, requests)
+}
+
+func TestClient_ChangePassword_NilRequest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unexpected request to", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	assert.Error(t, cli.ChangePassword(nil, nil))
+}
+
+func TestClient_RequestOpenIDToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/_matrix/client/v3/user/@user:example.com/openid/request_token", r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		assert.JSONEq(t, `{}`, string(body))
+		_, _ = w.Write([]byte(`{"access_token":"SomeT0kenHere","expires_in":3600,"matrix_server_name":"example.com","token_type":"Bearer"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	resp, err := cli.RequestOpenIDToken()
+	require.NoError(t, err)
+	assert.Equal(t, &mautrix.RespOpenIDToken{
+		AccessToken:      "SomeT0kenHere",
+		TokenType:        "Bearer",
+		MatrixServerName: "example.com",
+		ExpiresIn:        3600,
+	}, resp)
+}
+
+func TestClient_GetNotifications(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/notifications", r.URL.Path)
+		assert.Equal(t, "token1", r.URL.Query().Get("from"))
+		assert.Equal(t, "10", r.URL.Query().Get("limit"))
+		assert.Equal(t, "highlight", r.URL.Query().Get("only"))
+		_, _ = w.Write([]byte(`{
+			"next_token": "token2",
+			"notifications": [{
+				"actions": ["notify", {"set_tweak": "highlight", "value": true}],
+				"event": {"type": "m.room.message", "event_id": "$event", "sender": "@alice:example.com", "content": {"msgtype": "m.text", "body": "hi user"}},
+				"profile_tag": "hcbvkzxhcvb",
+				"read": true,
+				"room_id": "!room:example.com",
+				"ts": 1475508881945
+			}]
+		}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	resp, err := cli.GetNotifications("token1", 10, "highlight")
+	require.NoError(t, err)
+	assert.Equal(t, "token2", resp.NextToken)
+	require.Len(t, resp.Notifications, 1)
+	notif := resp.Notifications[0]
+	assert.True(t, notif.Read)
+	assert.Equal(t, "hcbvkzxhcvb", notif.ProfileTag)
+	assert.Equal(t, int64(1475508881945), notif.Timestamp.UnixMilli())
+	assert.Equal(t, id.EventID("$event"), notif.Event.ID)
+	assert.Equal(t, id.RoomID("!room:example.com"), notif.Event.RoomID)
+	assert.True(t, notif.Actions.Should().Highlight)
+}
+
+func TestClient_SetPusher(t *testing.T) {
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			assert.Equal(t, "/_matrix/client/v3/pushers", r.URL.Path)
+			_, _ = w.Write([]byte(`{"pushers":[{"app_display_name":"App","app_id":"com.example.app","data":{"url":"https://push.example.com/_matrix/push/v1/notify","format":"event_id_only"},"device_display_name":"Phone","kind":"http","lang":"en","pushkey":"abcdef"}]}`))
+			return
+		}
+		assert.Equal(t, "/_matrix/client/v3/pushers/set", r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	kind := mautrix.PusherKindHTTP
+	require.NoError(t, cli.SetPusher(&mautrix.ReqSetPusher{
+		Pusher: mautrix.Pusher{
+			AppDisplayName:    "App",
+			AppID:             "com.example.app",
+			Data:              &mautrix.PusherData{URL: "https://push.example.com/_matrix/push/v1/notify", Format: "event_id_only"},
+			DeviceDisplayName: "Phone",
+			Kind:              &kind,
+			Language:          "en",
+			PushKey:           "abcdef",
+		},
+		Append: true,
+	}))
+	require.NoError(t, cli.DeletePusher("com.example.app", "abcdef"))
+	require.Len(t, bodies, 2)
+	assert.JSONEq(t, `{
+		"app_display_name": "App",
+		"app_id": "com.example.app",
+		"append": true,
+		"data": {"url": "https://push.example.com/_matrix/push/v1/notify", "format": "event_id_only"},
+		"device_display_name": "Phone",
+		"kind": "http",
+		"lang": "en",
+		"pushkey": "abcdef"
+	}`, bodies[0])
+	assert.JSONEq(t, `{"app_id": "com.example.app", "kind": null, "pushkey": "abcdef"}`, bodies[1])
+
+	resp, err := cli.GetPushers()
+	require.NoError(t, err)
+	require.Len(t, resp.Pushers, 1)
+	assert.Equal(t, mautrix.PusherKindHTTP, *resp.Pushers[0].Kind)
+	assert.Equal(t, "event_id_only", resp.Pushers[0].Data.Format)
+}
+
+func TestClient_DownloadToFile(t *testing.T) {
+	data := strings.Repeat("meow", 1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if strings.HasSuffix(r.URL.Path, "/broken") {
+			// Write only half of the promised body to simulate the connection dying mid-download
+			_, _ = w.Write([]byte(data[:len(data)/2]))
+			return
+		}
+		_, _ = w.Write([]byte(data))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "ok")
+	written, err := cli.DownloadToFile(id.ContentURI{Homeserver: "example.com", FileID: "ok"}, path)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), written)
+	fileData, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, data, string(fileData))
+
+	path = filepath.Join(dir, "broken")
+	_, err = cli.DownloadToFile(id.ContentURI{Homeserver: "example.com", FileID: "broken"}, path)
+	assert.Error(t, err)
+	_, err = os.Stat(path)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestClient_DownloadWithMeta(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/media/v3/download/example.com/utf8":
+			w.Header().Set("Content-Disposition", `attachment; filename="fallback.txt"; filename*=UTF-8''%C3%A4%C3%B6%20file.txt`)
+		case "/_matrix/media/v3/download/example.com/quoted":
+			w.Header().Set("Content-Disposition", `inline; filename="cat picture.png"`)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	for fileID, expectedName := range map[string]string{"utf8": "äö file.txt", "quoted": "cat picture.png", "none": ""} {
+		body, meta, err := cli.DownloadWithMeta(id.ContentURI{Homeserver: "example.com", FileID: fileID})
+		require.NoError(t, err)
+		data, err := io.ReadAll(body)
+		_ = body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+		assert.Equal(t, "text/plain", meta.ContentType)
+		assert.EqualValues(t, 5, meta.ContentLength)
+		assert.Equal(t, expectedName, meta.Filename)
+	}
+}
+
+func TestClient_RetryNetworkErrors(t *testing.T) {
+	var requestsLock sync.Mutex
+	requests := map[string]int{}
+	countRequests := func(method string) int {
+		requestsLock.Lock()
+		defer requestsLock.Unlock()
+		return requests[method]
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsLock.Lock()
+		requests[r.Method]++
+		count := requests[r.Method]
+		requestsLock.Unlock()
+		if count == 1 {
+			// Reset the connection on the first request of each method
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if !assert.NoError(t, err) {
+				return
+			}
+			_ = conn.Close()
+			return
+		}
+		_, _ = w.Write([]byte(`{"user_id":"@user:example.com","filter_id":"1"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.DefaultHTTPRetries = 2
+	cli.DefaultHTTPBackoff = time.Millisecond
+
+	resp, err := cli.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@user:example.com"), resp.UserID)
+	assert.Equal(t, 2, countRequests(http.MethodGet))
+
+	_, err = cli.CreateFilter(&mautrix.Filter{})
+	assert.Error(t, err)
+	assert.Equal(t, 1, countRequests(http.MethodPost))
+}
+
+func TestClient_AppendUserAgent(t *testing.T) {
+	var userAgent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		_, _ = w.Write([]byte(`{"user_id":"@user:example.com"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	assert.Equal(t, mautrix.DefaultUserAgent, cli.UserAgent)
+	cli.AppendUserAgent("my-bridge/2.1")
+	_, err = cli.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, mautrix.DefaultUserAgent+" my-bridge/2.1", userAgent)
+	assert.True(t, strings.HasPrefix(userAgent, "mautrix-go/"))
+}
+
+func TestClient_RequestMetricsHooks(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"nope"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	var requestPaths, responsePaths []string
+	var statusCode int
+	cli.OnRequest = func(method, path string) {
+		requestPaths = append(requestPaths, method+" "+path)
+	}
+	cli.OnResponse = func(method, path string, status int, duration time.Duration) {
+		responsePaths = append(responsePaths, method+" "+path)
+		statusCode = status
+	}
+	_, err = cli.SendText("!room:example.com", "hello")
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	// Room v3+ event IDs can contain slashes, which must not be split into separate path segments
+	_, err = cli.GetEvent("!room:example.com", "$abc/def+ghi")
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	expected := []string{
+		"PUT /_matrix/client/v3/rooms/{roomID}/send/m.room.message/{txnID}",
+		"GET /_matrix/client/v3/rooms/{roomID}/event/{eventID}",
+	}
+	assert.Equal(t, expected, requestPaths)
+	assert.Equal(t, expected, responsePaths)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+}
+
+func TestClient_RequestInterceptor(t *testing.T) {
+	var serverRequests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverRequests++
+		_, _ = w.Write([]byte(`{"user_id":"@real:example.com"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	var interceptedBody string
+	cli.RequestInterceptor = func(method, url string, body []byte) ([]byte, int, bool) {
+		if method == http.MethodPut && strings.Contains(url, "/send/") {
+			interceptedBody = string(body)
+			return []byte(`{"event_id":"$mocked"}`), http.StatusOK, true
+		}
+		return nil, 0, false
+	}
+
+	resp, err := cli.SendText("!room:example.com", "hello")
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$mocked"), resp.EventID)
+	assert.JSONEq(t, `{"msgtype":"m.text","body":"hello"}`, interceptedBody)
+	assert.Equal(t, 0, serverRequests)
+
+	whoami, err := cli.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@real:example.com"), whoami.UserID)
+	assert.Equal(t, 1, serverRequests)
+}
+
+func TestClient_TransportSetsHeaders(t *testing.T) {
+	authHeaders := map[string]string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeaders[r.URL.Path] = r.Header.Get("Authorization")
+		assert.Equal(t, mautrix.DefaultUserAgent, r.Header.Get("User-Agent"))
+		if strings.HasPrefix(r.URL.Path, "/_matrix/media/") {
+			_, _ = w.Write([]byte(`{"content_uri":"mxc://example.com/abc"}`))
+		} else {
+			_, _ = w.Write([]byte(`{"user_id":"@user:example.com"}`))
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token1")
+	require.NoError(t, err)
+	_, err = cli.Whoami()
+	require.NoError(t, err)
+	cli.SetCredentials("@user:example.com", "token2")
+	_, err = cli.UploadBytes([]byte("hello"), "text/plain")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"/_matrix/client/v3/account/whoami": "Bearer token1",
+		"/_matrix/media/v3/upload":          "Bearer token2",
+	}, authHeaders)
+
+	// Replacing the HTTP client must not lose the headers
+	cli.Client = &http.Client{}
+	_, err = cli.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer token2", authHeaders["/_matrix/client/v3/account/whoami"])
+}
+
+func TestClient_RequestHook_Headers(t *testing.T) {
+	var authHeader, userAgent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+		userAgent = r.Header.Get("User-Agent")
+		_, _ = w.Write([]byte(`{"user_id":"@user:example.com"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	var hookAuthHeader string
+	cli.RequestHook = func(req *http.Request) {
+		// The default headers are added by the transport after the hook, but headers set here take precedence
+		hookAuthHeader = req.Header.Get("Authorization")
+		req.Header.Set("User-Agent", "custom/1.0")
+	}
+	_, err = cli.Whoami()
+	require.NoError(t, err)
+	assert.Empty(t, hookAuthHeader)
+	assert.Equal(t, "Bearer token", authHeader)
+	assert.Equal(t, "custom/1.0", userAgent)
+}
+
+func TestClient_RedactEvent_Reason(t *testing.T) {
+	var reqBody map[string]any
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.True(t, strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/rooms/!room:example.com/redact/$target/"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&reqBody))
+		_, _ = w.Write([]byte(`{"event_id":"$redaction"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	resp, err := cli.RedactEvent("!room:example.com", "$target", mautrix.ReqRedact{Reason: "spam"})
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$redaction"), resp.EventID)
+	assert.Equal(t, map[string]any{"reason": "spam"}, reqBody)
+}
+
+func TestClient_BatchSend(t *testing.T) {
+	var queries []string
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		queries = append(queries, r.URL.Query().Get("batch_id"))
+		assert.Equal(t, "$prev", r.URL.Query().Get("prev_event_id"))
+		var req map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Len(t, req["events"], 1)
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"event_ids":["$evt%d"],"next_batch_id":"batch%d"}`, len(paths), len(paths))))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@bridge:example.com", "token")
+	require.NoError(t, err)
+	req := &mautrix.ReqBatchSend{
+		PrevEventID: "$prev",
+		Events:      []*event.Event{{Type: event.EventMessage, Sender: "@ghost:example.com"}},
+	}
+	resp, err := cli.BatchSend("!room:example.com", req)
+	require.NoError(t, err)
+	assert.Equal(t, []id.EventID{"$evt1"}, resp.EventIDs)
+
+	req.BatchID = resp.NextBatchID
+	req.UnstablePrefix = "com.example.batch"
+	_, err = cli.BatchSend("!room:example.com", req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", "batch1"}, queries)
+	assert.Equal(t, []string{
+		"/_matrix/client/unstable/org.matrix.msc2716/rooms/!room:example.com/batch_send",
+		"/_matrix/client/unstable/com.example.batch/rooms/!room:example.com/batch_send",
+	}, paths)
+}
+
+func TestClient_UploadLink_NoTokenLeak(t *testing.T) {
+	var externalAuth string
+	external := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		externalAuth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("png data"))
+	}))
+	defer external.Close()
+	var homeserverAuth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		homeserverAuth = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`{"content_uri":"mxc://example.com/abc"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	_, err = cli.UploadLink(external.URL + "/avatar.png")
+	require.NoError(t, err)
+	assert.Empty(t, externalAuth)
+	assert.Equal(t, "Bearer token", homeserverAuth)
+}
+
+func TestClient_SetAvatarFromURL(t *testing.T) {
+	external := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("png data"))
+	}))
+	defer external.Close()
+	var uploads int
+	var avatarURLs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/media/v3/upload":
+			uploads++
+			assert.Equal(t, "image/png", r.Header.Get("Content-Type"))
+			_, _ = w.Write([]byte(`{"content_uri":"mxc://example.com/avatar"}`))
+		case "/_matrix/client/v3/profile/@user:example.com/avatar_url":
+			var req map[string]string
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			avatarURLs = append(avatarURLs, req["avatar_url"])
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.AvatarCache = mautrix.NewMemoryAvatarCache()
+	require.NoError(t, cli.SetAvatarFromURL(external.URL+"/avatar.png"))
+	require.NoError(t, cli.SetAvatarFromURL(external.URL+"/avatar.png"))
+	assert.Equal(t, 1, uploads)
+	assert.Equal(t, []string{"mxc://example.com/avatar", "mxc://example.com/avatar"}, avatarURLs)
+}
+
+func TestClient_GetAuthMetadata(t *testing.T) {
+	var supportMetadata, supportIssuer, plainErrors bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case plainErrors:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case r.URL.Path == "/_matrix/client/unstable/org.matrix.msc2965/auth_metadata" && supportMetadata:
+			_, _ = w.Write([]byte(`{
+				"issuer": "https://auth.example.com/",
+				"authorization_endpoint": "https://auth.example.com/authorize",
+				"scopes_supported": ["openid", "urn:matrix:org.matrix.msc2967.client:api:*"],
+				"account_management_uri": "https://auth.example.com/account"
+			}`))
+		case r.URL.Path == "/_matrix/client/unstable/org.matrix.msc2965/auth_issuer" && supportIssuer:
+			_, _ = w.Write([]byte(`{"issuer":"https://auth.example.com/"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request"}`))
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "", "")
+	require.NoError(t, err)
+
+	supportMetadata = true
+	resp, err := cli.GetAuthMetadata()
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, "https://auth.example.com/", resp.Issuer)
+	assert.Equal(t, "https://auth.example.com/account", resp.AccountManagementURI)
+	assert.Contains(t, resp.ScopesSupported, "openid")
+
+	supportMetadata, supportIssuer = false, true
+	resp, err = cli.GetAuthMetadata()
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, "https://auth.example.com/", resp.Issuer)
+	assert.Empty(t, resp.AuthorizationEndpoint)
+
+	supportIssuer = false
+	resp, err = cli.GetAuthMetadata()
+	assert.NoError(t, err)
+	assert.Nil(t, resp)
+
+	plainErrors = true
+	resp, err = cli.GetAuthMetadata()
+	assert.NoError(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestClient_SendStateEventIfChanged(t *testing.T) {
+	currentTopic := `{"topic":"Hello"}`
+	var sends int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/state/m.room.topic/", r.URL.Path)
+		if r.Method == http.MethodGet {
+			if currentTopic == "" {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Event not found"}`))
+			} else {
+				_, _ = w.Write([]byte(currentTopic))
+			}
+			return
+		}
+		sends++
+		_, _ = w.Write([]byte(`{"event_id":"$topic"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	_, sent, err := cli.SendStateEventIfChanged("!room:example.com", event.StateTopic, "", &event.TopicEventContent{Topic: "Hello"})
+	require.NoError(t, err)
+	assert.False(t, sent)
+	assert.Equal(t, 0, sends)
+
+	resp, sent, err := cli.SendStateEventIfChanged("!room:example.com", event.StateTopic, "", &event.TopicEventContent{Topic: "Changed"})
+	require.NoError(t, err)
+	assert.True(t, sent)
+	assert.Equal(t, id.EventID("$topic"), resp.EventID)
+	assert.Equal(t, 1, sends)
+
+	currentTopic = ""
+	_, sent, err = cli.SendStateEventIfChanged("!room:example.com", event.StateTopic, "", &event.TopicEventContent{Topic: "Hello"})
+	require.NoError(t, err)
+	assert.True(t, sent)
+	assert.Equal(t, 2, sends)
+}
+
+func TestClient_TeardownRoom(t *testing.T) {
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "#first:example.com") {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"You don't have permission"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@bridge:example.com", "token")
+	require.NoError(t, err)
+	err = cli.TeardownRoom("!portal:example.com", []id.RoomAlias{"#first:example.com", "#second:example.com"})
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	assert.Contains(t, err.Error(), "#first:example.com")
+	assert.Equal(t, []string{
+		"DELETE /_matrix/client/v3/directory/room/#first:example.com",
+		"DELETE /_matrix/client/v3/directory/room/#second:example.com",
+		"PUT /_matrix/client/v3/directory/list/room/!portal:example.com",
+		"POST /_matrix/client/v3/rooms/!portal:example.com/leave",
+	}, requests)
+}
+
+func TestClient_IgnoreUser(t *testing.T) {
+	var accountData []byte
+	var puts int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/user/@user:example.com/account_data/m.ignored_user_list", r.URL.Path)
+		if r.Method == http.MethodPut {
+			puts++
+			var err error
+			accountData, err = io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			_, _ = w.Write([]byte(`{}`))
+		} else if accountData == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Account data not found"}`))
+		} else {
+			_, _ = w.Write(accountData)
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	ignored, err := cli.GetIgnoredUsers()
+	require.NoError(t, err)
+	assert.Empty(t, ignored)
+
+	require.NoError(t, cli.IgnoreUser("@spammer:example.com"))
+	require.NoError(t, cli.IgnoreUser("@another:example.com"))
+	require.NoError(t, cli.IgnoreUser("@spammer:example.com"))
+	assert.Equal(t, 2, puts)
+	assert.JSONEq(t, `{"ignored_users":{"@spammer:example.com":{},"@another:example.com":{}}}`, string(accountData))
+	ignored, err = cli.GetIgnoredUsers()
+	require.NoError(t, err)
+	assert.Equal(t, []id.UserID{"@another:example.com", "@spammer:example.com"}, ignored)
+
+	require.NoError(t, cli.UnignoreUser("@spammer:example.com"))
+	require.NoError(t, cli.UnignoreUser("@spammer:example.com"))
+	assert.Equal(t, 3, puts)
+	ignored, err = cli.GetIgnoredUsers()
+	require.NoError(t, err)
+	assert.Equal(t, []id.UserID{"@another:example.com"}, ignored)
+}
+
+func TestClient_ReportEvent(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/report/$event", r.URL.Path)
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"reason":"spam","score":-100}`, string(body))
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	require.NoError(t, cli.ReportEvent("!room:example.com", "$event", "spam", -100))
+	assert.ErrorIs(t, cli.ReportEvent("!room:example.com", "$event", "spam", 1), mautrix.ErrInvalidReportScore)
+	assert.ErrorIs(t, cli.ReportEvent("!room:example.com", "$event", "spam", -101), mautrix.ErrInvalidReportScore)
+	assert.Equal(t, 1, requests)
+}
+
+func TestClient_ReportRoom(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		assert.Equal(t, http.MethodPost, r.Method)
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"reason":"spam room"}`, string(body))
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	require.NoError(t, cli.ReportRoom("!room:example.com", "spam room"))
+	cli.ReportRoomUnstablePrefix = "org.matrix.msc4151"
+	require.NoError(t, cli.ReportRoom("!room:example.com", "spam room"))
+	assert.Equal(t, []string{
+		"/_matrix/client/v3/rooms/!room:example.com/report",
+		"/_matrix/client/unstable/org.matrix.msc4151/rooms/!room:example.com/report",
+	}, paths)
+}
+
+func TestClient_SendRawEvent(t *testing.T) {
+	rawContent := []byte(`{"z_custom": 1,  "msgtype": "m.text", "body": "hello", "a_custom": {"nested": true}}`)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/send/m.room.message/txn1", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, rawContent, body)
+		_, _ = w.Write([]byte(`{"event_id":"$event"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	resp, err := cli.SendRawEvent("!room:example.com", event.EventMessage, rawContent, "txn1")
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$event"), resp.EventID)
+}
+
+func TestClient_SendStateEvent_Timestamp(t *testing.T) {
+	var queries []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/state/m.room.topic/", r.URL.Path)
+		queries = append(queries, r.URL.RawQuery)
+		_, _ = w.Write([]byte(`{"event_id":"$event"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	topic := &event.TopicEventContent{Topic: "Hello"}
+	_, err = cli.SendStateEvent("!room:example.com", event.StateTopic, "", topic)
+	require.NoError(t, err)
+	_, err = cli.SendStateEvent("!room:example.com", event.StateTopic, "", topic, mautrix.ReqSendStateEvent{Timestamp: 1700000000000})
+	require.NoError(t, err)
+	_, err = cli.SendMassagedStateEvent("!room:example.com", event.StateTopic, "", topic, 1700000001000)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", "ts=1700000000000", "ts=1700000001000"}, queries)
+}
+
+func TestClient_SetRoomMemberProfile(t *testing.T) {
+	memberContent := `{"membership":"join","displayname":"Old name","avatar_url":"mxc://example.com/old","com.example.custom":true}`
+	var sentContent []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/state/m.room.member/@ghost:example.com", r.URL.Path)
+		if r.Method == http.MethodPut {
+			var err error
+			sentContent, err = io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			_, _ = w.Write([]byte(`{"event_id":"$event"}`))
+		} else {
+			_, _ = w.Write([]byte(memberContent))
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	err = cli.SetRoomMemberProfile("!room:example.com", "@ghost:example.com", "New name", "mxc://example.com/new")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"membership":"join","displayname":"New name","avatar_url":"mxc://example.com/new","com.example.custom":true}`, string(sentContent))
+
+	err = cli.SetRoomMemberProfile("!room:example.com", "@ghost:example.com", "Only name", "")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"membership":"join","displayname":"Only name","com.example.custom":true}`, string(sentContent))
+
+	sentContent = nil
+	memberContent = `{"membership":"leave"}`
+	err = cli.SetRoomMemberProfile("!room:example.com", "@ghost:example.com", "New name", "")
+	assert.Error(t, err)
+	assert.Nil(t, sentContent)
+}
+
+func TestClient_SetJoinRule(t *testing.T) {
+	var sentContent []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/state/m.room.join_rules/", r.URL.Path)
+		if r.Method == http.MethodPut {
+			var err error
+			sentContent, err = io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			_, _ = w.Write([]byte(`{"event_id":"$event"}`))
+		} else if sentContent == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Event not found"}`))
+		} else {
+			_, _ = w.Write(sentContent)
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	joinRule, err := cli.GetJoinRule("!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, event.JoinRuleInvite, joinRule.JoinRule)
+
+	allow := []event.JoinRuleAllow{{RoomID: "!space:example.com", Type: event.JoinRuleAllowRoomMembership}}
+	_, err = cli.SetJoinRule("!room:example.com", event.JoinRuleRestricted, allow)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"join_rule":"restricted","allow":[{"room_id":"!space:example.com","type":"m.room_membership"}]}`, string(sentContent))
+	joinRule, err = cli.GetJoinRule("!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, &event.JoinRulesEventContent{JoinRule: event.JoinRuleRestricted, Allow: allow}, joinRule)
+
+	_, err = cli.SetJoinRule("!room:example.com", event.JoinRulePublic, allow)
+	assert.ErrorIs(t, err, mautrix.ErrInvalidJoinRule)
+	_, err = cli.SetJoinRule("!room:example.com", "everyone", nil)
+	assert.ErrorIs(t, err, mautrix.ErrInvalidJoinRule)
+}
+
+func TestClient_SetHistoryVisibility(t *testing.T) {
+	var sentContent []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/state/m.room.history_visibility/", r.URL.Path)
+		if r.Method == http.MethodPut {
+			var err error
+			sentContent, err = io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			_, _ = w.Write([]byte(`{"event_id":"$event"}`))
+		} else if sentContent == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Event not found"}`))
+		} else {
+			_, _ = w.Write(sentContent)
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	visibility, err := cli.GetHistoryVisibility("!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, event.HistoryVisibilityShared, visibility)
+
+	_, err = cli.SetHistoryVisibility("!room:example.com", event.HistoryVisibilityJoined)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"history_visibility":"joined"}`, string(sentContent))
+	visibility, err = cli.GetHistoryVisibility("!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, event.HistoryVisibilityJoined, visibility)
+}
+
+func TestClient_EnableEncryption(t *testing.T) {
+	var sentContent []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/state/m.room.encryption/", r.URL.Path)
+		if r.Method == http.MethodPut {
+			var err error
+			sentContent, err = io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			_, _ = w.Write([]byte(`{"event_id":"$event"}`))
+		} else if sentContent == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Event not found"}`))
+		} else {
+			_, _ = w.Write(sentContent)
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.StateStore = mautrix.NewMemoryStateStore()
+	content, err := cli.GetEncryptionEvent("!room:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, content)
+
+	_, err = cli.EnableEncryption("!room:example.com", -1, 100)
+	assert.Error(t, err)
+	_, err = cli.EnableEncryption("!room:example.com", 604800000, -1)
+	assert.Error(t, err)
+	assert.Nil(t, sentContent)
+
+	_, err = cli.EnableEncryption("!room:example.com", 604800000, 100)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"algorithm":"m.megolm.v1.aes-sha2","rotation_period_ms":604800000,"rotation_period_msgs":100}`, string(sentContent))
+	content, err = cli.GetEncryptionEvent("!room:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, content)
+	assert.Equal(t, id.AlgorithmMegolmV1, content.Algorithm)
+	assert.True(t, cli.StateStore.IsEncrypted("!room:example.com"))
+}
+
+func TestClient_GetAllRelations(t *testing.T) {
+	var requests int
+	endless := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/_matrix/client/v1/rooms/!room:example.com/relations/$target/m.annotation/m.reaction", r.URL.Path)
+		from := r.URL.Query().Get("from")
+		switch {
+		case endless:
+			_, _ = fmt.Fprintf(w, `{"chunk":[{"type":"m.reaction","event_id":"$page%d"}],"next_batch":"page%d"}`, requests, requests)
+		case from == "":
+			_, _ = w.Write([]byte(`{"chunk":[{"type":"m.reaction","event_id":"$1"},{"type":"m.reaction","event_id":"$2"}],"next_batch":"page2"}`))
+		case from == "page2":
+			_, _ = w.Write([]byte(`{"chunk":[{"type":"m.reaction","event_id":"$3"}]}`))
+		default:
+			t.Errorf("unexpected from token %q", from)
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	evts, err := cli.GetAllRelations("!room:example.com", "$target", event.RelAnnotation, event.EventReaction)
+	require.NoError(t, err)
+	require.Len(t, evts, 3)
+	assert.Equal(t, id.EventID("$3"), evts[2].ID)
+	assert.Equal(t, 2, requests)
+
+	endless = true
+	requests = 0
+	defer func(prev int) { mautrix.MaxRelationPages = prev }(mautrix.MaxRelationPages)
+	mautrix.MaxRelationPages = 5
+	evts, err = cli.GetAllRelations("!room:example.com", "$target", event.RelAnnotation, event.EventReaction)
+	assert.ErrorIs(t, err, mautrix.ErrTooManyRelationPages)
+	assert.Len(t, evts, 5)
+	assert.Equal(t, 5, requests)
+}
+
+func TestClient_CreateMXC_UploadToMXC(t *testing.T) {
+	var uploaded []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/versions":
+			_, _ = w.Write([]byte(`{"versions":["v1.6","v1.7"]}`))
+		case "/_matrix/media/v1/create":
+			assert.Equal(t, http.MethodPost, r.Method)
+			_, _ = w.Write([]byte(`{"content_uri":"mxc://example.com/async","unused_expires_at":1700000000000}`))
+		case "/_matrix/media/v3/upload/example.com/async":
+			assert.Equal(t, http.MethodPut, r.Method)
+			assert.Equal(t, "text/plain", r.Header.Get("Content-Type"))
+			var err error
+			uploaded, err = io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	supported, err := cli.SupportsAsyncUploads()
+	require.NoError(t, err)
+	assert.True(t, supported)
+	resp, err := cli.CreateMXC()
+	require.NoError(t, err)
+	assert.Equal(t, "mxc://example.com/async", resp.ContentURI.String())
+	// MultiReader hides the length of the data, so the upload has to be streamed
+	err = cli.UploadToMXC(resp.ContentURI, io.MultiReader(strings.NewReader("hello "), strings.NewReader("world")), "text/plain")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(uploaded))
+}
+
+func TestClient_FollowTombstone(t *testing.T) {
+	var joined []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v3/rooms/!old:example.com/state/m.room.tombstone/":
+			_, _ = w.Write([]byte(`{"body":"This room has been replaced","replacement_room":"!new:example.com"}`))
+		case "/_matrix/client/v3/rooms/!current:example.com/state/m.room.tombstone/":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Event not found"}`))
+		case "/_matrix/client/v3/rooms/!new:example.com/join":
+			assert.Equal(t, http.MethodPost, r.Method)
+			joined = append(joined, "!new:example.com")
+			_, _ = w.Write([]byte(`{"room_id":"!new:example.com"}`))
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	tombstone, err := cli.GetRoomTombstone("!old:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, tombstone)
+	assert.Equal(t, "This room has been replaced", tombstone.Body)
+
+	newRoomID, err := cli.FollowTombstone("!old:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!new:example.com"), newRoomID)
+	assert.Equal(t, []string{"!new:example.com"}, joined)
+
+	newRoomID, err = cli.FollowTombstone("!current:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, newRoomID)
+	assert.Len(t, joined, 1)
+}
+
+func TestClient_GetRoomVersion(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v3/rooms/!v10:example.com/state/m.room.create/":
+			_, _ = w.Write([]byte(`{"creator":"@alice:example.com","room_version":"10"}`))
+		case "/_matrix/client/v3/rooms/!v1:example.com/state/m.room.create/":
+			_, _ = w.Write([]byte(`{"creator":"@alice:example.com"}`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"Not in room"}`))
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	version, err := cli.GetRoomVersion("!v10:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "10", version)
+	version, err = cli.GetRoomVersion("!v1:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "1", version)
+	_, err = cli.GetRoomVersion("!other:example.com")
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+}
+
+func TestClient_IsSpace(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v3/rooms/!space:example.com/state/m.room.create/":
+			_, _ = w.Write([]byte(`{"creator":"@alice:example.com","room_version":"10","type":"m.space"}`))
+		case "/_matrix/client/v3/rooms/!room:example.com/state/m.room.create/":
+			_, _ = w.Write([]byte(`{"creator":"@alice:example.com","room_version":"10"}`))
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	isSpace, err := cli.IsSpace("!space:example.com")
+	require.NoError(t, err)
+	assert.True(t, isSpace)
+	isSpace, err = cli.IsSpace("!room:example.com")
+	require.NoError(t, err)
+	assert.False(t, isSpace)
+}
+
+func TestClient_CustomJSON(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.JSONEq(t, `{"custom":true}`, string(body))
+		_, _ = w.Write([]byte(`{"user_id":"@user:example.com"}`))
+	}))
+	defer ts.Close()
+
+	origMarshal, origUnmarshal := mautrix.Marshal, mautrix.Unmarshal
+	defer func() {
+		mautrix.Marshal, mautrix.Unmarshal = origMarshal, origUnmarshal
+	}()
+	var marshalCalls, unmarshalCalls int
+	mautrix.Marshal = func(v any) ([]byte, error) {
+		marshalCalls++
+		return []byte(`{"custom":true}`), nil
+	}
+	mautrix.Unmarshal = func(data []byte, v any) error {
+		unmarshalCalls++
+		return json.Unmarshal(data, v)
+	}
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	var resp mautrix.RespWhoami
+	_, err = cli.MakeRequest(http.MethodPost, cli.BuildClientURL("v3", "test"), map[string]any{"original": true}, &resp)
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@user:example.com"), resp.UserID)
+	assert.Equal(t, 1, marshalCalls)
+	assert.Equal(t, 1, unmarshalCalls)
+}
+
+func TestClient_MakeRequest_TruncatedBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		_, _ = w.Write([]byte(`{"user_id":`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	_, err = cli.Whoami()
+	require.Error(t, err)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Contains(t, err.Error(), "failed to read response body (HTTP 200)")
+	var httpErr mautrix.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.True(t, httpErr.IsStatus(http.StatusOK))
+}
+
+type closeTrackingBody struct {
+	io.ReadCloser
+	closed bool
+}
+
+func (ctb *closeTrackingBody) Close() error {
+	ctb.closed = true
+	return ctb.ReadCloser.Close()
+}
+
+type closeTrackingTransport struct {
+	bodies []*closeTrackingBody
+}
+
+func (ctt *closeTrackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if res != nil {
+		body := &closeTrackingBody{ReadCloser: res.Body}
+		ctt.bodies = append(ctt.bodies, body)
+		res.Body = body
+	}
+	return res, err
+}
+
+func TestClient_MakeRequest_ResponseAndError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	}))
+	defer ts.Close()
+
+	redirectErr := errors.New("redirects not allowed")
+	transport := &closeTrackingTransport{}
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.Client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return redirectErr
+		},
+	}
+	_, err = cli.Whoami()
+	require.Error(t, err)
+	assert.ErrorIs(t, err, redirectErr)
+	var httpErr mautrix.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.True(t, httpErr.IsStatus(http.StatusFound))
+	require.Len(t, transport.bodies, 1)
+	assert.True(t, transport.bodies[0].closed)
+}
+
+func TestClient_MakeRequest_RetryClosesBody(t *testing.T) {
+	transport := &closeTrackingTransport{}
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte(`bad gateway`))
+			return
+		}
+		assert.True(t, transport.bodies[0].closed, "first response body should be closed before retrying")
+		_, _ = w.Write([]byte(`{"user_id":"@user:example.com"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.Client = &http.Client{Transport: transport}
+	cli.DefaultHTTPBackoff = time.Millisecond
+	var resp mautrix.RespWhoami
+	_, err = cli.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodGet,
+		URL:          cli.BuildClientURL("v3", "account", "whoami"),
+		ResponseJSON: &resp,
+		MaxAttempts:  2,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@user:example.com"), resp.UserID)
+	assert.Len(t, transport.bodies, 2)
+}
+
+func TestClient_SendMassagedStateEvent_AppServiceUser(t *testing.T) {
+	var query url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/state/m.room.topic/", r.URL.Path)
+		query = r.URL.Query()
+		_, _ = w.Write([]byte(`{"event_id":"$event"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@ghost:example.com", "as_token")
+	require.NoError(t, err)
+	cli.SetAppServiceUserID = true
+	_, err = cli.SendMassagedStateEvent("!room:example.com", event.StateTopic, "", &event.TopicEventContent{Topic: "hi"}, 1234)
+	require.NoError(t, err)
+	assert.Equal(t, "1234", query.Get("ts"))
+	assert.Equal(t, "@ghost:example.com", query.Get("user_id"))
+
+	_, err = cli.SendStateEvent("!room:example.com", event.StateTopic, "", &event.TopicEventContent{Topic: "hi"}, mautrix.ReqSendStateEvent{Timestamp: 5678})
+	require.NoError(t, err)
+	assert.Equal(t, "5678", query.Get("ts"))
+	assert.Equal(t, "@ghost:example.com", query.Get("user_id"))
+}
+
+func TestClient_EventIDPathEscaping(t *testing.T) {
+	const eventID = id.EventID("$abc/def+ghi")
+	var seenPaths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenPaths = append(seenPaths, r.URL.EscapedPath())
+		// Split the escaped path like a homeserver router would, then decode each segment separately
+		parts := strings.Split(r.URL.EscapedPath(), "/")
+		var decodedEventID string
+		for i, part := range parts {
+			if i > 0 && (parts[i-1] == "event" || parts[i-1] == "redact" || parts[i-1] == "relations") {
+				var err error
+				decodedEventID, err = url.PathUnescape(part)
+				require.NoError(t, err)
+				break
+			}
+		}
+		if decodedEventID != string(eventID) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Event not found"}`))
+			return
+		}
+		switch {
+		case strings.Contains(r.URL.Path, "/relations/"):
+			_, _ = w.Write([]byte(`{"chunk":[]}`))
+		case strings.Contains(r.URL.Path, "/redact/"):
+			_, _ = w.Write([]byte(`{"event_id":"$redaction"}`))
+		default:
+			_, _ = w.Write([]byte(`{"type":"m.room.message","event_id":"$abc/def+ghi","room_id":"!room:example.com","sender":"@user:example.com","content":{}}`))
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	evt, err := cli.GetEvent("!room:example.com", eventID)
+	require.NoError(t, err)
+	assert.Equal(t, eventID, evt.ID)
+	_, err = cli.RedactEvent("!room:example.com", eventID, mautrix.ReqRedact{TxnID: "txn"})
+	require.NoError(t, err)
+	_, err = cli.GetRelations("!room:example.com", eventID, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"/_matrix/client/v3/rooms/%21room:example.com/event/$abc%2Fdef+ghi",
+		"/_matrix/client/v3/rooms/%21room:example.com/redact/$abc%2Fdef+ghi/txn",
+		"/_matrix/client/v1/rooms/%21room:example.com/relations/$abc%2Fdef+ghi",
+	}, seenPaths)
+}
+
+func TestClient_Clone(t *testing.T) {
+	var authHeaders, userIDs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeaders = append(authHeaders, r.Header.Get("Authorization"))
+		userIDs = append(userIDs, r.URL.Query().Get("user_id"))
+		_, _ = w.Write([]byte(`{"user_id":"@user:example.com"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@bot:example.com", "as_token")
+	require.NoError(t, err)
+	cli.SetAppServiceUserID = true
+	cli.TxnID()
+	cli.TxnID()
+
+	clone := cli.Clone()
+	clone.UserID = "@ghost:example.com"
+	assert.Same(t, cli.Client, clone.Client)
+	assert.Same(t, cli.HomeserverURL, clone.HomeserverURL)
+	assert.Same(t, cli.Store, clone.Store)
+	assert.True(t, strings.HasSuffix(clone.TxnID(), "_1"))
+	assert.True(t, strings.HasSuffix(cli.TxnID(), "_3"))
+
+	clone2 := cli.Clone()
+	clone2.AccessToken = "other_token"
+	clone2.SetAppServiceUserID = false
+
+	_, err = cli.Whoami()
+	require.NoError(t, err)
+	_, err = clone.Whoami()
+	require.NoError(t, err)
+	_, err = clone2.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Bearer as_token", "Bearer as_token", "Bearer other_token"}, authHeaders)
+	assert.Equal(t, []string{"@bot:example.com", "@ghost:example.com", ""}, userIDs)
+
+	// The transport of the shared HTTP client must not fall back to the original client's token
+	noToken := cli.Clone()
+	noToken.AccessToken = ""
+	_, err = noToken.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, "", authHeaders[3])
+}
+
+type fakeCryptoHelper struct {
+	mautrix.CryptoHelper
+}
+
+type fakeAvatarCache struct {
+	mautrix.AvatarCache
+}
+
+func TestClient_Clone_CopiesAllFields(t *testing.T) {
+	cli, err := mautrix.NewClient("https://example.com", "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.StateStore = mautrix.NewMemoryStateStore()
+	cli.Crypto = fakeCryptoHelper{}
+	cli.AvatarCache = fakeAvatarCache{}
+	// Fill all remaining exported fields with non-zero values, so that a field that Clone doesn't copy is noticed.
+	src := reflect.ValueOf(cli).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		field := src.Type().Field(i)
+		value := src.Field(i)
+		if !field.IsExported() || !value.IsZero() {
+			continue
+		}
+		switch value.Kind() {
+		case reflect.Bool:
+			value.SetBool(true)
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			value.SetInt(1)
+		case reflect.String:
+			value.SetString("value")
+		case reflect.Pointer:
+			value.Set(reflect.New(value.Type().Elem()))
+		case reflect.Slice:
+			value.Set(reflect.MakeSlice(value.Type(), 1, 1))
+		case reflect.Func:
+			fnType := value.Type()
+			value.Set(reflect.MakeFunc(fnType, func([]reflect.Value) []reflect.Value {
+				out := make([]reflect.Value, fnType.NumOut())
+				for j := range out {
+					out[j] = reflect.Zero(fnType.Out(j))
+				}
+				return out
+			}))
+		default:
+			t.Fatalf("Don't know how to fill field %s of type %s", field.Name, field.Type)
+		}
+	}
+
+	clone := reflect.ValueOf(cli.Clone()).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		field := src.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Type.Kind() == reflect.Func {
+			assert.Equal(t, src.Field(i).Pointer(), clone.Field(i).Pointer(), "field %s wasn't copied", field.Name)
+		} else {
+			assert.Equal(t, src.Field(i).Interface(), clone.Field(i).Interface(), "field %s wasn't copied", field.Name)
+		}
+	}
+}
+
+func TestClient_SetRoomNameTopicAvatar(t *testing.T) {
+	sent := make(map[string]json.RawMessage)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		body, _ := io.ReadAll(r.Body)
+		sent[r.URL.Path] = body
+		_, _ = w.Write([]byte(`{"event_id":"$event"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	resp, err := cli.SetRoomName("!room:example.com", "Room name")
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$event"), resp.EventID)
+	_, err = cli.SetRoomTopic("!room:example.com", "Room topic")
+	require.NoError(t, err)
+	_, err = cli.SetRoomAvatar("!room:example.com", id.ContentURI{Homeserver: "example.com", FileID: "avatar"})
+	require.NoError(t, err)
+
+	require.Len(t, sent, 3)
+	assert.JSONEq(t, `{"name":"Room name"}`, string(sent["/_matrix/client/v3/rooms/!room:example.com/state/m.room.name/"]))
+	assert.JSONEq(t, `{"topic":"Room topic"}`, string(sent["/_matrix/client/v3/rooms/!room:example.com/state/m.room.topic/"]))
+	assert.JSONEq(t, `{"url":"mxc://example.com/avatar"}`, string(sent["/_matrix/client/v3/rooms/!room:example.com/state/m.room.avatar/"]))
+}
+
+func TestClient_IsOwnEvent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"event_id":"$event"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@bot:example.com", "token")
+	require.NoError(t, err)
+	_, err = cli.SendMessageEvent("!room:example.com", event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "hi"}, mautrix.ReqSendEvent{TransactionID: "txn1"})
+	require.NoError(t, err)
+	ghost := cli.Clone()
+	ghost.UserID = "@ghost:example.com"
+	_, err = ghost.SendRawEvent("!room:example.com", event.EventMessage, json.RawMessage(`{"msgtype":"m.text","body":"hi"}`), "txn2")
+	require.NoError(t, err)
+
+	assert.True(t, cli.IsOwnEvent(&event.Event{Sender: "@bot:example.com"}))
+	assert.True(t, cli.IsOwnEvent(&event.Event{Sender: "@ghost:example.com", Unsigned: event.Unsigned{TransactionID: "txn2"}}))
+	assert.True(t, cli.IsOwnEvent(&event.Event{Sender: "@other:example.com", Unsigned: event.Unsigned{TransactionID: "txn1"}}))
+	assert.False(t, cli.IsOwnEvent(&event.Event{Sender: "@other:example.com", Unsigned: event.Unsigned{TransactionID: "txn3"}}))
+	assert.False(t, cli.IsOwnEvent(&event.Event{Sender: "@other:example.com"}))
+
+	cli.SentTransactions = nil
+	assert.False(t, cli.IsOwnEvent(&event.Event{Sender: "@other:example.com", Unsigned: event.Unsigned{TransactionID: "txn1"}}))
+}
+
+func TestTransactionTracker_Limit(t *testing.T) {
+	tracker := mautrix.NewTransactionTracker(3)
+	for _, txnID := range []string{"1", "2", "3", "3", "4"} {
+		tracker.Add(txnID)
+	}
+	assert.False(t, tracker.Has("1"))
+	assert.True(t, tracker.Has("2"))
+	assert.True(t, tracker.Has("3"))
+	assert.True(t, tracker.Has("4"))
+}
+
+func TestIsEndpointNotSupported(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/org.matrix.msc2716/rooms/!unrecognized:example.com/batch_send":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request"}`))
+		case "/_matrix/client/unstable/org.matrix.msc2716/rooms/!plain404:example.com/batch_send":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`404 page not found`))
+		case "/_matrix/client/unstable/org.matrix.msc2716/rooms/!forbidden:example.com/batch_send":
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"Nope"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Room not found"}`))
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	_, err = cli.BatchSend("!unrecognized:example.com", &mautrix.ReqBatchSend{})
+	assert.True(t, mautrix.IsEndpointNotSupported(err))
+	assert.ErrorIs(t, err, mautrix.MUnrecognized)
+	_, err = cli.BatchSend("!plain404:example.com", &mautrix.ReqBatchSend{})
+	assert.True(t, mautrix.IsEndpointNotSupported(err))
+	_, err = cli.BatchSend("!forbidden:example.com", &mautrix.ReqBatchSend{})
+	assert.Error(t, err)
+	assert.False(t, mautrix.IsEndpointNotSupported(err))
+	_, err = cli.BatchSend("!other:example.com", &mautrix.ReqBatchSend{})
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+	assert.False(t, mautrix.IsEndpointNotSupported(err))
+
+	assert.True(t, mautrix.IsEndpointNotSupported(fmt.Errorf("wrapped: %w", mautrix.MUnrecognized)))
+	assert.False(t, mautrix.IsEndpointNotSupported(errors.New("M_UNRECOGNIZED")))
+	assert.False(t, mautrix.IsEndpointNotSupported(nil))
+}
+
+func TestClient_MarkReadMultiple(t *testing.T) {
+	var lock sync.Mutex
+	received := make(map[id.RoomID]id.EventID)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/_matrix/client/v3/rooms/"), "/")
+		if !assert.Len(t, parts, 4) {
+			return
+		}
+		assert.Equal(t, "receipt", parts[1])
+		assert.Equal(t, string(event.ReceiptTypeRead), parts[2])
+		if parts[0] == "!forbidden:example.com" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"Not in room"}`))
+			return
+		}
+		lock.Lock()
+		received[id.RoomID(parts[0])] = id.EventID(parts[3])
+		lock.Unlock()
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	positions := make(map[id.RoomID]id.EventID)
+	for i := 0; i < 20; i++ {
+		positions[id.RoomID(fmt.Sprintf("!room%d:example.com", i))] = id.EventID(fmt.Sprintf("$event%d", i))
+	}
+	require.NoError(t, cli.MarkReadMultiple(positions))
+	assert.Equal(t, positions, received)
+
+	err = cli.MarkReadMultiple(map[id.RoomID]id.EventID{
+		"!room0:example.com":     "$event0",
+		"!forbidden:example.com": "$event1",
+	})
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	assert.Contains(t, err.Error(), "!forbidden:example.com")
+}
+
+func TestClient_Login_DeviceID(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/login", r.URL.Path)
+		var req map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "EXISTINGDEVICE", req["device_id"])
+		assert.Equal(t, "My bridge", req["initial_device_display_name"])
+		_, _ = w.Write([]byte(`{"access_token":"new_token","device_id":"EXISTINGDEVICE","user_id":"@user:example.com"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "", "")
+	require.NoError(t, err)
+	resp, err := cli.Login(&mautrix.ReqLogin{
+		Type:                     mautrix.AuthTypePassword,
+		Identifier:               mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: "user"},
+		Password:                 "password",
+		DeviceID:                 "EXISTINGDEVICE",
+		InitialDeviceDisplayName: "My bridge",
+		StoreCredentials:         true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, id.DeviceID("EXISTINGDEVICE"), resp.DeviceID)
+	assert.Nil(t, resp.WellKnown)
+	assert.Equal(t, id.DeviceID("EXISTINGDEVICE"), cli.DeviceID)
+	assert.Equal(t, "new_token", cli.AccessToken)
+	assert.Equal(t, id.UserID("@user:example.com"), cli.UserID)
+}
+
+func TestClient_Login_WellKnown(t *testing.T) {
+	newServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/account/whoami", r.URL.Path)
+		_, _ = w.Write([]byte(`{"user_id":"@user:example.com"}`))
+	}))
+	defer newServer.Close()
+	loginServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/login", r.URL.Path)
+		_, _ = fmt.Fprintf(w, `{"access_token":"token","device_id":"DEVICE","user_id":"@user:example.com","well_known":{"m.homeserver":{"base_url":%q}}}`, newServer.URL)
+	}))
+	defer loginServer.Close()
+
+	cli, err := mautrix.NewClient(loginServer.URL, "", "")
+	require.NoError(t, err)
+	resp, err := cli.Login(&mautrix.ReqLogin{
+		Type:               mautrix.AuthTypeToken,
+		Token:              "login_token",
+		StoreCredentials:   true,
+		StoreHomeserverURL: true,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp.WellKnown)
+	assert.Equal(t, newServer.URL, resp.WellKnown.Homeserver.BaseURL)
+	assert.Equal(t, newServer.URL, cli.HomeserverURL.String())
+	_, err = cli.Whoami()
+	require.NoError(t, err)
+
+	cli.ApplyWellKnown(&mautrix.ClientWellKnown{Homeserver: mautrix.HomeserverInfo{BaseURL: "://invalid"}})
+	assert.Equal(t, newServer.URL, cli.HomeserverURL.String())
+	cli.ApplyWellKnown(nil)
+	assert.Equal(t, newServer.URL, cli.HomeserverURL.String())
+}
+
+func TestClient_MediaPrefix_Upload(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/custom/media/upload", r.URL.Path)
+		_, _ = w.Write([]byte(`{"content_uri":"mxc://example.com/abc"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.MediaPrefix = []string{"custom", "media"}
+	resp, err := cli.UploadBytes([]byte("hello"), "text/plain")
+	require.NoError(t, err)
+	assert.Equal(t, "mxc://example.com/abc", resp.ContentURI.String())
+}
+
+func TestClient_Download_AuthAndErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		assert.Contains(t, r.Header.Get("User-Agent"), "media downloader")
+		if r.URL.Path == "/_matrix/media/v3/download/example.com/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Media not found"}`))
+			return
+		}
+		_, _ = w.Write([]byte("media data"))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	data, err := cli.DownloadBytes(id.ContentURI{Homeserver: "example.com", FileID: "ok"})
+	require.NoError(t, err)
+	assert.Equal(t, "media data", string(data))
+
+	transport := &closeTrackingTransport{}
+	cli.Client = &http.Client{Transport: transport}
+	body, err := cli.Download(id.ContentURI{Homeserver: "example.com", FileID: "missing"})
+	assert.Nil(t, body)
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+	require.Len(t, transport.bodies, 1)
+	assert.True(t, transport.bodies[0].closed)
+}
@@ -17,6 +17,7 @@ package canonicaljson
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"sort"
 	"unicode/utf8"
@@ -35,6 +36,18 @@ func CanonicalJSON(input []byte) ([]byte, error) {
 	return CanonicalJSONAssumeValid(input), nil
 }
 
+// Marshal encodes the given value as JSON using encoding/json and then re-encodes it in the canonical encoding.
+//
+// Numbers are not validated, so the caller must ensure that the value doesn't contain floats or integers
+// outside the range allowed by the spec.
+func Marshal(input interface{}) ([]byte, error) {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	return CanonicalJSONAssumeValid(data), nil
+}
+
 // CanonicalJSONAssumeValid is the same as CanonicalJSON, but assumes the
 // input is valid JSON
 func CanonicalJSONAssumeValid(input []byte) []byte {
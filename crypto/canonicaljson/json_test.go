@@ -89,3 +89,43 @@ func TestReadHex(t *testing.T) {
 	testReadHex(t, "89ab", 0x89AB)
 	testReadHex(t, "cdef", 0xCDEF)
 }
+
+func testMarshal(t *testing.T, input interface{}, want string) {
+	got, err := Marshal(input)
+	if err != nil {
+		t.Errorf("Marshal(%#v): unexpected error %v", input, err)
+	} else if string(got) != want {
+		t.Errorf("Marshal(%#v): want %q got %q", input, want, got)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	// Examples from https://spec.matrix.org/v1.2/appendices/#canonical-json
+	testMarshal(t, map[string]interface{}{}, `{}`)
+	testMarshal(t, struct {
+		Two string `json:"two"`
+		One int    `json:"one"`
+	}{"Two", 1}, `{"one":1,"two":"Two"}`)
+	testMarshal(t, struct {
+		B string `json:"b"`
+		A string `json:"a"`
+	}{"2", "1"}, `{"a":"1","b":"2"}`)
+	testMarshal(t, map[string]interface{}{
+		"auth": map[string]interface{}{
+			"success": true,
+			"mxid":    "@john.doe:example.com",
+			"profile": map[string]interface{}{
+				"display_name": "John Doe",
+				"three_pids": []interface{}{
+					map[string]interface{}{"medium": "email", "address": "john.doe@example.org"},
+					map[string]interface{}{"medium": "msisdn", "address": "123456789"},
+				},
+			},
+		},
+	}, `{"auth":{"mxid":"@john.doe:example.com","profile":{"display_name":"John Doe","three_pids":[{"address":"john.doe@example.org","medium":"email"},{"address":"123456789","medium":"msisdn"}]},"success":true}}`)
+	testMarshal(t, map[string]string{"a": "日本語"}, `{"a":"日本語"}`)
+	testMarshal(t, map[string]int{"本": 2, "日": 1}, `{"日":1,"本":2}`)
+	testMarshal(t, map[string]interface{}{"a": nil}, `{"a":null}`)
+	// encoding/json escapes HTML characters, which must be unescaped in canonical JSON
+	testMarshal(t, map[string]string{"a": "<b>&"}, `{"a":"<b>&"}`)
+}
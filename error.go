@@ -69,6 +69,35 @@ var (
 	MConnectionFailed  = RespError{ErrCode: "M_CONNECTION_FAILED"}
 )
 
+// ErrInvalidPresence is returned when trying to sync or set presence with a value that isn't one of the presence
+// constants in the event package.
+var ErrInvalidPresence = errors.New("invalid presence value")
+
+// ErrInvalidReportScore is returned by ReportEvent when the score is outside the allowed range of -100 to 0.
+var ErrInvalidReportScore = errors.New("report score must be between -100 and 0")
+
+// ErrInvalidJoinRule is returned by SetJoinRule when the join rule isn't one of the join rule constants in the event
+// package, or when allow conditions are specified for a join rule that isn't restricted.
+var ErrInvalidJoinRule = errors.New("invalid join rule")
+
+// ErrTooManyRelationPages is returned by GetAllRelations if there are still more relations after MaxRelationPages pages.
+var ErrTooManyRelationPages = errors.New("too many pages of relations")
+
+// ErrEndpointNotSupported matches HTTPErrors that mean the server doesn't implement the requested endpoint,
+// i.e. responses with the M_UNRECOGNIZED error code, or 404/405 responses without a Matrix error code.
+// This is mostly useful for unstable endpoints, so that callers can fall back gracefully:
+//
+//	resp, err := client.BatchSend(roomID, req)
+//	if mautrix.IsEndpointNotSupported(err) {
+//		// use a fallback
+//	}
+var ErrEndpointNotSupported = errors.New("endpoint not supported by server")
+
+// IsEndpointNotSupported checks if the given error matches ErrEndpointNotSupported.
+func IsEndpointNotSupported(err error) bool {
+	return errors.Is(err, ErrEndpointNotSupported)
+}
+
 // HTTPError An HTTP Error response, which may wrap an underlying native Go Error.
 type HTTPError struct {
 	Request      *http.Request
@@ -81,6 +110,10 @@ type HTTPError struct {
 }
 
 func (e HTTPError) Is(err error) bool {
+	if err == ErrEndpointNotSupported && e.RespError == nil && e.WrappedError == nil {
+		// Servers that don't know the endpoint at all may not respond with a Matrix error
+		return e.IsStatus(http.StatusNotFound) || e.IsStatus(http.StatusMethodNotAllowed)
+	}
 	return (e.RespError != nil && errors.Is(e.RespError, err)) || (e.WrappedError != nil && errors.Is(e.WrappedError, err))
 }
 
@@ -115,9 +148,12 @@ func (e HTTPError) Unwrap() error {
 // RespError is the standard JSON error response from Homeservers. It also implements the Golang "error" interface.
 // See https://spec.matrix.org/v1.2/client-server-api/#api-standards
 type RespError struct {
-	ErrCode   string
-	Err       string
-	ExtraData map[string]interface{}
+	ErrCode string
+	Err     string
+	// SoftLogout is set on M_UNKNOWN_TOKEN errors if the session was soft logged out, which means the client
+	// should log in again (or refresh its access token) without discarding local data like encryption keys.
+	SoftLogout bool
+	ExtraData  map[string]interface{}
 }
 
 func (e *RespError) UnmarshalJSON(data []byte) error {
@@ -127,6 +163,7 @@ func (e *RespError) UnmarshalJSON(data []byte) error {
 	}
 	e.ErrCode, _ = e.ExtraData["errcode"].(string)
 	e.Err, _ = e.ExtraData["error"].(string)
+	e.SoftLogout, _ = e.ExtraData["soft_logout"].(bool)
 	return nil
 }
 
@@ -137,6 +174,9 @@ func (e *RespError) MarshalJSON() ([]byte, error) {
 	}
 	data["errcode"] = e.ErrCode
 	data["error"] = e.Err
+	if e.SoftLogout {
+		data["soft_logout"] = true
+	}
 	return json.Marshal(data)
 }
 
@@ -146,6 +186,9 @@ func (e RespError) Error() string {
 }
 
 func (e RespError) Is(err error) bool {
+	if err == ErrEndpointNotSupported {
+		return e.ErrCode == MUnrecognized.ErrCode
+	}
 	e2, ok := err.(RespError)
 	if !ok {
 		return false
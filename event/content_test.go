@@ -0,0 +1,82 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func parseContent(t *testing.T, evtType event.Type, data string) *event.Content {
+	var content event.Content
+	require.NoError(t, json.Unmarshal([]byte(data), &content))
+	require.NoError(t, content.ParseRaw(evtType))
+	return &content
+}
+
+func TestContent_TypedAccessors(t *testing.T) {
+	member := parseContent(t, event.StateMember, `{"membership":"join","displayname":"Alice"}`).AsMember()
+	assert.Equal(t, event.MembershipJoin, member.Membership)
+	assert.Equal(t, "Alice", member.Displayname)
+
+	pl := parseContent(t, event.StatePowerLevels, `{"users":{"@alice:example.com":100},"events_default":50}`).AsPowerLevels()
+	assert.Equal(t, 100, pl.GetUserLevel("@alice:example.com"))
+	assert.Equal(t, 50, pl.EventsDefault)
+
+	assert.Equal(t, "Topic", parseContent(t, event.StateTopic, `{"topic":"Topic"}`).AsTopic().Topic)
+	assert.Equal(t, "Name", parseContent(t, event.StateRoomName, `{"name":"Name"}`).AsRoomName().Name)
+	assert.Equal(t, id.AlgorithmMegolmV1, parseContent(t, event.StateEncryption, `{"algorithm":"m.megolm.v1.aes-sha2"}`).AsEncryption().Algorithm)
+
+	reaction := parseContent(t, event.EventReaction, `{"m.relates_to":{"rel_type":"m.annotation","event_id":"$target","key":"👍"}}`).AsReaction()
+	assert.Equal(t, event.RelAnnotation, reaction.RelatesTo.Type)
+	assert.Equal(t, id.EventID("$target"), reaction.RelatesTo.EventID)
+	assert.Equal(t, "👍", reaction.RelatesTo.Key)
+
+	msg := parseContent(t, event.EventMessage, `{"msgtype":"m.text","body":"hello"}`).AsMessage()
+	assert.Equal(t, event.MsgText, msg.MsgType)
+	assert.Equal(t, "hello", msg.Body)
+}
+
+func TestContent_AsCreate(t *testing.T) {
+	space := parseContent(t, event.StateCreate, `{
+		"creator": "@alice:example.com",
+		"room_version": "10",
+		"type": "m.space",
+		"m.federate": true,
+		"predecessor": {"room_id": "!old:example.com", "event_id": "$tombstone"}
+	}`).AsCreate()
+	assert.Equal(t, event.RoomTypeSpace, space.Type)
+	assert.Equal(t, id.UserID("@alice:example.com"), space.Creator)
+	assert.Equal(t, "10", space.RoomVersion)
+	assert.True(t, space.Federate)
+	require.NotNil(t, space.Predecessor)
+	assert.Equal(t, id.RoomID("!old:example.com"), space.Predecessor.RoomID)
+	assert.Equal(t, id.EventID("$tombstone"), space.Predecessor.EventID)
+
+	room := parseContent(t, event.StateCreate, `{"creator": "@alice:example.com"}`).AsCreate()
+	assert.Equal(t, event.RoomTypeDefault, room.Type)
+	assert.Empty(t, room.RoomVersion)
+	assert.Nil(t, room.Predecessor)
+}
+
+func TestContent_TypedAccessors_WrongType(t *testing.T) {
+	content := parseContent(t, event.StateTopic, `{"topic":"Topic"}`)
+	// Accessors for other types return an empty struct instead of nil
+	assert.NotNil(t, content.AsMember())
+	assert.Equal(t, event.Membership(""), content.AsMember().Membership)
+	assert.ErrorIs(t, content.ParseRaw(event.StateTopic), event.ErrContentAlreadyParsed)
+
+	var unknown event.Content
+	require.NoError(t, json.Unmarshal([]byte(`{}`), &unknown))
+	assert.ErrorIs(t, unknown.ParseRaw(event.Type{Type: "com.example.unknown"}), event.ErrUnsupportedContentType)
+}
@@ -36,6 +36,40 @@ func (rec ReceiptEventContent) GetOrCreate(evt id.EventID) Receipts {
 	return receipts
 }
 
+// GetReceipt returns the receipt the given user sent for the given event. Public read receipts are preferred over
+// private ones if the user has both. The second return value is false if there is no receipt.
+func (rec ReceiptEventContent) GetReceipt(evtID id.EventID, userID id.UserID) (ReadReceipt, bool) {
+	receipts := rec[evtID]
+	if receipt, ok := receipts[ReceiptTypeRead][userID]; ok {
+		return receipt, true
+	}
+	if receipt, ok := receipts[ReceiptTypeReadPrivate][userID]; ok {
+		return receipt, true
+	}
+	for receiptType, userReceipts := range receipts {
+		if receiptType == ReceiptTypeRead || receiptType == ReceiptTypeReadPrivate {
+			continue
+		} else if receipt, ok := userReceipts[userID]; ok {
+			return receipt, true
+		}
+	}
+	return ReadReceipt{}, false
+}
+
+// ForEach calls the given function for every receipt in the event. If the function returns false, iteration stops.
+// The iteration order is not defined.
+func (rec ReceiptEventContent) ForEach(fn func(evtID id.EventID, receiptType ReceiptType, userID id.UserID, receipt ReadReceipt) bool) {
+	for evtID, receipts := range rec {
+		for receiptType, userReceipts := range receipts {
+			for userID, receipt := range userReceipts {
+				if !fn(evtID, receiptType, userID, receipt) {
+					return
+				}
+			}
+		}
+	}
+}
+
 type ReceiptType string
 
 const (
@@ -128,6 +162,16 @@ const (
 	PresenceUnavailable Presence = "unavailable"
 )
 
+// IsValid checks if the presence is one of the values defined in the spec.
+func (p Presence) IsValid() bool {
+	switch p {
+	case PresenceOnline, PresenceOffline, PresenceUnavailable:
+		return true
+	default:
+		return false
+	}
+}
+
 // PresenceEventContent represents the content of a m.presence ephemeral event.
 // https://spec.matrix.org/v1.2/client-server-api/#mpresence
 type PresenceEventContent struct {
@@ -0,0 +1,88 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const receiptContent = `{
+	"$event1": {
+		"m.read": {
+			"@alice:example.com": {"ts": 1700000000000},
+			"@bob:example.com": {"ts": 1700000001000, "thread_id": "$thread"}
+		},
+		"m.read.private": {
+			"@alice:example.com": {"ts": 1700000002000},
+			"@carol:example.com": {"ts": 1700000003000, "thread_id": "main"}
+		}
+	},
+	"$event2": {
+		"m.read": {
+			"@dave:example.com": {"ts": 1700000004000}
+		}
+	}
+}`
+
+func TestReceiptEventContent_GetReceipt(t *testing.T) {
+	var content event.ReceiptEventContent
+	require.NoError(t, json.Unmarshal([]byte(receiptContent), &content))
+
+	receipt, ok := content.GetReceipt("$event1", "@alice:example.com")
+	require.True(t, ok)
+	assert.Equal(t, int64(1700000000000), receipt.Timestamp.UnixMilli())
+
+	receipt, ok = content.GetReceipt("$event1", "@bob:example.com")
+	require.True(t, ok)
+	assert.Equal(t, event.ThreadID("$thread"), receipt.ThreadID)
+
+	receipt, ok = content.GetReceipt("$event1", "@carol:example.com")
+	require.True(t, ok)
+	assert.Equal(t, event.ReadReceiptThreadMain, receipt.ThreadID)
+
+	_, ok = content.GetReceipt("$event2", "@alice:example.com")
+	assert.False(t, ok)
+	_, ok = content.GetReceipt("$event3", "@alice:example.com")
+	assert.False(t, ok)
+}
+
+func TestReceiptEventContent_ForEach(t *testing.T) {
+	var content event.ReceiptEventContent
+	require.NoError(t, json.Unmarshal([]byte(receiptContent), &content))
+
+	type receiptKey struct {
+		EventID     id.EventID
+		ReceiptType event.ReceiptType
+		UserID      id.UserID
+	}
+	seen := map[receiptKey]event.ThreadID{}
+	content.ForEach(func(evtID id.EventID, receiptType event.ReceiptType, userID id.UserID, receipt event.ReadReceipt) bool {
+		seen[receiptKey{evtID, receiptType, userID}] = receipt.ThreadID
+		return true
+	})
+	assert.Equal(t, map[receiptKey]event.ThreadID{
+		{"$event1", event.ReceiptTypeRead, "@alice:example.com"}:        "",
+		{"$event1", event.ReceiptTypeRead, "@bob:example.com"}:          "$thread",
+		{"$event1", event.ReceiptTypeReadPrivate, "@alice:example.com"}: "",
+		{"$event1", event.ReceiptTypeReadPrivate, "@carol:example.com"}: event.ReadReceiptThreadMain,
+		{"$event2", event.ReceiptTypeRead, "@dave:example.com"}:         "",
+	}, seen)
+
+	calls := 0
+	content.ForEach(func(id.EventID, event.ReceiptType, id.UserID, event.ReadReceipt) bool {
+		calls++
+		return false
+	})
+	assert.Equal(t, 1, calls)
+}
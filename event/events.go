@@ -116,6 +116,10 @@ type MautrixInfo struct {
 	DecryptionDuration time.Duration
 
 	CheckpointSent bool
+
+	// ContentParseError is set if parsing the event content into the typed struct failed.
+	// The content is still available as raw JSON in Content.VeryRaw and Content.Raw.
+	ContentParseError error
 }
 
 func (evt *Event) GetStateKey() string {
@@ -125,6 +129,26 @@ func (evt *Event) GetStateKey() string {
 	return ""
 }
 
+// IsRedaction returns true if the event is a m.room.redaction event.
+func (evt *Event) IsRedaction() bool {
+	return evt.Type == EventRedaction
+}
+
+// GetRedactedEventID returns the ID of the event that this redaction event redacts, or an empty string if this is
+// not a redaction event. The top-level redacts field is used if present, otherwise the field inside the content
+// (where it was moved to in room version 11) is checked.
+func (evt *Event) GetRedactedEventID() id.EventID {
+	if !evt.IsRedaction() {
+		return ""
+	} else if evt.Redacts != "" {
+		return evt.Redacts
+	} else if content, ok := evt.Content.Parsed.(*RedactionEventContent); ok && content.Redacts != "" {
+		return content.Redacts
+	}
+	redacts, _ := evt.Content.Raw["redacts"].(string)
+	return id.EventID(redacts)
+}
+
 type StrippedState struct {
 	Content  Content   `json:"content"`
 	Type     Type      `json:"type"`
@@ -0,0 +1,94 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func parseEvent(t *testing.T, data string) *event.Event {
+	var evt event.Event
+	require.NoError(t, json.Unmarshal([]byte(data), &evt))
+	_ = evt.Content.ParseRaw(evt.Type)
+	return &evt
+}
+
+func TestEvent_GetRedactedEventID(t *testing.T) {
+	evt := parseEvent(t, `{"type":"m.room.redaction","event_id":"$redaction","redacts":"$target","content":{"reason":"spam"}}`)
+	assert.True(t, evt.IsRedaction())
+	assert.Equal(t, id.EventID("$target"), evt.Redacts)
+	assert.Equal(t, id.EventID("$target"), evt.GetRedactedEventID())
+	assert.Equal(t, "spam", evt.Content.AsRedaction().Reason)
+
+	v11 := parseEvent(t, `{"type":"m.room.redaction","event_id":"$redaction","content":{"redacts":"$target"}}`)
+	assert.Equal(t, id.EventID("$target"), v11.GetRedactedEventID())
+
+	msg := parseEvent(t, `{"type":"m.room.message","event_id":"$msg","content":{"msgtype":"m.text","body":"hi","redacts":"$target"}}`)
+	assert.False(t, msg.IsRedaction())
+	assert.Equal(t, id.EventID(""), msg.GetRedactedEventID())
+}
+
+func TestEvent_Unsigned(t *testing.T) {
+	evt := parseEvent(t, `{
+		"type": "m.room.member",
+		"state_key": "@user:example.com",
+		"event_id": "$member",
+		"sender": "@user:example.com",
+		"content": {"membership": "join", "displayname": "New name"},
+		"unsigned": {
+			"age": 1234,
+			"transaction_id": "mautrix-go_1_1",
+			"prev_content": {"membership": "join", "displayname": "Old name"},
+			"prev_sender": "@user:example.com",
+			"replaces_state": "$old_member"
+		}
+	}`)
+	assert.Equal(t, int64(1234), evt.Unsigned.Age)
+	assert.Equal(t, "mautrix-go_1_1", evt.Unsigned.TransactionID)
+	assert.Equal(t, id.UserID("@user:example.com"), evt.Unsigned.PrevSender)
+	assert.Equal(t, id.EventID("$old_member"), evt.Unsigned.ReplacesState)
+	require.NotNil(t, evt.Unsigned.PrevContent)
+	require.NoError(t, evt.Unsigned.PrevContent.ParseRaw(evt.Type))
+	assert.Equal(t, "Old name", evt.Unsigned.PrevContent.AsMember().Displayname)
+	assert.Equal(t, "New name", evt.Content.AsMember().Displayname)
+	assert.False(t, evt.Unsigned.IsEmpty())
+}
+
+func TestEvent_Unsigned_TopLevelPrevContent(t *testing.T) {
+	evt := parseEvent(t, `{
+		"type": "m.room.topic",
+		"state_key": "",
+		"event_id": "$topic",
+		"content": {"topic": "new"},
+		"prev_content": {"topic": "old"},
+		"replaces_state": "$old_topic"
+	}`)
+	require.NotNil(t, evt.Unsigned.PrevContent)
+	require.NoError(t, evt.Unsigned.PrevContent.ParseRaw(evt.Type))
+	assert.Equal(t, "old", evt.Unsigned.PrevContent.AsTopic().Topic)
+	assert.Equal(t, id.EventID("$old_topic"), evt.Unsigned.ReplacesState)
+}
+
+func TestEvent_Unsigned_RedactedBecause(t *testing.T) {
+	evt := parseEvent(t, `{
+		"type": "m.room.message",
+		"event_id": "$message",
+		"content": {},
+		"unsigned": {"redacted_because": {"type": "m.room.redaction", "event_id": "$redaction", "redacts": "$message", "content": {"reason": "spam"}}}
+	}`)
+	require.NotNil(t, evt.Unsigned.RedactedBecause)
+	assert.Equal(t, id.EventID("$redaction"), evt.Unsigned.RedactedBecause.ID)
+	assert.Equal(t, id.EventID("$message"), evt.Unsigned.RedactedBecause.Redacts)
+	assert.Empty(t, evt.Unsigned.TransactionID)
+}
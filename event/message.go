@@ -32,11 +32,23 @@ const (
 	MsgAudio    MessageType = "m.audio"
 	MsgFile     MessageType = "m.file"
 
+	MsgServerNotice        MessageType = "m.server_notice"
 	MsgVerificationRequest MessageType = "m.key.verification.request"
 
 	MsgBeeperGallery MessageType = "com.beeper.gallery"
 )
 
+// IsMedia returns true if the message type is one of the media types (image, video, audio or file),
+// i.e. the message content is expected to have an url or file field.
+func (mt MessageType) IsMedia() bool {
+	switch mt {
+	case MsgImage, MsgVideo, MsgAudio, MsgFile:
+		return true
+	default:
+		return false
+	}
+}
+
 // Format specifies the format of the formatted_body in m.room.message events.
 // https://spec.matrix.org/v1.2/client-server-api/#mroommessage-msgtypes
 type Format string
@@ -48,12 +60,15 @@ const (
 
 // RedactionEventContent represents the content of a m.room.redaction message event.
 //
-// The redacted event ID is still at the top level, but will move in a future room version.
-// See https://github.com/matrix-org/matrix-doc/pull/2244 and https://github.com/matrix-org/matrix-doc/pull/2174
+// The redacted event ID is at the top level in room versions up to 10, and in the content in room version 11.
+// Event.GetRedactedEventID can be used to get it regardless of the room version.
 //
-// https://spec.matrix.org/v1.2/client-server-api/#mroomredaction
+// https://spec.matrix.org/v1.8/client-server-api/#mroomredaction
 type RedactionEventContent struct {
 	Reason string `json:"reason,omitempty"`
+
+	// The event ID that was redacted. Only present in room version 11 and later.
+	Redacts id.EventID `json:"redacts,omitempty"`
 }
 
 // ReactionEventContent represents the content of a m.reaction message event.
@@ -118,6 +133,27 @@ type MessageEventContent struct {
 	BeeperGalleryCaptionHTML string                 `json:"com.beeper.gallery.caption_html,omitempty"`
 }
 
+// TextMessage creates the content for a plain text m.text message.
+func TextMessage(body string) *MessageEventContent {
+	return &MessageEventContent{MsgType: MsgText, Body: body}
+}
+
+// EmoteMessage creates the content for a plain text m.emote message.
+func EmoteMessage(body string) *MessageEventContent {
+	return &MessageEventContent{MsgType: MsgEmote, Body: body}
+}
+
+// NoticeMessage creates the content for a plain text m.notice message.
+func NoticeMessage(body string) *MessageEventContent {
+	return &MessageEventContent{MsgType: MsgNotice, Body: body}
+}
+
+// ImageMessage creates the content for an unencrypted m.image message. The body is usually the file name of the image.
+// The info parameter may be nil, but clients will be able to render the image better if the size and dimensions are known.
+func ImageMessage(body string, url id.ContentURI, info *FileInfo) *MessageEventContent {
+	return &MessageEventContent{MsgType: MsgImage, Body: body, URL: url.CUString(), Info: info}
+}
+
 func (content *MessageEventContent) GetRelatesTo() *RelatesTo {
 	if content.RelatesTo == nil {
 		content.RelatesTo = &RelatesTo{}
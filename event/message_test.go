@@ -166,3 +166,39 @@ func TestMessageEventContent__Marshal_Custom(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expectedCustomMarshalResult, string(data))
 }
+
+func TestMessageType_IsMedia(t *testing.T) {
+	for msgType, isMedia := range map[event.MessageType]bool{
+		event.MsgText:                false,
+		event.MsgEmote:               false,
+		event.MsgNotice:              false,
+		event.MsgImage:               true,
+		event.MsgVideo:               true,
+		event.MsgAudio:               true,
+		event.MsgFile:                true,
+		event.MsgLocation:            false,
+		event.MsgServerNotice:        false,
+		event.MsgVerificationRequest: false,
+		"com.example.custom":         false,
+	} {
+		assert.Equal(t, isMedia, msgType.IsMedia(), msgType)
+	}
+}
+
+func TestMessageConstructors(t *testing.T) {
+	assert.Equal(t, &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"}, event.TextMessage("hello"))
+	assert.Equal(t, &event.MessageEventContent{MsgType: event.MsgEmote, Body: "waves"}, event.EmoteMessage("waves"))
+	assert.Equal(t, &event.MessageEventContent{MsgType: event.MsgNotice, Body: "beep"}, event.NoticeMessage("beep"))
+
+	info := &event.FileInfo{MimeType: "image/png", Width: 640, Height: 480, Size: 1234}
+	image := event.ImageMessage("cat.png", id.MustParseContentURI("mxc://example.com/cat"), info)
+	assert.Equal(t, &event.MessageEventContent{
+		MsgType: event.MsgImage,
+		Body:    "cat.png",
+		URL:     "mxc://example.com/cat",
+		Info:    info,
+	}, image)
+	data, err := json.Marshal(image)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"msgtype":"m.image","body":"cat.png","url":"mxc://example.com/cat","info":{"mimetype":"image/png","w":640,"h":480,"size":1234}}`, string(data))
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"encoding/json"
+)
+
+// redactionAllowedContentKeys contains the content keys that are preserved when redacting events of each type.
+// The map is keyed by the event type string, so that the event type class doesn't matter. A nil list means all keys
+// are preserved. Events of types not in this map have their entire content removed.
+//
+// This follows the redaction algorithm of room version 11, which preserves a superset of the keys preserved by
+// earlier room versions (except for the obsolete m.room.aliases event).
+// https://spec.matrix.org/v1.8/rooms/v11/#redactions
+var redactionAllowedContentKeys = map[string][]string{
+	StateMember.Type:            {"membership", "join_authorised_via_users_server", "third_party_invite"},
+	StateCreate.Type:            nil,
+	StateJoinRules.Type:         {"join_rule", "allow"},
+	StateHistoryVisibility.Type: {"history_visibility"},
+	StatePowerLevels.Type: {
+		"ban", "events", "events_default", "invite", "kick", "redact",
+		"state_default", "users", "users_default",
+	},
+	EventRedaction.Type: {"redacts"},
+}
+
+// RedactEventContent returns a copy of the given event with the content stripped according to the redaction algorithm.
+//
+// This can be used to update a locally cached event when a redaction for it is received, instead of refetching the
+// event from the server. The unsigned data of the event is cleared, so the caller should set Unsigned.RedactedBecause
+// to the redaction event if it's needed. The content of the returned event is not parsed, Content.ParseRaw can be
+// called to parse it if necessary. The original event is not modified.
+func RedactEventContent(evt *Event) *Event {
+	redacted := *evt
+	redacted.Unsigned = Unsigned{}
+	redacted.Content = Content{}
+
+	allowedKeys, ok := redactionAllowedContentKeys[evt.Type.Type]
+	var content map[string]interface{}
+	if ok {
+		if allowedKeys == nil {
+			content = copyContentMap(&evt.Content)
+		} else {
+			original := copyContentMap(&evt.Content)
+			content = make(map[string]interface{}, len(allowedKeys))
+			for _, key := range allowedKeys {
+				if value, exists := original[key]; exists {
+					content[key] = value
+				}
+			}
+			if invite, isMap := content["third_party_invite"].(map[string]interface{}); isMap {
+				// Only the signed key of third party invites is preserved
+				content["third_party_invite"] = map[string]interface{}{"signed": invite["signed"]}
+			}
+		}
+	}
+	if content == nil {
+		content = make(map[string]interface{})
+	}
+	redacted.Content.VeryRaw, _ = json.Marshal(content)
+	redacted.Content.Raw = content
+	return &redacted
+}
+
+// copyContentMap returns the content as a newly decoded map, so that modifying it doesn't affect the original content.
+func copyContentMap(content *Content) map[string]interface{} {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil
+	}
+	var output map[string]interface{}
+	_ = json.Unmarshal(data, &output)
+	return output
+}
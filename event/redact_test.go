@@ -0,0 +1,63 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func redactedContentJSON(t *testing.T, data string) string {
+	evt := parseEvent(t, data)
+	redacted := event.RedactEventContent(evt)
+	content, err := json.Marshal(&redacted.Content)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestRedactEventContent(t *testing.T) {
+	evt := parseEvent(t, `{
+		"type": "m.room.message",
+		"event_id": "$msg",
+		"room_id": "!room:example.com",
+		"sender": "@user:example.com",
+		"origin_server_ts": 1234,
+		"content": {"msgtype": "m.text", "body": "secret"},
+		"unsigned": {"transaction_id": "foo"}
+	}`)
+	redacted := event.RedactEventContent(evt)
+	assert.Equal(t, id.EventID("$msg"), redacted.ID)
+	assert.Equal(t, id.RoomID("!room:example.com"), redacted.RoomID)
+	assert.Equal(t, id.UserID("@user:example.com"), redacted.Sender)
+	assert.Equal(t, int64(1234), redacted.Timestamp)
+	assert.Empty(t, redacted.Unsigned.TransactionID)
+	assert.Empty(t, redacted.Content.Raw)
+	// The original event must not be modified
+	assert.Equal(t, "secret", evt.Content.AsMessage().Body)
+	assert.Equal(t, "foo", evt.Unsigned.TransactionID)
+}
+
+func TestRedactEventContent_StateEvents(t *testing.T) {
+	assert.JSONEq(t, `{"membership":"join"}`, redactedContentJSON(t,
+		`{"type":"m.room.member","state_key":"@user:example.com","content":{"membership":"join","displayname":"User","avatar_url":"mxc://example.com/abc"}}`))
+	assert.JSONEq(t, `{"membership":"invite","third_party_invite":{"signed":{"token":"abc"}}}`, redactedContentJSON(t,
+		`{"type":"m.room.member","state_key":"@user:example.com","content":{"membership":"invite","third_party_invite":{"display_name":"User","signed":{"token":"abc"}}}}`))
+	assert.JSONEq(t, `{"users":{"@user:example.com":100},"users_default":0,"events_default":0,"invite":50}`, redactedContentJSON(t,
+		`{"type":"m.room.power_levels","state_key":"","content":{"users":{"@user:example.com":100},"users_default":0,"events_default":0,"invite":50,"notifications":{"room":50}}}`))
+	assert.JSONEq(t, `{"join_rule":"public"}`, redactedContentJSON(t,
+		`{"type":"m.room.join_rules","state_key":"","content":{"join_rule":"public","custom":true}}`))
+	assert.JSONEq(t, `{"creator":"@user:example.com","room_version":"10"}`, redactedContentJSON(t,
+		`{"type":"m.room.create","state_key":"","content":{"creator":"@user:example.com","room_version":"10"}}`))
+	assert.JSONEq(t, `{}`, redactedContentJSON(t,
+		`{"type":"m.room.topic","state_key":"","content":{"topic":"Hello"}}`))
+}
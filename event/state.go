@@ -76,8 +76,25 @@ const (
 	JoinRuleInvite     JoinRule = "invite"
 	JoinRuleRestricted JoinRule = "restricted"
 	JoinRulePrivate    JoinRule = "private"
+
+	JoinRuleKnockRestricted JoinRule = "knock_restricted"
 )
 
+// IsValid checks if the join rule is one of the values defined in the spec.
+func (jr JoinRule) IsValid() bool {
+	switch jr {
+	case JoinRulePublic, JoinRuleKnock, JoinRuleInvite, JoinRuleRestricted, JoinRulePrivate, JoinRuleKnockRestricted:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsRestricted checks if the join rule allows joining based on the allow conditions in JoinRulesEventContent.
+func (jr JoinRule) IsRestricted() bool {
+	return jr == JoinRuleRestricted || jr == JoinRuleKnockRestricted
+}
+
 // JoinRulesEventContent represents the content of a m.room.join_rules state event.
 // https://spec.matrix.org/v1.2/client-server-api/#mroomjoin_rules
 type JoinRulesEventContent struct {
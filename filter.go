@@ -48,8 +48,9 @@ type FilterPart struct {
 	Types       []event.Type `json:"types,omitempty"`
 	ContainsURL *bool        `json:"contains_url,omitempty"`
 
-	LazyLoadMembers         bool `json:"lazy_load_members,omitempty"`
-	IncludeRedundantMembers bool `json:"include_redundant_members,omitempty"`
+	LazyLoadMembers           bool `json:"lazy_load_members,omitempty"`
+	IncludeRedundantMembers   bool `json:"include_redundant_members,omitempty"`
+	UnreadThreadNotifications bool `json:"unread_thread_notifications,omitempty"`
 }
 
 // Validate checks if the filter contains valid property values
@@ -0,0 +1,61 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestFilter_MarshalJSON(t *testing.T) {
+	filter := mautrix.Filter{
+		EventFields: []string{"type", "content"},
+		EventFormat: mautrix.EventFormatClient,
+		Presence:    mautrix.FilterPart{NotTypes: []event.Type{event.EphemeralEventPresence}},
+		Room: mautrix.RoomFilter{
+			Rooms: []id.RoomID{"!room:example.com"},
+			State: mautrix.FilterPart{LazyLoadMembers: true},
+			Timeline: mautrix.FilterPart{
+				Limit:                     10,
+				Senders:                   []id.UserID{"@user:example.com"},
+				Types:                     []event.Type{event.EventMessage},
+				UnreadThreadNotifications: true,
+			},
+		},
+	}
+	data, err := json.Marshal(&filter)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"account_data": {},
+		"event_fields": ["type", "content"],
+		"event_format": "client",
+		"presence": {"not_types": ["m.presence"]},
+		"room": {
+			"account_data": {},
+			"ephemeral": {},
+			"rooms": ["!room:example.com"],
+			"state": {"lazy_load_members": true},
+			"timeline": {
+				"limit": 10,
+				"senders": ["@user:example.com"],
+				"types": ["m.room.message"],
+				"unread_thread_notifications": true
+			}
+		}
+	}`, string(data))
+
+	var parsed mautrix.Filter
+	require.NoError(t, json.Unmarshal(data, &parsed))
+	assert.Equal(t, filter, parsed)
+}
@@ -50,12 +50,15 @@ func MustParseContentURI(uri string) ContentURI {
 }
 
 // ParseContentURI parses a Matrix content URI.
+//
+// An empty string is parsed into an empty ContentURI without an error. Non-empty strings must be in the
+// mxc://<server name>/<media ID> format, where neither part is empty and the media ID doesn't contain slashes.
 func ParseContentURI(uri string) (parsed ContentURI, err error) {
 	if len(uri) == 0 {
 		return
 	} else if !strings.HasPrefix(uri, "mxc://") {
 		err = InvalidContentURI
-	} else if index := strings.IndexRune(uri[6:], '/'); index == -1 || index == len(uri)-7 {
+	} else if index := strings.IndexRune(uri[6:], '/'); index <= 0 || index == len(uri)-7 || strings.ContainsRune(uri[6+index+1:], '/') {
 		err = InvalidContentURI
 	} else {
 		parsed.Homeserver = uri[6 : 6+index]
@@ -71,7 +74,7 @@ func ParseContentURIBytes(uri []byte) (parsed ContentURI, err error) {
 		return
 	} else if !bytes.HasPrefix(uri, mxcBytes) {
 		err = InvalidContentURI
-	} else if index := bytes.IndexRune(uri[6:], '/'); index == -1 || index == len(uri)-7 {
+	} else if index := bytes.IndexRune(uri[6:], '/'); index <= 0 || index == len(uri)-7 || bytes.ContainsRune(uri[6+index+1:], '/') {
 		err = InvalidContentURI
 	} else {
 		parsed.Homeserver = string(uri[6 : 6+index])
@@ -0,0 +1,53 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestParseContentURI(t *testing.T) {
+	const input = "mxc://maunium.net/hello123"
+	parsed, err := id.ParseContentURI(input)
+	require.NoError(t, err)
+	assert.Equal(t, "maunium.net", parsed.Homeserver)
+	assert.Equal(t, "hello123", parsed.FileID)
+	assert.False(t, parsed.IsEmpty())
+	assert.Equal(t, input, parsed.String())
+
+	parsedBytes, err := id.ParseContentURIBytes([]byte(input))
+	require.NoError(t, err)
+	assert.Equal(t, parsed, parsedBytes)
+}
+
+func TestParseContentURI_Empty(t *testing.T) {
+	parsed, err := id.ParseContentURI("")
+	assert.NoError(t, err)
+	assert.True(t, parsed.IsEmpty())
+	assert.Equal(t, "", parsed.String())
+}
+
+func TestParseContentURI_Invalid(t *testing.T) {
+	for _, input := range []string{
+		"https://maunium.net/hello123",
+		"mxc://maunium.net",
+		"mxc://maunium.net/",
+		"mxc:///hello123",
+		"mxc://maunium.net/hello/123",
+		"mxc://maunium.net//hello123",
+	} {
+		_, err := id.ParseContentURI(input)
+		assert.ErrorIs(t, err, id.InvalidContentURI, input)
+		_, err = id.ParseContentURIBytes([]byte(input))
+		assert.ErrorIs(t, err, id.InvalidContentURI, input)
+	}
+}
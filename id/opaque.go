@@ -8,6 +8,7 @@ package id
 
 import (
 	"fmt"
+	"strings"
 )
 
 // A RoomID is a string starting with ! that references a specific room.
@@ -32,6 +33,34 @@ type EventID string
 // https://github.com/matrix-org/matrix-doc/pull/2716
 type BatchID string
 
+// IdentifierMaxLength is the maximum length of room IDs, room aliases and event IDs.
+const IdentifierMaxLength = 255
+
+// hasSigilAndServer checks if the identifier starts with the given sigil and has a non-empty opaque part and server name.
+func hasSigilAndServer(identifier string, sigil byte) bool {
+	if len(identifier) == 0 || len(identifier) > IdentifierMaxLength || identifier[0] != sigil {
+		return false
+	}
+	colonIndex := strings.IndexByte(identifier, ':')
+	return colonIndex > 1 && colonIndex < len(identifier)-1
+}
+
+// IsValid checks if the room ID starts with ! and has a server name.
+func (roomID RoomID) IsValid() bool {
+	return hasSigilAndServer(string(roomID), '!')
+}
+
+// IsValid checks if the room alias starts with # and has a server name.
+func (roomAlias RoomAlias) IsValid() bool {
+	return hasSigilAndServer(string(roomAlias), '#')
+}
+
+// IsValid checks if the event ID starts with $ and isn't empty. Event IDs in room versions 3 and later are hashes
+// without a server name, so the rest of the event ID is not validated.
+func (eventID EventID) IsValid() bool {
+	return len(eventID) > 1 && len(eventID) <= IdentifierMaxLength && eventID[0] == '$'
+}
+
 func (roomID RoomID) String() string {
 	return string(roomID)
 }
@@ -0,0 +1,40 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRoomID_IsValid(t *testing.T) {
+	assert.True(t, id.RoomID("!room:example.com").IsValid())
+	assert.False(t, id.RoomID("!room").IsValid())
+	assert.False(t, id.RoomID("!:example.com").IsValid())
+	assert.False(t, id.RoomID("!room:").IsValid())
+	assert.False(t, id.RoomID("#room:example.com").IsValid())
+	assert.False(t, id.RoomID("!"+strings.Repeat("a", 255)+":example.com").IsValid())
+	assert.False(t, id.RoomID("").IsValid())
+}
+
+func TestRoomAlias_IsValid(t *testing.T) {
+	assert.True(t, id.RoomAlias("#room:example.com").IsValid())
+	assert.False(t, id.RoomAlias("!room:example.com").IsValid())
+	assert.False(t, id.RoomAlias("#room").IsValid())
+}
+
+func TestEventID_IsValid(t *testing.T) {
+	assert.True(t, id.EventID("$Rqnc-F-dvnEYJTyHq_iKxU2bZ1CI92-kuZq3a5lr5Zg").IsValid())
+	assert.True(t, id.EventID("$143273582443PhrSn:example.org").IsValid())
+	assert.False(t, id.EventID("$").IsValid())
+	assert.False(t, id.EventID("!room:example.com").IsValid())
+	assert.False(t, id.EventID("").IsValid())
+}
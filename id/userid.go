@@ -98,6 +98,16 @@ func (userID UserID) ParseAndValidate() (localpart, homeserver string, err error
 	return
 }
 
+// IsValid checks if the user ID is valid according to the user identifier grammar, i.e. it has a server name,
+// the localpart only contains allowed characters, and the total length is at most 255 characters.
+//
+// Note that some historical user IDs don't follow the grammar, so this shouldn't be used to reject user IDs from the
+// server. It's meant for validating user IDs before creating them, e.g. for appservice ghosts.
+func (userID UserID) IsValid() bool {
+	_, homeserver, err := userID.ParseAndValidate()
+	return err == nil && len(homeserver) > 0
+}
+
 func (userID UserID) ParseAndDecode() (localpart, homeserver string, err error) {
 	localpart, homeserver, err = userID.ParseAndValidate()
 	if err == nil {
@@ -84,3 +84,12 @@ func TestUserID_URI(t *testing.T) {
 	userID := id.NewUserID("hello", "example.com")
 	assert.Equal(t, userID.URI().String(), "matrix:u/hello:example.com")
 }
+
+func TestUserID_IsValid(t *testing.T) {
+	assert.True(t, id.UserID("@user:example.com").IsValid())
+	assert.True(t, id.NewEncodedUserID("Remote User!", "example.com").IsValid())
+	assert.False(t, id.UserID("@Remote User!:example.com").IsValid())
+	assert.False(t, id.UserID("@user:").IsValid())
+	assert.False(t, id.UserID("user:example.com").IsValid())
+	assert.False(t, id.UserID("@:example.com").IsValid())
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package parallel contains helpers for running requests in parallel.
+package parallel
+
+import (
+	"errors"
+	"sync"
+)
+
+// DefaultLimit is the number of calls that Run makes in parallel if no limit is given.
+const DefaultLimit = 8
+
+// Run calls fn for every item in the map, with at most limit calls running at the same time.
+// If limit is less than 1, DefaultLimit is used.
+//
+// All items are processed even if some fail, and the errors are returned combined with errors.Join.
+func Run[K comparable, V any](items map[K]V, limit int, fn func(K, V) error) error {
+	if limit < 1 {
+		limit = DefaultLimit
+	}
+	var wg sync.WaitGroup
+	var errsLock sync.Mutex
+	var errs []error
+	sem := make(chan struct{}, limit)
+	for key, value := range items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key K, value V) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(key, value); err != nil {
+				errsLock.Lock()
+				errs = append(errs, err)
+				errsLock.Unlock()
+			}
+		}(key, value)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package parallel_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/internal/parallel"
+)
+
+func TestRun(t *testing.T) {
+	items := make(map[int]string)
+	for i := 0; i < 20; i++ {
+		items[i] = fmt.Sprintf("item%d", i)
+	}
+	errOdd := errors.New("odd item")
+	var running, maxRunning atomic.Int32
+	var lock sync.Mutex
+	seen := make(map[int]string)
+	err := parallel.Run(items, 3, func(key int, value string) error {
+		current := running.Add(1)
+		defer running.Add(-1)
+		for {
+			prev := maxRunning.Load()
+			if current <= prev || maxRunning.CompareAndSwap(prev, current) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		lock.Lock()
+		seen[key] = value
+		lock.Unlock()
+		if key%2 == 1 {
+			return fmt.Errorf("%s: %w", value, errOdd)
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, errOdd)
+	assert.Contains(t, err.Error(), "item19")
+	assert.Equal(t, items, seen)
+	assert.LessOrEqual(t, maxRunning.Load(), int32(3))
+
+	assert.NoError(t, parallel.Run(map[int]string{}, 0, func(int, string) error {
+		return errOdd
+	}))
+}
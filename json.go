@@ -0,0 +1,21 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"encoding/json"
+)
+
+// Marshal and Unmarshal are used for encoding request bodies and decoding response bodies in Client.MakeFullRequest,
+// as well as for appservice transactions and responses. They default to encoding/json, but can be replaced with a
+// compatible implementation (e.g. github.com/goccy/go-json) for better performance.
+//
+// Streamed responses (ReqSync.StreamResponse and DecodeSyncStream) always use encoding/json.
+var (
+	Marshal   func(v any) ([]byte, error)    = json.Marshal
+	Unmarshal func(data []byte, v any) error = json.Unmarshal
+)
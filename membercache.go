@@ -0,0 +1,161 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"sync"
+
+	"golang.org/x/exp/maps"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MemberCache is an in-memory cache of the current members of rooms, i.e. users whose membership is join, invite
+// or knock. It's kept up to date from the m.room.member events in /sync responses.
+//
+// When lazy loading members, sync responses only contain the member events relevant to the timeline, so the member
+// list built from sync alone may be incomplete. A room is only marked as complete after its full member list has
+// been fetched with Client.Members, and it's marked incomplete again when a limited timeline means that membership
+// changes may have been skipped.
+type MemberCache struct {
+	lock  sync.RWMutex
+	rooms map[id.RoomID]*cachedRoomMembers
+}
+
+type cachedRoomMembers struct {
+	members  map[id.UserID]*event.MemberEventContent
+	complete bool
+}
+
+// NewMemberCache creates an empty MemberCache.
+func NewMemberCache() *MemberCache {
+	return &MemberCache{
+		rooms: make(map[id.RoomID]*cachedRoomMembers),
+	}
+}
+
+// Get returns a copy of the cached members of the given room, and whether the list is known to be complete.
+// If the room isn't cached at all, the map is nil.
+func (mc *MemberCache) Get(roomID id.RoomID) (map[id.UserID]*event.MemberEventContent, bool) {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+	room, ok := mc.rooms[roomID]
+	if !ok {
+		return nil, false
+	}
+	return maps.Clone(room.members), room.complete
+}
+
+func (mc *MemberCache) getRoom(roomID id.RoomID) *cachedRoomMembers {
+	room, ok := mc.rooms[roomID]
+	if !ok {
+		room = &cachedRoomMembers{members: make(map[id.UserID]*event.MemberEventContent)}
+		mc.rooms[roomID] = room
+	}
+	return room
+}
+
+// Set updates the cached membership of a single user. Users who left or were banned are removed from the cache.
+func (mc *MemberCache) Set(roomID id.RoomID, userID id.UserID, member *event.MemberEventContent) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	switch member.Membership {
+	case event.MembershipJoin, event.MembershipInvite, event.MembershipKnock:
+		mc.getRoom(roomID).members[userID] = member
+	default:
+		if room, ok := mc.rooms[roomID]; ok {
+			delete(room.members, userID)
+		}
+	}
+}
+
+// Replace replaces the cached members of the given room with the given member events.
+func (mc *MemberCache) Replace(roomID id.RoomID, members []*event.Event, complete bool) {
+	room := &cachedRoomMembers{
+		members:  make(map[id.UserID]*event.MemberEventContent, len(members)),
+		complete: complete,
+	}
+	for _, evt := range members {
+		content, ok := evt.Content.Parsed.(*event.MemberEventContent)
+		if !ok || evt.StateKey == nil {
+			continue
+		}
+		switch content.Membership {
+		case event.MembershipJoin, event.MembershipInvite, event.MembershipKnock:
+			room.members[id.UserID(*evt.StateKey)] = content
+		}
+	}
+	mc.lock.Lock()
+	mc.rooms[roomID] = room
+	mc.lock.Unlock()
+}
+
+// MarkIncomplete marks the cached member list of the given room as possibly incomplete.
+func (mc *MemberCache) MarkIncomplete(roomID id.RoomID) {
+	mc.lock.Lock()
+	if room, ok := mc.rooms[roomID]; ok {
+		room.complete = false
+	}
+	mc.lock.Unlock()
+}
+
+// Invalidate removes the given room from the cache entirely.
+func (mc *MemberCache) Invalidate(roomID id.RoomID) {
+	mc.lock.Lock()
+	delete(mc.rooms, roomID)
+	mc.lock.Unlock()
+}
+
+// EnableMemberCache sets MemberCache to a new empty cache and registers the sync handlers that keep it up to date.
+// If a custom Syncer is used, MemberCacheSyncHandler and MemberCacheGappySyncHandler must be registered manually.
+func (cli *Client) EnableMemberCache() {
+	cli.MemberCache = NewMemberCache()
+	if syncer, ok := cli.Syncer.(ExtensibleSyncer); ok {
+		syncer.OnEvent(cli.MemberCacheSyncHandler)
+	}
+	if syncer, ok := cli.Syncer.(*DefaultSyncer); ok {
+		syncer.OnGappySync(cli.MemberCacheGappySyncHandler)
+	}
+}
+
+// MemberCacheSyncHandler updates MemberCache with the member events in sync responses.
+//
+// DefaultSyncer.ParseEventContent must also be true for this to work (which it is by default).
+func (cli *Client) MemberCacheSyncHandler(source EventSource, evt *event.Event) {
+	if cli.MemberCache == nil || evt.Type != event.StateMember || evt.StateKey == nil {
+		return
+	}
+	content, ok := evt.Content.Parsed.(*event.MemberEventContent)
+	if !ok {
+		return
+	}
+	if source&EventSourceLeave != 0 && id.UserID(*evt.StateKey) == cli.UserID {
+		// We're no longer in the room, so there won't be any further updates to the member list
+		cli.MemberCache.Invalidate(evt.RoomID)
+		return
+	}
+	cli.MemberCache.Set(evt.RoomID, id.UserID(*evt.StateKey), content)
+}
+
+// MemberCacheGappySyncHandler marks the member list of rooms with a limited timeline as incomplete,
+// as the membership changes in the gap may not be included in the sync response when lazy loading members.
+func (cli *Client) MemberCacheGappySyncHandler(roomID id.RoomID, _ *SyncTimeline) {
+	if cli.MemberCache != nil {
+		cli.MemberCache.MarkIncomplete(roomID)
+	}
+}
+
+// GetCachedMembers returns the members of the given room from MemberCache, and whether the member list is known
+// to be complete. If the list isn't complete, Members can be used to fetch the full list, which will also
+// update the cache.
+func (cli *Client) GetCachedMembers(roomID id.RoomID) (map[id.UserID]*event.MemberEventContent, bool) {
+	if cli.MemberCache == nil {
+		return nil, false
+	}
+	return cli.MemberCache.Get(roomID)
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func processTestSync(t *testing.T, cli *mautrix.Client, data, since string) {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(data), &resp))
+	require.NoError(t, cli.Syncer.ProcessResponse(&resp, since))
+}
+
+func TestClient_MemberCache(t *testing.T) {
+	cli, err := mautrix.NewClient("https://example.com", "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.EnableMemberCache()
+
+	processTestSync(t, cli, `{"next_batch":"s1","rooms":{"join":{"!room:example.com":{"timeline":{"events":[
+		{"type":"m.room.member","state_key":"@alice:example.com","event_id":"$1","sender":"@alice:example.com","content":{"membership":"join","displayname":"Alice"}},
+		{"type":"m.room.member","state_key":"@bob:example.com","event_id":"$2","sender":"@bob:example.com","content":{"membership":"join"}}
+	]}}}}}`, "")
+	members, complete := cli.GetCachedMembers("!room:example.com")
+	assert.False(t, complete)
+	require.Len(t, members, 2)
+	assert.Equal(t, "Alice", members["@alice:example.com"].Displayname)
+	assert.Equal(t, event.MembershipJoin, members["@bob:example.com"].Membership)
+
+	processTestSync(t, cli, `{"next_batch":"s2","rooms":{"join":{"!room:example.com":{"timeline":{"events":[
+		{"type":"m.room.member","state_key":"@bob:example.com","event_id":"$3","sender":"@bob:example.com","content":{"membership":"leave"}}
+	]}}}}}`, "s1")
+	members, _ = cli.GetCachedMembers("!room:example.com")
+	assert.Len(t, members, 1)
+	assert.NotContains(t, members, id.UserID("@bob:example.com"))
+
+	processTestSync(t, cli, `{"next_batch":"s3","rooms":{"leave":{"!room:example.com":{"timeline":{"events":[
+		{"type":"m.room.member","state_key":"@user:example.com","event_id":"$4","sender":"@alice:example.com","content":{"membership":"ban"}}
+	]}}}}}`, "s2")
+	members, _ = cli.GetCachedMembers("!room:example.com")
+	assert.Nil(t, members)
+}
+
+func TestClient_MemberCache_Completeness(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/members", r.URL.Path)
+		_, _ = w.Write([]byte(`{"chunk":[
+			{"type":"m.room.member","room_id":"!room:example.com","state_key":"@alice:example.com","event_id":"$1","sender":"@alice:example.com","content":{"membership":"join"}},
+			{"type":"m.room.member","room_id":"!room:example.com","state_key":"@carol:example.com","event_id":"$2","sender":"@alice:example.com","content":{"membership":"invite"}},
+			{"type":"m.room.member","room_id":"!room:example.com","state_key":"@dave:example.com","event_id":"$3","sender":"@dave:example.com","content":{"membership":"leave"}}
+		]}`))
+	}))
+	defer ts.Close()
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.EnableMemberCache()
+
+	_, err = cli.Members("!room:example.com")
+	require.NoError(t, err)
+	members, complete := cli.GetCachedMembers("!room:example.com")
+	assert.True(t, complete)
+	assert.Len(t, members, 2)
+	assert.Equal(t, event.MembershipInvite, members["@carol:example.com"].Membership)
+
+	processTestSync(t, cli, `{"next_batch":"s2","rooms":{"join":{"!room:example.com":{"timeline":{"limited":true,"prev_batch":"p1","events":[
+		{"type":"m.room.member","state_key":"@carol:example.com","event_id":"$4","sender":"@carol:example.com","content":{"membership":"join"}}
+	]}}}}}`, "s1")
+	members, complete = cli.GetCachedMembers("!room:example.com")
+	assert.False(t, complete)
+	assert.Equal(t, event.MembershipJoin, members["@carol:example.com"].Membership)
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"sync"
+	"time"
+)
+
+// presenceLimiter rate limits presence and typing updates with a token bucket per key. Each bucket holds a single
+// token, which is refilled once the interval has passed since the last update. Updates made while the bucket is
+// empty are dropped, regardless of their value.
+type presenceLimiter struct {
+	lock      sync.Mutex
+	last      map[string]time.Time
+	lastSweep time.Time
+}
+
+// allow checks if an update with the given key may be sent now. If it may, the token of the key is taken,
+// so further updates are dropped until interval has passed.
+func (pl *presenceLimiter) allow(key string, interval time.Duration) bool {
+	if interval <= 0 {
+		return true
+	}
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	now := time.Now()
+	if last, ok := pl.last[key]; ok && now.Sub(last) < interval {
+		return false
+	}
+	if pl.last == nil {
+		pl.last = make(map[string]time.Time)
+	} else if now.Sub(pl.lastSweep) >= interval {
+		// Remove expired entries so that keys which aren't used anymore (e.g. typing in old rooms) don't pile up
+		for existingKey, last := range pl.last {
+			if now.Sub(last) >= interval {
+				delete(pl.last, existingKey)
+			}
+		}
+		pl.lastSweep = now
+	}
+	pl.last[key] = now
+	return true
+}
+
+// forget refills the token of the given key, so that the next update is sent immediately.
+// This is used if sending an update fails.
+func (pl *presenceLimiter) forget(key string) {
+	pl.lock.Lock()
+	delete(pl.last, key)
+	pl.lock.Unlock()
+}
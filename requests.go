@@ -120,6 +120,56 @@ type ReqCreateRoom struct {
 	BeeperAutoJoinInvites bool      `json:"com.beeper.auto_join_invites,omitempty"`
 }
 
+// ReqReport is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3roomsroomidreporteventid
+type ReqReport struct {
+	Reason string `json:"reason,omitempty"`
+	Score  int    `json:"score"`
+}
+
+// ReqReportRoom is the JSON request for https://github.com/matrix-org/matrix-spec-proposals/pull/4151
+type ReqReportRoom struct {
+	Reason string `json:"reason"`
+}
+
+// ReqGetRelations contains the query parameters for https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv1roomsroomidrelationseventid
+type ReqGetRelations struct {
+	// Only return relations of this type. Required if EventType is set.
+	RelationType event.RelationType
+	// Only return related events of this type.
+	EventType event.Type
+
+	Dir   Direction
+	From  string
+	To    string
+	Limit int
+}
+
+func (rgr *ReqGetRelations) PathSuffix() []any {
+	if rgr.RelationType == "" {
+		return nil
+	} else if rgr.EventType.Type == "" {
+		return []any{rgr.RelationType}
+	}
+	return []any{rgr.RelationType, rgr.EventType.Type}
+}
+
+func (rgr *ReqGetRelations) Query() map[string]string {
+	query := map[string]string{}
+	if rgr.Dir != 0 {
+		query["dir"] = string(rgr.Dir)
+	}
+	if rgr.From != "" {
+		query["from"] = rgr.From
+	}
+	if rgr.To != "" {
+		query["to"] = rgr.To
+	}
+	if rgr.Limit > 0 {
+		query["limit"] = strconv.Itoa(rgr.Limit)
+	}
+	return query
+}
+
 // ReqRedact is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3roomsroomidredacteventidtxnid
 type ReqRedact struct {
 	Reason string
@@ -183,6 +233,11 @@ type ReqAliasCreate struct {
 	RoomID id.RoomID `json:"room_id"`
 }
 
+// ReqRoomDirectoryVisibility is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3directorylistroomroomid
+type ReqRoomDirectoryVisibility struct {
+	Visibility string `json:"visibility"`
+}
+
 type OneTimeKey struct {
 	Key        id.Curve25519  `json:"key"`
 	Fallback   bool           `json:"fallback,omitempty"`
@@ -324,6 +379,54 @@ type ReqDeleteDevices struct {
 	Auth    interface{}   `json:"auth,omitempty"`
 }
 
+// ReqDeactivate is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3accountdeactivate
+type ReqDeactivate struct {
+	Auth     interface{} `json:"auth,omitempty"`
+	IDServer string      `json:"id_server,omitempty"`
+}
+
+// ReqChangePassword is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3accountpassword
+type ReqChangePassword struct {
+	NewPassword string `json:"new_password"`
+	// Whether other devices should be logged out. Unlike in the spec, this defaults to false.
+	LogoutDevices bool        `json:"logout_devices"`
+	Auth          interface{} `json:"auth,omitempty"`
+}
+
+type PusherKind string
+
+const (
+	PusherKindHTTP  PusherKind = "http"
+	PusherKindEmail PusherKind = "email"
+)
+
+type PusherData struct {
+	// The URL of the push gateway. Required for HTTP pushers.
+	URL string `json:"url,omitempty"`
+	// The format of the push notifications. Currently, the only format in the spec is "event_id_only".
+	Format string `json:"format,omitempty"`
+}
+
+// Pusher represents a single pusher in https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3pushers
+type Pusher struct {
+	AppDisplayName    string      `json:"app_display_name,omitempty"`
+	AppID             string      `json:"app_id"`
+	Data              *PusherData `json:"data,omitempty"`
+	DeviceDisplayName string      `json:"device_display_name,omitempty"`
+	// The kind of the pusher. When setting a pusher, nil means the pusher should be deleted.
+	Kind       *PusherKind `json:"kind"`
+	Language   string      `json:"lang,omitempty"`
+	ProfileTag string      `json:"profile_tag,omitempty"`
+	PushKey    string      `json:"pushkey"`
+}
+
+// ReqSetPusher is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3pushersset
+type ReqSetPusher struct {
+	Pusher
+	// If true, other pushers with the same push key for other users are kept.
+	Append bool `json:"append,omitempty"`
+}
+
 type ReqPutPushRule struct {
 	Before string `json:"-"`
 	After  string `json:"-"`
@@ -341,6 +444,9 @@ type ReqBatchSend struct {
 	BeeperNewMessages bool      `json:"-"`
 	BeeperMarkReadBy  id.UserID `json:"-"`
 
+	// The unstable prefix to use in the endpoint path. Defaults to org.matrix.msc2716.
+	UnstablePrefix string `json:"-"`
+
 	StateEventsAtStart []*event.Event `json:"state_events_at_start"`
 	Events             []*event.Event `json:"events"`
 }
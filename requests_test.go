@@ -0,0 +1,58 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestReqCreateRoom_MarshalJSON(t *testing.T) {
+	emptyStateKey := ""
+	req := &mautrix.ReqCreateRoom{
+		Preset:          "private_chat",
+		IsDirect:        true,
+		Invite:          []id.UserID{"@user:example.com"},
+		CreationContent: map[string]interface{}{"m.federate": false},
+		InitialState: []*event.Event{{
+			Type:     event.StateEncryption,
+			StateKey: &emptyStateKey,
+			Content:  event.Content{Parsed: &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}},
+		}, {
+			Type:     event.StateHistoryVisibility,
+			StateKey: &emptyStateKey,
+			Content:  event.Content{Parsed: &event.HistoryVisibilityEventContent{HistoryVisibility: event.HistoryVisibilityJoined}},
+		}},
+		PowerLevelOverride: &event.PowerLevelsEventContent{
+			Users:         map[id.UserID]int{"@bot:example.com": 100},
+			EventsDefault: 50,
+		},
+	}
+	data, err := json.Marshal(req)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"preset": "private_chat",
+		"is_direct": true,
+		"invite": ["@user:example.com"],
+		"creation_content": {"m.federate": false},
+		"initial_state": [
+			{"type": "m.room.encryption", "state_key": "", "content": {"algorithm": "m.megolm.v1.aes-sha2"}},
+			{"type": "m.room.history_visibility", "state_key": "", "content": {"history_visibility": "joined"}}
+		],
+		"power_level_content_override": {
+			"users": {"@bot:example.com": 100},
+			"events_default": 50
+		}
+	}`, string(data))
+}
@@ -14,6 +14,7 @@ import (
 
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
 )
 
 // RespWhoami is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3accountwhoami
@@ -84,6 +85,13 @@ type RespMessages struct {
 	End   string         `json:"end,omitempty"`
 }
 
+// RespGetRelations is the JSON response for https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv1roomsroomidrelationseventid
+type RespGetRelations struct {
+	Chunk     []*event.Event `json:"chunk"`
+	NextBatch string         `json:"next_batch,omitempty"`
+	PrevBatch string         `json:"prev_batch,omitempty"`
+}
+
 // RespContext is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3roomsroomidcontexteventid
 type RespContext struct {
 	End          string         `json:"end"`
@@ -209,6 +217,25 @@ func (rlf *RespLoginFlows) HasFlow(flowType ...AuthType) bool {
 	return rlf.FirstFlowOfType(flowType...) != nil
 }
 
+// RespAuthMetadata is the JSON response for the OAuth 2.0 authorization server metadata endpoint (MSC2965),
+// used by servers that delegate authentication to an OpenID Connect provider (MSC3861).
+// https://github.com/matrix-org/matrix-spec-proposals/pull/2965
+type RespAuthMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint         string `json:"token_endpoint,omitempty"`
+	RegistrationEndpoint  string `json:"registration_endpoint,omitempty"`
+	RevocationEndpoint    string `json:"revocation_endpoint,omitempty"`
+
+	ScopesSupported               []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported        []string `json:"response_types_supported,omitempty"`
+	GrantTypesSupported           []string `json:"grant_types_supported,omitempty"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported,omitempty"`
+
+	AccountManagementURI              string   `json:"account_management_uri,omitempty"`
+	AccountManagementActionsSupported []string `json:"account_management_actions_supported,omitempty"`
+}
+
 // RespLogin is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3login
 type RespLogin struct {
 	AccessToken string           `json:"access_token"`
@@ -217,6 +244,25 @@ type RespLogin struct {
 	WellKnown   *ClientWellKnown `json:"well_known,omitempty"`
 }
 
+// RespWellKnownSupport is the JSON response for https://spec.matrix.org/v1.10/client-server-api/#getwell-knownmatrixsupport
+type RespWellKnownSupport struct {
+	Contacts    []SupportContact `json:"contacts,omitempty"`
+	SupportPage string           `json:"support_page,omitempty"`
+}
+
+type SupportContactRole string
+
+const (
+	SupportContactRoleAdmin    SupportContactRole = "m.role.admin"
+	SupportContactRoleSecurity SupportContactRole = "m.role.security"
+)
+
+type SupportContact struct {
+	MatrixID     id.UserID          `json:"matrix_id,omitempty"`
+	EmailAddress string             `json:"email_address,omitempty"`
+	Role         SupportContactRole `json:"role"`
+}
+
 // RespLogout is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3logout
 type RespLogout struct{}
 
@@ -329,6 +375,9 @@ type SyncJoinedRoom struct {
 	AccountData SyncEventsList  `json:"account_data"`
 
 	UnreadNotifications *UnreadNotificationCounts `json:"unread_notifications,omitempty"`
+	// Per-thread notification counts, only present if unread_thread_notifications was enabled in the filter.
+	// https://spec.matrix.org/v1.4/client-server-api/#receiving-notifications
+	UnreadThreadNotifications map[id.EventID]*UnreadNotificationCounts `json:"unread_thread_notifications,omitempty"`
 	// https://github.com/matrix-org/matrix-spec-proposals/pull/2654
 	MSC2654UnreadCount *int `json:"org.matrix.msc2654.unread_count,omitempty"`
 }
@@ -338,6 +387,24 @@ type UnreadNotificationCounts struct {
 	NotificationCount int `json:"notification_count"`
 }
 
+// TotalUnreadNotifications sums the notification and highlight counts of all joined rooms, including per-thread counts.
+// This is useful for e.g. displaying a badge count.
+func (rsr *RespSyncRooms) TotalUnreadNotifications() (total UnreadNotificationCounts) {
+	add := func(counts *UnreadNotificationCounts) {
+		if counts != nil {
+			total.HighlightCount += counts.HighlightCount
+			total.NotificationCount += counts.NotificationCount
+		}
+	}
+	for _, room := range rsr.Join {
+		add(room.UnreadNotifications)
+		for _, threadCounts := range room.UnreadThreadNotifications {
+			add(threadCounts)
+		}
+	}
+	return
+}
+
 type marshalableSyncJoinedRoom SyncJoinedRoom
 
 var syncJoinedRoomPathsToDelete = []string{"summary", "state", "timeline", "ephemeral", "account_data"}
@@ -421,6 +488,39 @@ type RespDeviceInfo struct {
 	LastSeenTS  int64       `json:"last_seen_ts"`
 }
 
+// RespNotifications is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3notifications
+type RespNotifications struct {
+	Notifications []*Notification `json:"notifications"`
+	NextToken     string          `json:"next_token,omitempty"`
+}
+
+type Notification struct {
+	Actions    pushrules.PushActionArray `json:"actions"`
+	Event      *event.Event              `json:"event"`
+	ProfileTag string                    `json:"profile_tag,omitempty"`
+	Read       bool                      `json:"read"`
+	RoomID     id.RoomID                 `json:"room_id"`
+	Timestamp  jsontime.UnixMilli        `json:"ts"`
+}
+
+// RespPushers is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3pushers
+type RespPushers struct {
+	Pushers []*Pusher `json:"pushers"`
+}
+
+// RespOpenIDToken is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3useruseridopenidrequest_token
+type RespOpenIDToken struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	MatrixServerName string `json:"matrix_server_name"`
+	ExpiresIn        int    `json:"expires_in"`
+}
+
+// RespDeactivate is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3accountdeactivate
+type RespDeactivate struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
 // Deprecated: MSC2716 was abandoned
 type RespBatchSend struct {
 	StateEventIDs []id.EventID `json:"state_event_ids"`
@@ -16,6 +16,7 @@ import (
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/id"
 )
 
 const sampleData = `{
@@ -111,3 +112,52 @@ func TestRespCapabilities_MarshalJSON(t *testing.T) {
 	assert.Equal(t, marshaledString, origString)
 	assert.Len(t, sampleObject.Custom, 1)
 }
+
+func TestRespSync_UnreadNotifications(t *testing.T) {
+	var resp mautrix.RespSync
+	err := json.Unmarshal([]byte(`{"next_batch":"s1","rooms":{"join":{
+		"!a:example.com":{"unread_notifications":{"notification_count":3,"highlight_count":1}},
+		"!b:example.com":{
+			"unread_notifications":{"notification_count":2,"highlight_count":0},
+			"unread_thread_notifications":{"$thread":{"notification_count":4,"highlight_count":2}}
+		},
+		"!c:example.com":{}
+	}}}`), &resp)
+	require.NoError(t, err)
+	roomB := resp.Rooms.Join["!b:example.com"]
+	require.NotNil(t, roomB.UnreadNotifications)
+	assert.Equal(t, 2, roomB.UnreadNotifications.NotificationCount)
+	require.Contains(t, roomB.UnreadThreadNotifications, id.EventID("$thread"))
+	assert.Equal(t, 2, roomB.UnreadThreadNotifications["$thread"].HighlightCount)
+	assert.Equal(t, mautrix.UnreadNotificationCounts{NotificationCount: 9, HighlightCount: 3}, resp.Rooms.TotalUnreadNotifications())
+}
+
+func TestRespSync_TopLevelBlocks(t *testing.T) {
+	var resp mautrix.RespSync
+	err := json.Unmarshal([]byte(`{
+		"next_batch": "s1",
+		"account_data": {"events": [{"type": "m.direct", "content": {"@friend:example.com": ["!dm:example.com"]}}]},
+		"to_device": {"events": [{"type": "m.room_key_request", "sender": "@user:example.com", "content": {"action": "cancellation", "request_id": "1", "requesting_device_id": "DEVICE"}}]},
+		"device_lists": {"changed": ["@alice:example.com", "@bob:example.com"], "left": ["@carol:example.com"]}
+	}`), &resp)
+	require.NoError(t, err)
+	require.Len(t, resp.AccountData.Events, 1)
+	assert.Equal(t, "m.direct", resp.AccountData.Events[0].Type.Type)
+	require.Len(t, resp.ToDevice.Events, 1)
+	assert.Equal(t, id.UserID("@user:example.com"), resp.ToDevice.Events[0].Sender)
+	assert.Equal(t, []id.UserID{"@alice:example.com", "@bob:example.com"}, resp.DeviceLists.Changed)
+	assert.Equal(t, []id.UserID{"@carol:example.com"}, resp.DeviceLists.Left)
+}
+
+func TestRespSync_KeyCounts(t *testing.T) {
+	var resp mautrix.RespSync
+	err := json.Unmarshal([]byte(`{
+		"next_batch": "s1",
+		"device_one_time_keys_count": {"signed_curve25519": 42},
+		"device_unused_fallback_key_types": ["signed_curve25519"]
+	}`), &resp)
+	require.NoError(t, err)
+	assert.Equal(t, 42, resp.DeviceOTKCount.SignedCurve25519)
+	assert.Equal(t, 0, resp.DeviceOTKCount.Curve25519)
+	assert.Equal(t, []id.KeyAlgorithm{id.KeyAlgorithmSignedCurve25519}, resp.FallbackKeys)
+}
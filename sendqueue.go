@@ -0,0 +1,111 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+type roomSendQueueEntry struct {
+	waiters []chan struct{}
+}
+
+// RoomSendQueue serializes sends to the same room while letting sends to different rooms run concurrently.
+//
+// Sends to a single room are executed in the order they were queued, which ensures that e.g. edits are sent after
+// the message they edit even if the sends are started from different goroutines. Optionally, the total number of
+// concurrent sends across all rooms can be capped too.
+type RoomSendQueue struct {
+	lock   sync.Mutex
+	rooms  map[id.RoomID]*roomSendQueueEntry
+	global chan struct{}
+}
+
+// NewRoomSendQueue creates a new RoomSendQueue. If maxConcurrent is positive, at most that many sends
+// (to different rooms) will run at the same time. Otherwise, the number of rooms being sent to isn't limited.
+func NewRoomSendQueue(maxConcurrent int) *RoomSendQueue {
+	queue := &RoomSendQueue{
+		rooms: make(map[id.RoomID]*roomSendQueueEntry),
+	}
+	if maxConcurrent > 0 {
+		queue.global = make(chan struct{}, maxConcurrent)
+	}
+	return queue
+}
+
+// Do waits until it's the caller's turn to send to the given room and then calls fn.
+//
+// If the context is canceled before fn is called, the caller is removed from the queue and the context error is returned.
+func (rsq *RoomSendQueue) Do(ctx context.Context, roomID id.RoomID, fn func() error) error {
+	err := rsq.acquire(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	defer rsq.release(roomID)
+	if rsq.global != nil {
+		select {
+		case rsq.global <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() {
+			<-rsq.global
+		}()
+	}
+	return fn()
+}
+
+func (rsq *RoomSendQueue) acquire(ctx context.Context, roomID id.RoomID) error {
+	rsq.lock.Lock()
+	entry, ok := rsq.rooms[roomID]
+	if !ok {
+		// Nobody is sending to the room, so the room is ours immediately.
+		rsq.rooms[roomID] = &roomSendQueueEntry{}
+		rsq.lock.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	entry.waiters = append(entry.waiters, ch)
+	rsq.lock.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		rsq.lock.Lock()
+		defer rsq.lock.Unlock()
+		for i, waiter := range entry.waiters {
+			if waiter == ch {
+				entry.waiters = append(entry.waiters[:i], entry.waiters[i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// The turn was handed to us while the context was being canceled, so pass it on to the next waiter.
+		rsq.releaseLocked(roomID)
+		return ctx.Err()
+	}
+}
+
+func (rsq *RoomSendQueue) release(roomID id.RoomID) {
+	rsq.lock.Lock()
+	rsq.releaseLocked(roomID)
+	rsq.lock.Unlock()
+}
+
+func (rsq *RoomSendQueue) releaseLocked(roomID id.RoomID) {
+	entry := rsq.rooms[roomID]
+	if len(entry.waiters) == 0 {
+		delete(rsq.rooms, roomID)
+		return
+	}
+	next := entry.waiters[0]
+	entry.waiters = entry.waiters[1:]
+	close(next)
+}
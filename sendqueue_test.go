@@ -0,0 +1,150 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRoomSendQueue_SameRoomSerialized(t *testing.T) {
+	queue := mautrix.NewRoomSendQueue(0)
+	roomID := id.RoomID("!room:example.com")
+
+	var active, maxActive int32
+	var orderLock sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	unblock := make(chan struct{})
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := queue.Do(context.Background(), roomID, func() error {
+				current := atomic.AddInt32(&active, 1)
+				defer atomic.AddInt32(&active, -1)
+				for {
+					prevMax := atomic.LoadInt32(&maxActive)
+					if current <= prevMax || atomic.CompareAndSwapInt32(&maxActive, prevMax, current) {
+						break
+					}
+				}
+				if i == 0 {
+					<-unblock
+				}
+				time.Sleep(5 * time.Millisecond)
+				orderLock.Lock()
+				order = append(order, i)
+				orderLock.Unlock()
+				return nil
+			})
+			assert.NoError(t, err)
+		}(i)
+		// Give the goroutine time to get into the queue, so that the queue order is deterministic.
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(unblock)
+	wg.Wait()
+	assert.EqualValues(t, 1, maxActive)
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, order)
+}
+
+func TestRoomSendQueue_DifferentRoomsConcurrent(t *testing.T) {
+	queue := mautrix.NewRoomSendQueue(0)
+	var bothRunning sync.WaitGroup
+	bothRunning.Add(2)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, roomID := range []id.RoomID{"!a:example.com", "!b:example.com"} {
+		wg.Add(1)
+		go func(roomID id.RoomID) {
+			defer wg.Done()
+			_ = queue.Do(context.Background(), roomID, func() error {
+				bothRunning.Done()
+				<-done
+				return nil
+			})
+		}(roomID)
+	}
+	allRunning := make(chan struct{})
+	go func() {
+		bothRunning.Wait()
+		close(allRunning)
+	}()
+	select {
+	case <-allRunning:
+	case <-time.After(time.Second):
+		t.Error("sends to different rooms didn't run concurrently")
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestRoomSendQueue_GlobalLimit(t *testing.T) {
+	queue := mautrix.NewRoomSendQueue(2)
+	var active, maxActive int32
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(roomID id.RoomID) {
+			defer wg.Done()
+			_ = queue.Do(context.Background(), roomID, func() error {
+				current := atomic.AddInt32(&active, 1)
+				defer atomic.AddInt32(&active, -1)
+				for {
+					prevMax := atomic.LoadInt32(&maxActive)
+					if current <= prevMax || atomic.CompareAndSwapInt32(&maxActive, prevMax, current) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				return nil
+			})
+		}(id.RoomID("!room" + string(rune('a'+i)) + ":example.com"))
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, maxActive, int32(2))
+}
+
+func TestRoomSendQueue_ContextCanceled(t *testing.T) {
+	queue := mautrix.NewRoomSendQueue(0)
+	roomID := id.RoomID("!room:example.com")
+	unblock := make(chan struct{})
+	go func() {
+		_ = queue.Do(context.Background(), roomID, func() error {
+			<-unblock
+			return nil
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	called := false
+	err := queue.Do(ctx, roomID, func() error {
+		called = true
+		return nil
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, called)
+
+	close(unblock)
+	// The canceled waiter must not block the queue for later sends.
+	err = queue.Do(context.Background(), roomID, func() error {
+		return nil
+	})
+	require.NoError(t, err)
+}
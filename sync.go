@@ -32,9 +32,9 @@ const (
 	EventSourceDecrypted
 )
 
-const primaryTypes = EventSourcePresence | EventSourceAccountData | EventSourceToDevice | EventSourceTimeline | EventSourceState
+const primaryTypes = EventSourcePresence | EventSourceAccountData | EventSourceToDevice | EventSourceTimeline | EventSourceState | EventSourceEphemeral
 const roomSections = EventSourceJoin | EventSourceInvite | EventSourceLeave
-const roomableTypes = EventSourceAccountData | EventSourceTimeline | EventSourceState
+const roomableTypes = EventSourceAccountData | EventSourceTimeline | EventSourceState | EventSourceEphemeral
 const encryptableTypes = roomableTypes | EventSourceToDevice
 
 func (es EventSource) String() string {
@@ -50,6 +50,8 @@ func (es EventSource) String() string {
 		typeName = "timeline"
 	case EventSourceState:
 		typeName = "state"
+	case EventSourceEphemeral:
+		typeName = "ephemeral"
 	default:
 		return fmt.Sprintf("unknown (%d)", es)
 	}
@@ -83,6 +85,11 @@ type EventHandler func(source EventSource, evt *event.Event)
 // SyncHandler handles a whole sync response. If the return value is false, handling will be stopped completely.
 type SyncHandler func(resp *RespSync, since string) bool
 
+// GappySyncHandler handles a limited room timeline in a sync response, i.e. a timeline that doesn't include all events
+// since the previous sync. The missing events can be fetched with Client.Messages using timeline.PrevBatch as the from
+// token and DirectionBackward, until reaching an event that was already seen.
+type GappySyncHandler func(roomID id.RoomID, timeline *SyncTimeline)
+
 // Syncer is an interface that must be satisfied in order to do /sync requests on a client.
 type Syncer interface {
 	// ProcessResponse processes the /sync response. The since parameter is the since= value that was used to produce the response.
@@ -104,27 +111,44 @@ type DispatchableSyncer interface {
 	Dispatch(source EventSource, evt *event.Event)
 }
 
+// InitialSyncFilterer is an optional interface for syncers that want to use a different filter for the initial sync
+// (i.e. when there's no since token). The filter is sent inline instead of being uploaded to the server.
+type InitialSyncFilterer interface {
+	// GetInitialFilterJSON returns the filter to use for the initial sync, or nil to use the normal filter.
+	GetInitialFilterJSON(userID id.UserID) *Filter
+}
+
 // DefaultSyncer is the default syncing implementation. You can either write your own syncer, or selectively
 // replace parts of this default syncer (e.g. the ProcessResponse method). The default syncer uses the observer
 // pattern to notify callers about incoming events. See DefaultSyncer.OnEventType for more information.
 type DefaultSyncer struct {
 	// syncListeners want the whole sync response, e.g. the crypto machine
 	syncListeners []SyncHandler
+	// initialSyncListeners want the whole response of the initial sync
+	initialSyncListeners []SyncHandler
 	// globalListeners want all events
 	globalListeners []EventHandler
+	// gappySyncListeners want to know about limited room timelines
+	gappySyncListeners []GappySyncHandler
 	// listeners want a specific event type
 	listeners map[event.Type][]EventHandler
 	// ParseEventContent determines whether or not event content should be parsed before passing to handlers.
 	ParseEventContent bool
 	// ParseErrorHandler is called when event.Content.ParseRaw returns an error.
-	// If it returns false, the event will not be forwarded to listeners.
+	// If it returns false, the event will not be forwarded to listeners. If it returns true, the event is forwarded
+	// with Content.Parsed set to nil and the error stored in Mautrix.ContentParseError.
+	// Other events in the same sync response are processed normally either way.
 	ParseErrorHandler func(evt *event.Event, err error) bool
 	// FilterJSON is used when the client starts syncing and doesn't get an existing filter ID from SyncStore's LoadFilterID.
 	FilterJSON *Filter
+	// InitialTimelineLimit is the maximum number of timeline events to fetch per room in the initial sync.
+	// If zero, the timeline limit from FilterJSON is used for the initial sync too.
+	InitialTimelineLimit int
 }
 
 var _ Syncer = (*DefaultSyncer)(nil)
 var _ ExtensibleSyncer = (*DefaultSyncer)(nil)
+var _ InitialSyncFilterer = (*DefaultSyncer)(nil)
 
 // NewDefaultSyncer returns an instantiated DefaultSyncer
 func NewDefaultSyncer() *DefaultSyncer {
@@ -136,6 +160,7 @@ func NewDefaultSyncer() *DefaultSyncer {
 		ParseErrorHandler: func(evt *event.Event, err error) bool {
 			return false
 		},
+		InitialTimelineLimit: 10,
 	}
 }
 
@@ -148,6 +173,13 @@ func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error)
 		}
 	}()
 
+	if since == "" {
+		for _, listener := range s.initialSyncListeners {
+			if !listener(res, since) {
+				return
+			}
+		}
+	}
 	for _, listener := range s.syncListeners {
 		if !listener(res, since) {
 			return
@@ -159,21 +191,77 @@ func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error)
 	s.processSyncEvents("", res.AccountData.Events, EventSourceAccountData)
 
 	for roomID, roomData := range res.Rooms.Join {
-		s.processSyncEvents(roomID, roomData.State.Events, EventSourceJoin|EventSourceState)
-		s.processSyncEvents(roomID, roomData.Timeline.Events, EventSourceJoin|EventSourceTimeline)
-		s.processSyncEvents(roomID, roomData.Ephemeral.Events, EventSourceJoin|EventSourceEphemeral)
-		s.processSyncEvents(roomID, roomData.AccountData.Events, EventSourceJoin|EventSourceAccountData)
+		s.processJoinedRoom(roomID, roomData, since)
 	}
 	for roomID, roomData := range res.Rooms.Invite {
-		s.processSyncEvents(roomID, roomData.State.Events, EventSourceInvite|EventSourceState)
+		s.processInvitedRoom(roomID, roomData)
 	}
 	for roomID, roomData := range res.Rooms.Leave {
-		s.processSyncEvents(roomID, roomData.State.Events, EventSourceLeave|EventSourceState)
-		s.processSyncEvents(roomID, roomData.Timeline.Events, EventSourceLeave|EventSourceTimeline)
+		s.processLeftRoom(roomID, roomData, since)
 	}
 	return
 }
 
+// StreamHandler returns a SyncStreamHandler that dispatches the events of each room as soon as the room is decoded.
+// It can be used with ReqSync.StreamHandler to avoid keeping huge sync responses in memory. The RespSync returned by
+// the request won't contain rooms, but should still be passed to ProcessResponse to handle the rest of the response.
+//
+// Note that this means room events are dispatched before sync listeners and non-room events like to-device events,
+// so this shouldn't be used if e.g. encryption keys need to be received before room events are handled.
+func (s *DefaultSyncer) StreamHandler(since string) *SyncStreamHandler {
+	return &SyncStreamHandler{
+		Join: func(roomID id.RoomID, room *SyncJoinedRoom) (err error) {
+			defer s.recoverStreamPanic(since, &err)
+			s.processJoinedRoom(roomID, room, since)
+			return
+		},
+		Invite: func(roomID id.RoomID, room *SyncInvitedRoom) (err error) {
+			defer s.recoverStreamPanic(since, &err)
+			s.processInvitedRoom(roomID, room)
+			return
+		},
+		Leave: func(roomID id.RoomID, room *SyncLeftRoom) (err error) {
+			defer s.recoverStreamPanic(since, &err)
+			s.processLeftRoom(roomID, room, since)
+			return
+		},
+	}
+}
+
+func (s *DefaultSyncer) recoverStreamPanic(since string, err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("StreamHandler panicked! since=%s panic=%s\n%s", since, r, debug.Stack())
+	}
+}
+
+func (s *DefaultSyncer) processJoinedRoom(roomID id.RoomID, roomData *SyncJoinedRoom, since string) {
+	s.processSyncEvents(roomID, roomData.State.Events, EventSourceJoin|EventSourceState)
+	s.notifyGappySync(roomID, &roomData.Timeline, since)
+	s.processSyncEvents(roomID, roomData.Timeline.Events, EventSourceJoin|EventSourceTimeline)
+	s.processSyncEvents(roomID, roomData.Ephemeral.Events, EventSourceJoin|EventSourceEphemeral)
+	s.processSyncEvents(roomID, roomData.AccountData.Events, EventSourceJoin|EventSourceAccountData)
+}
+
+func (s *DefaultSyncer) processInvitedRoom(roomID id.RoomID, roomData *SyncInvitedRoom) {
+	s.processSyncEvents(roomID, roomData.State.Events, EventSourceInvite|EventSourceState)
+}
+
+func (s *DefaultSyncer) processLeftRoom(roomID id.RoomID, roomData *SyncLeftRoom, since string) {
+	s.processSyncEvents(roomID, roomData.State.Events, EventSourceLeave|EventSourceState)
+	s.notifyGappySync(roomID, &roomData.Timeline, since)
+	s.processSyncEvents(roomID, roomData.Timeline.Events, EventSourceLeave|EventSourceTimeline)
+}
+
+func (s *DefaultSyncer) notifyGappySync(roomID id.RoomID, timeline *SyncTimeline, since string) {
+	// Timelines are always limited in the initial sync, so there's no gap to fill
+	if !timeline.Limited || since == "" {
+		return
+	}
+	for _, listener := range s.gappySyncListeners {
+		listener(roomID, timeline)
+	}
+}
+
 func (s *DefaultSyncer) processSyncEvents(roomID id.RoomID, events []*event.Event, source EventSource) {
 	for _, evt := range events {
 		s.processSyncEvent(roomID, evt, source)
@@ -200,8 +288,15 @@ func (s *DefaultSyncer) processSyncEvent(roomID id.RoomID, evt *event.Event, sou
 
 	if s.ParseEventContent {
 		err := evt.Content.ParseRaw(evt.Type)
-		if err != nil && !s.ParseErrorHandler(evt, err) {
-			return
+		if err != nil {
+			if !errors.Is(err, event.ErrContentAlreadyParsed) {
+				// Leave the content unparsed instead of passing a half-filled struct to handlers
+				evt.Content.Parsed = nil
+				evt.Mautrix.ContentParseError = err
+			}
+			if !s.ParseErrorHandler(evt, err) {
+				return
+			}
 		}
 	}
 
@@ -234,10 +329,23 @@ func (s *DefaultSyncer) OnSync(callback SyncHandler) {
 	s.syncListeners = append(s.syncListeners, callback)
 }
 
+// OnInitialSync allows callers to be notified of the response to the initial sync, i.e. the first sync without a
+// since token. Initial sync listeners are called before the normal sync listeners added with OnSync.
+func (s *DefaultSyncer) OnInitialSync(callback SyncHandler) {
+	s.initialSyncListeners = append(s.initialSyncListeners, callback)
+}
+
 func (s *DefaultSyncer) OnEvent(callback EventHandler) {
 	s.globalListeners = append(s.globalListeners, callback)
 }
 
+// OnGappySync allows callers to be notified when a room timeline in a sync response is limited, which means there's
+// a gap between the previous sync and the events in the timeline. The callback is called before the timeline events
+// of the room are dispatched. Limited timelines in the initial sync are ignored.
+func (s *DefaultSyncer) OnGappySync(callback GappySyncHandler) {
+	s.gappySyncListeners = append(s.gappySyncListeners, callback)
+}
+
 // OnFailedSync always returns a 10 second wait period between failed /syncs, never a fatal error.
 func (s *DefaultSyncer) OnFailedSync(res *RespSync, err error) (time.Duration, error) {
 	if errors.Is(err, MUnknownToken) {
@@ -263,6 +371,19 @@ func (s *DefaultSyncer) GetFilterJSON(userID id.UserID) *Filter {
 	return s.FilterJSON
 }
 
+// GetInitialFilterJSON returns a copy of the normal filter with the timeline limit lowered to InitialTimelineLimit.
+func (s *DefaultSyncer) GetInitialFilterJSON(userID id.UserID) *Filter {
+	if s.InitialTimelineLimit <= 0 {
+		return nil
+	}
+	filterCopy := *s.GetFilterJSON(userID)
+	if filterCopy.Room.Timeline.Limit > 0 && filterCopy.Room.Timeline.Limit <= s.InitialTimelineLimit {
+		return nil
+	}
+	filterCopy.Room.Timeline.Limit = s.InitialTimelineLimit
+	return &filterCopy
+}
+
 // OldEventIgnorer is a utility struct for bots to ignore events from before the bot joined the room.
 //
 // Deprecated: Use Client.DontProcessOldEvents instead.
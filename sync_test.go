@@ -0,0 +1,427 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestDefaultSyncer_GetInitialFilterJSON(t *testing.T) {
+	syncer := mautrix.NewDefaultSyncer()
+	initialFilter := syncer.GetInitialFilterJSON("@user:example.com")
+	require.NotNil(t, initialFilter)
+	assert.Equal(t, 10, initialFilter.Room.Timeline.Limit)
+	assert.Equal(t, 50, syncer.GetFilterJSON("@user:example.com").Room.Timeline.Limit)
+
+	syncer.FilterJSON.Room.Timeline.Limit = 5
+	assert.Nil(t, syncer.GetInitialFilterJSON("@user:example.com"))
+
+	syncer.FilterJSON.Room.Timeline.Limit = 50
+	syncer.InitialTimelineLimit = 0
+	assert.Nil(t, syncer.GetInitialFilterJSON("@user:example.com"))
+}
+
+func TestClient_Sync_InitialFilter(t *testing.T) {
+	var filterParams []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/v3/user/@user:example.com/filter" {
+			_, _ = w.Write([]byte(`{"filter_id":"1"}`))
+			return
+		}
+		filterParams = append(filterParams, r.URL.Query().Get("filter"))
+		_, _ = w.Write([]byte(`{"next_batch":"s1"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	syncer := cli.Syncer.(*mautrix.DefaultSyncer)
+	var initialSyncs, syncs int
+	syncer.OnInitialSync(func(resp *mautrix.RespSync, since string) bool {
+		initialSyncs++
+		return true
+	})
+	syncer.OnSync(func(resp *mautrix.RespSync, since string) bool {
+		syncs++
+		if syncs == 2 {
+			cli.StopSync()
+		}
+		return true
+	})
+	require.NoError(t, cli.Sync())
+	assert.Equal(t, 1, initialSyncs)
+	require.Len(t, filterParams, 3)
+	var initialFilter mautrix.Filter
+	require.NoError(t, json.Unmarshal([]byte(filterParams[0]), &initialFilter))
+	assert.Equal(t, 10, initialFilter.Room.Timeline.Limit)
+	assert.Equal(t, "1", filterParams[1])
+}
+
+func TestClient_SyncAsync(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/v3/user/@user:example.com/filter" {
+			_, _ = w.Write([]byte(`{"filter_id":"1"}`))
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		_, _ = w.Write([]byte(`{"next_batch":"s1"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	firstSync := make(chan struct{})
+	cli.Syncer.(*mautrix.DefaultSyncer).OnInitialSync(func(resp *mautrix.RespSync, since string) bool {
+		close(firstSync)
+		return true
+	})
+	done := cli.SyncAsync()
+	<-firstSync
+	cli.StopSync()
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync didn't stop after StopSync")
+	}
+}
+
+func TestClient_Sync_InvalidPresence(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte(`{"next_batch":"s1"}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.SyncPresence = "onlien"
+	assert.ErrorIs(t, cli.Sync(), mautrix.ErrInvalidPresence)
+	_, err = cli.SyncOnce("", 0)
+	assert.ErrorIs(t, err, mautrix.ErrInvalidPresence)
+	_, err = cli.FullSyncRequest(mautrix.ReqSync{SetPresence: "away"})
+	assert.ErrorIs(t, err, mautrix.ErrInvalidPresence)
+	assert.ErrorIs(t, cli.SetPresence("busy"), mautrix.ErrInvalidPresence)
+	assert.Equal(t, 0, requests)
+
+	_, err = cli.FullSyncRequest(mautrix.ReqSync{SetPresence: event.PresenceOffline})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests)
+}
+
+func TestClient_SyncOnce(t *testing.T) {
+	var filters int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/v3/user/@user:example.com/filter" {
+			filters++
+			_, _ = w.Write([]byte(`{"filter_id":"1"}`))
+			return
+		}
+		assert.Equal(t, "1", r.URL.Query().Get("filter"))
+		assert.Equal(t, "offline", r.URL.Query().Get("set_presence"))
+		if r.URL.Query().Get("since") == "" {
+			_, _ = w.Write([]byte(`{"next_batch":"s1","rooms":{"join":{"!room:example.com":{}}}}`))
+		} else {
+			_, _ = w.Write([]byte(`{"next_batch":"s2"}`))
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.SyncPresence = event.PresenceOffline
+	resp, err := cli.SyncOnce("", 0)
+	require.NoError(t, err)
+	assert.Equal(t, "s1", resp.NextBatch)
+	assert.Contains(t, resp.Rooms.Join, id.RoomID("!room:example.com"))
+	assert.Equal(t, "", cli.Store.LoadNextBatch(cli.UserID))
+
+	resp, err = cli.SyncOnce(resp.NextBatch, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "s2", resp.NextBatch)
+	assert.Equal(t, 1, filters)
+}
+
+func TestClient_FetchRoomLatest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/sync", r.URL.Path)
+		assert.Empty(t, r.URL.Query().Get("since"))
+		var filter mautrix.Filter
+		assert.NoError(t, json.Unmarshal([]byte(r.URL.Query().Get("filter")), &filter))
+		assert.Equal(t, []id.RoomID{"!target:example.com"}, filter.Room.Rooms)
+		assert.Equal(t, 2, filter.Room.Timeline.Limit)
+		_, _ = w.Write([]byte(`{"next_batch":"s1","rooms":{"join":{
+			"!other:example.com":{"timeline":{"events":[{"type":"m.room.message","event_id":"$other","content":{}}]}},
+			"!target:example.com":{"timeline":{"events":[
+				{"type":"m.room.message","event_id":"$1","content":{"msgtype":"m.text","body":"hi"}},
+				{"type":"m.room.message","event_id":"$2","content":{"msgtype":"m.text","body":"hello"}}
+			]}}
+		}}}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	evts, err := cli.FetchRoomLatest("!target:example.com", 2)
+	require.NoError(t, err)
+	require.Len(t, evts, 2)
+	assert.Equal(t, id.EventID("$1"), evts[0].ID)
+	assert.Equal(t, id.EventID("$2"), evts[1].ID)
+	assert.Equal(t, id.RoomID("!target:example.com"), evts[1].RoomID)
+	assert.Equal(t, "", cli.Store.LoadNextBatch(cli.UserID))
+}
+
+func TestDefaultSyncer_MalformedContent(t *testing.T) {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(`{"next_batch":"s1","rooms":{"join":{"!room:example.com":{"timeline":{"events":[
+		{"type":"m.room.message","event_id":"$1","content":{"msgtype":"m.text","body":"first"}},
+		{"type":"m.room.message","event_id":"$2","content":{"msgtype":"m.text","body":{"not":"a string"}}},
+		{"type":"m.room.message","event_id":"$3","content":{"msgtype":"m.text","body":"third"}}
+	]}}}}}`), &resp))
+
+	syncer := mautrix.NewDefaultSyncer()
+	var received []*event.Event
+	syncer.OnEventType(event.EventMessage, func(source mautrix.EventSource, evt *event.Event) {
+		received = append(received, evt)
+	})
+	require.NoError(t, syncer.ProcessResponse(&resp, ""))
+	require.Len(t, received, 2)
+	assert.Equal(t, "first", received[0].Content.AsMessage().Body)
+	assert.Equal(t, "third", received[1].Content.AsMessage().Body)
+
+	var parseErrors []id.EventID
+	syncer.ParseErrorHandler = func(evt *event.Event, err error) bool {
+		parseErrors = append(parseErrors, evt.ID)
+		return true
+	}
+	received = nil
+	resp.Rooms.Join["!room:example.com"].Timeline.Events[0].Content.Parsed = nil
+	resp.Rooms.Join["!room:example.com"].Timeline.Events[1].Content.Parsed = nil
+	resp.Rooms.Join["!room:example.com"].Timeline.Events[2].Content.Parsed = nil
+	require.NoError(t, syncer.ProcessResponse(&resp, "s0"))
+	assert.Equal(t, []id.EventID{"$2"}, parseErrors)
+	require.Len(t, received, 3)
+	assert.Nil(t, received[1].Content.Parsed)
+	assert.Error(t, received[1].Mautrix.ContentParseError)
+	assert.NotEmpty(t, received[1].Content.VeryRaw)
+	assert.Nil(t, received[2].Mautrix.ContentParseError)
+}
+
+func TestDefaultSyncer_EphemeralAndPresence(t *testing.T) {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(`{"next_batch":"s1",
+		"presence":{"events":[{"type":"m.presence","sender":"@alice:example.com","content":{"presence":"online"}}]},
+		"rooms":{"join":{"!room:example.com":{"ephemeral":{"events":[
+			{"type":"m.typing","content":{"user_ids":["@alice:example.com","@bob:example.com"]}},
+			{"type":"m.receipt","content":{"$event":{"m.read":{"@alice:example.com":{"ts":1700000000000}}}}}
+		]}}}}
+	}`), &resp))
+
+	syncer := mautrix.NewDefaultSyncer()
+	received := map[event.Type]*event.Event{}
+	sources := map[event.Type]mautrix.EventSource{}
+	syncer.OnEvent(func(source mautrix.EventSource, evt *event.Event) {
+		received[evt.Type] = evt
+		sources[evt.Type] = source
+	})
+	require.NoError(t, syncer.ProcessResponse(&resp, ""))
+
+	typing := received[event.EphemeralEventTyping]
+	require.NotNil(t, typing)
+	assert.Equal(t, id.RoomID("!room:example.com"), typing.RoomID)
+	assert.Equal(t, []id.UserID{"@alice:example.com", "@bob:example.com"}, typing.Content.AsTyping().UserIDs)
+	assert.Equal(t, mautrix.EventSourceJoin|mautrix.EventSourceEphemeral, sources[event.EphemeralEventTyping])
+	assert.Equal(t, "joined room ephemeral", sources[event.EphemeralEventTyping].String())
+
+	receipt := received[event.EphemeralEventReceipt]
+	require.NotNil(t, receipt)
+	assert.Equal(t, id.RoomID("!room:example.com"), receipt.RoomID)
+	readReceipt := (*receipt.Content.AsReceipt())["$event"][event.ReceiptTypeRead]["@alice:example.com"]
+	assert.Equal(t, int64(1700000000000), readReceipt.Timestamp.UnixMilli())
+
+	presence := received[event.EphemeralEventPresence]
+	require.NotNil(t, presence)
+	assert.Equal(t, id.UserID("@alice:example.com"), presence.Sender)
+	assert.Equal(t, event.PresenceOnline, presence.Content.AsPresence().Presence)
+	assert.Equal(t, "presence", sources[event.EphemeralEventPresence].String())
+}
+
+func TestClient_FullStateSync(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/sync", r.URL.Path)
+		assert.Equal(t, "true", r.URL.Query().Get("full_state"))
+		assert.Equal(t, "s1", r.URL.Query().Get("since"))
+		assert.Equal(t, "1", r.URL.Query().Get("filter"))
+		_, _ = w.Write([]byte(`{"next_batch":"s2","rooms":{"join":{"!room:example.com":{"state":{"events":[
+			{"type":"m.room.name","state_key":"","event_id":"$name","content":{"name":"Room"}}
+		]}}}}}`))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.Store.SaveNextBatch(cli.UserID, "s1")
+	cli.Store.SaveFilterID(cli.UserID, "1")
+	resp, err := cli.FullStateSync()
+	require.NoError(t, err)
+	require.Contains(t, resp.Rooms.Join, id.RoomID("!room:example.com"))
+	assert.Len(t, resp.Rooms.Join["!room:example.com"].State.Events, 1)
+	assert.Equal(t, "s1", cli.Store.LoadNextBatch(cli.UserID))
+}
+
+func TestClient_GetMemberCount(t *testing.T) {
+	includeSummary := true
+	var memberRequests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v3/sync":
+			var filter mautrix.Filter
+			assert.NoError(t, json.Unmarshal([]byte(r.URL.Query().Get("filter")), &filter))
+			assert.Equal(t, []id.RoomID{"!room:example.com"}, filter.Room.Rooms)
+			assert.True(t, filter.Room.State.LazyLoadMembers)
+			if includeSummary {
+				_, _ = w.Write([]byte(`{"next_batch":"s1","rooms":{"join":{"!room:example.com":{
+					"summary":{"m.heroes":["@alice:example.com"],"m.joined_member_count":1234,"m.invited_member_count":5}
+				}}}}`))
+			} else {
+				_, _ = w.Write([]byte(`{"next_batch":"s1","rooms":{"join":{"!room:example.com":{}}}}`))
+			}
+		case "/_matrix/client/v3/rooms/!room:example.com/joined_members":
+			memberRequests++
+			_, _ = w.Write([]byte(`{"joined":{"@alice:example.com":{},"@bob:example.com":{}}}`))
+		case "/_matrix/client/v3/rooms/!room:example.com/members":
+			memberRequests++
+			assert.Equal(t, "invite", r.URL.Query().Get("membership"))
+			_, _ = w.Write([]byte(`{"chunk":[{"type":"m.room.member","state_key":"@carol:example.com","content":{"membership":"invite"}}]}`))
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	joined, invited, err := cli.GetMemberCount("!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1234, joined)
+	assert.Equal(t, 5, invited)
+	assert.Equal(t, 0, memberRequests)
+
+	includeSummary = false
+	joined, invited, err = cli.GetMemberCount("!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 2, joined)
+	assert.Equal(t, 1, invited)
+	assert.Equal(t, 2, memberRequests)
+}
+
+func TestDefaultSyncer_OnGappySync(t *testing.T) {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(`{"next_batch":"s2","rooms":{"join":{
+		"!gappy:example.com":{"timeline":{"limited":true,"prev_batch":"p1","events":[
+			{"type":"m.room.message","event_id":"$new","content":{"msgtype":"m.text","body":"hi"}}
+		]}},
+		"!normal:example.com":{"timeline":{"prev_batch":"p2","events":[]}}
+	}}}`), &resp))
+	gappy := resp.Rooms.Join["!gappy:example.com"].Timeline
+	assert.True(t, gappy.Limited)
+	assert.Equal(t, "p1", gappy.PrevBatch)
+	assert.False(t, resp.Rooms.Join["!normal:example.com"].Timeline.Limited)
+
+	syncer := mautrix.NewDefaultSyncer()
+	var order []string
+	syncer.OnGappySync(func(roomID id.RoomID, timeline *mautrix.SyncTimeline) {
+		order = append(order, "gap:"+roomID.String()+":"+timeline.PrevBatch)
+	})
+	syncer.OnEventType(event.EventMessage, func(source mautrix.EventSource, evt *event.Event) {
+		order = append(order, "event:"+evt.ID.String())
+	})
+	require.NoError(t, syncer.ProcessResponse(&resp, "s1"))
+	assert.Equal(t, []string{"gap:!gappy:example.com:p1", "event:$new"}, order)
+
+	order = nil
+	resp.Rooms.Join["!gappy:example.com"].Timeline.Events[0].Content.Parsed = nil
+	require.NoError(t, syncer.ProcessResponse(&resp, ""))
+	assert.Equal(t, []string{"event:$new"}, order)
+}
+
+func TestClient_Sync_TimeoutAndHook(t *testing.T) {
+	var timeouts, presences []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/v3/user/@user:example.com/filter" {
+			_, _ = w.Write([]byte(`{"filter_id":"1"}`))
+			return
+		}
+		timeouts = append(timeouts, r.URL.Query().Get("timeout"))
+		presences = append(presences, r.URL.Query().Get("set_presence"))
+		_, _ = fmt.Fprintf(w, `{"next_batch":"s%d"}`, len(timeouts))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.SyncTimeout = 5 * time.Second
+	cli.SyncPresence = event.PresenceOffline
+	var sinces []string
+	cli.SyncRequestHook = func(req *mautrix.ReqSync) {
+		sinces = append(sinces, req.Since)
+		if req.Since == "s2" {
+			req.SetPresence = event.PresenceOnline
+			cli.StopSync()
+		}
+	}
+	require.NoError(t, cli.Sync())
+	assert.Equal(t, []string{"", "s1", "s2"}, sinces)
+	assert.Equal(t, []string{"5000", "5000", "5000"}, timeouts)
+	assert.Equal(t, []string{"offline", "offline", "online"}, presences)
+}
+
+func TestClient_Sync_DontSaveNextBatch(t *testing.T) {
+	var sinces []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/v3/user/@user:example.com/filter" {
+			_, _ = w.Write([]byte(`{"filter_id":"1"}`))
+			return
+		}
+		sinces = append(sinces, r.URL.Query().Get("since"))
+		_, _ = fmt.Fprintf(w, `{"next_batch":"s%d"}`, len(sinces)+100)
+	}))
+	defer ts.Close()
+
+	store := mautrix.NewMemorySyncStore()
+	store.SaveNextBatch("@user:example.com", "s100")
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.Store = store
+	cli.DontSaveNextBatch = true
+	syncs := 0
+	cli.Syncer.(*mautrix.DefaultSyncer).OnSync(func(resp *mautrix.RespSync, since string) bool {
+		syncs++
+		if syncs == 2 {
+			cli.StopSync()
+		}
+		return true
+	})
+	require.NoError(t, cli.Sync())
+	// The loop still advances its own position, but the stored token isn't touched
+	require.GreaterOrEqual(t, len(sinces), 2)
+	assert.Equal(t, []string{"s100", "s101"}, sinces[:2])
+	assert.Equal(t, "s100", store.LoadNextBatch("@user:example.com"))
+}
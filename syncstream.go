@@ -0,0 +1,176 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// SyncStreamHandler contains callbacks for rooms in a /sync response that is decoded with DecodeSyncStream.
+//
+// Each callback is called as soon as the room has been decoded, so the whole response never has to be in memory
+// at once. Rooms in categories whose callback is nil are stored in the returned RespSync like normal.
+// If a callback returns an error, decoding is stopped and the error is returned.
+type SyncStreamHandler struct {
+	Join   func(roomID id.RoomID, room *SyncJoinedRoom) error
+	Invite func(roomID id.RoomID, room *SyncInvitedRoom) error
+	Leave  func(roomID id.RoomID, room *SyncLeftRoom) error
+	Knock  func(roomID id.RoomID, room *SyncKnockedRoom) error
+}
+
+// DecodeSyncStream decodes a /sync response from the given reader, passing rooms to the handler one by one instead
+// of collecting them all into the RespSync. Everything outside the rooms object is decoded into the returned
+// RespSync as usual.
+//
+// With a nil handler (or a handler with no callbacks), the result is equivalent to decoding the whole response
+// with json.Unmarshal.
+func DecodeSyncStream(r io.Reader, handler *SyncStreamHandler) (*RespSync, error) {
+	if handler == nil {
+		handler = &SyncStreamHandler{}
+	}
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	var resp RespSync
+	// The rest of the response is small, so it's collected back into an object and unmarshaled normally
+	// instead of duplicating the field names here.
+	var rest bytes.Buffer
+	rest.WriteByte('{')
+	for dec.More() {
+		key, err := decodeKey(dec)
+		if err != nil {
+			return nil, err
+		}
+		if key == "rooms" {
+			err = decodeSyncStreamRooms(dec, handler, &resp.Rooms)
+		} else {
+			var value json.RawMessage
+			if err = dec.Decode(&value); err == nil {
+				if rest.Len() > 1 {
+					rest.WriteByte(',')
+				}
+				keyJSON, _ := json.Marshal(key)
+				rest.Write(keyJSON)
+				rest.WriteByte(':')
+				rest.Write(value)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", key, err)
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	rest.WriteByte('}')
+	rooms := resp.Rooms
+	if err := json.Unmarshal(rest.Bytes(), &resp); err != nil {
+		return nil, err
+	}
+	resp.Rooms = rooms
+	return &resp, nil
+}
+
+func decodeSyncStreamRooms(dec *json.Decoder, handler *SyncStreamHandler, rooms *RespSyncRooms) error {
+	if isNull, err := expectObjectOrNull(dec); err != nil || isNull {
+		return err
+	}
+	for dec.More() {
+		key, err := decodeKey(dec)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "join":
+			err = decodeSyncStreamRoomMap(dec, handler.Join, &rooms.Join)
+		case "invite":
+			err = decodeSyncStreamRoomMap(dec, handler.Invite, &rooms.Invite)
+		case "leave":
+			err = decodeSyncStreamRoomMap(dec, handler.Leave, &rooms.Leave)
+		case "knock":
+			err = decodeSyncStreamRoomMap(dec, handler.Knock, &rooms.Knock)
+		default:
+			var ignored json.RawMessage
+			err = dec.Decode(&ignored)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %w", key, err)
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func decodeSyncStreamRoomMap[T any](dec *json.Decoder, handler func(id.RoomID, *T) error, into *map[id.RoomID]*T) error {
+	if isNull, err := expectObjectOrNull(dec); err != nil || isNull {
+		return err
+	} else if handler == nil && *into == nil {
+		*into = make(map[id.RoomID]*T)
+	}
+	for dec.More() {
+		roomID, err := decodeKey(dec)
+		if err != nil {
+			return err
+		}
+		// Event content keeps a reference to the raw JSON, so it can't be decoded directly from the decoder's buffer,
+		// which gets reused. Decoding into a RawMessage makes a copy of the room data.
+		var rawRoom json.RawMessage
+		var room T
+		if err = dec.Decode(&rawRoom); err != nil {
+			return fmt.Errorf("failed to read %s: %w", roomID, err)
+		} else if err = json.Unmarshal(rawRoom, &room); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", roomID, err)
+		}
+		if handler != nil {
+			if err = handler(id.RoomID(roomID), &room); err != nil {
+				return err
+			}
+		} else {
+			(*into)[id.RoomID(roomID)] = &room
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func decodeKey(dec *json.Decoder) (string, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	key, ok := token.(string)
+	if !ok {
+		return "", fmt.Errorf("expected object key, got %v", token)
+	}
+	return key, nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	} else if token != delim {
+		return fmt.Errorf("expected %s, got %v", delim, token)
+	}
+	return nil
+}
+
+func expectObjectOrNull(dec *json.Decoder) (isNull bool, err error) {
+	token, err := dec.Token()
+	if err != nil {
+		return false, err
+	} else if token == nil {
+		return true, nil
+	} else if token != json.Delim('{') {
+		return false, fmt.Errorf("expected { or null, got %v", token)
+	}
+	return false, nil
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const sampleStreamSync = `{
+	"rooms": {
+		"join": {
+			"!a:example.com": {
+				"timeline": {"events": [{"type": "m.room.message", "event_id": "$1", "sender": "@alice:example.com", "origin_server_ts": 1, "content": {"msgtype": "m.text", "body": "hi"}}], "limited": true, "prev_batch": "p1"},
+				"state": {"events": [{"type": "m.room.name", "state_key": "", "event_id": "$2", "sender": "@alice:example.com", "origin_server_ts": 1, "content": {"name": "A"}}]},
+				"ephemeral": {"events": [{"type": "m.typing", "content": {"user_ids": ["@alice:example.com"]}}]},
+				"summary": {"m.joined_member_count": 2},
+				"unread_notifications": {"highlight_count": 1, "notification_count": 3}
+			},
+			"!b:example.com": {"timeline": {"events": []}}
+		},
+		"invite": {
+			"!c:example.com": {"invite_state": {"events": [{"type": "m.room.member", "state_key": "@user:example.com", "sender": "@bob:example.com", "content": {"membership": "invite"}}]}}
+		},
+		"leave": {
+			"!d:example.com": {"timeline": {"events": [{"type": "m.room.member", "state_key": "@user:example.com", "event_id": "$3", "sender": "@user:example.com", "origin_server_ts": 2, "content": {"membership": "leave"}}]}}
+		},
+		"knock": {},
+		"unknown_category": {"!e:example.com": {}}
+	},
+	"to_device": {"events": [{"type": "m.dummy", "sender": "@bob:example.com", "content": {}}]},
+	"device_lists": {"changed": ["@bob:example.com"]},
+	"device_one_time_keys_count": {"signed_curve25519": 50},
+	"presence": {"events": [{"type": "m.presence", "sender": "@bob:example.com", "content": {"presence": "online"}}]},
+	"next_batch": "s123"
+}`
+
+func TestDecodeSyncStream_Equivalence(t *testing.T) {
+	var expected mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(sampleStreamSync), &expected))
+
+	decoded, err := mautrix.DecodeSyncStream(strings.NewReader(sampleStreamSync), nil)
+	require.NoError(t, err)
+	assert.Equal(t, &expected, decoded)
+
+	joined := make(map[id.RoomID]*mautrix.SyncJoinedRoom)
+	invited := make(map[id.RoomID]*mautrix.SyncInvitedRoom)
+	left := make(map[id.RoomID]*mautrix.SyncLeftRoom)
+	decoded, err = mautrix.DecodeSyncStream(strings.NewReader(sampleStreamSync), &mautrix.SyncStreamHandler{
+		Join: func(roomID id.RoomID, room *mautrix.SyncJoinedRoom) error {
+			joined[roomID] = room
+			return nil
+		},
+		Invite: func(roomID id.RoomID, room *mautrix.SyncInvitedRoom) error {
+			invited[roomID] = room
+			return nil
+		},
+		Leave: func(roomID id.RoomID, room *mautrix.SyncLeftRoom) error {
+			left[roomID] = room
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected.Rooms.Join, joined)
+	assert.Equal(t, expected.Rooms.Invite, invited)
+	assert.Equal(t, expected.Rooms.Leave, left)
+	assert.Empty(t, decoded.Rooms.Join)
+	assert.Empty(t, decoded.Rooms.Invite)
+	assert.Empty(t, decoded.Rooms.Leave)
+	assert.Equal(t, expected.Rooms.Knock, decoded.Rooms.Knock)
+	decoded.Rooms = expected.Rooms
+	assert.Equal(t, &expected, decoded)
+}
+
+func TestDecodeSyncStream_HandlerError(t *testing.T) {
+	handlerErr := fmt.Errorf("stop")
+	_, err := mautrix.DecodeSyncStream(strings.NewReader(sampleStreamSync), &mautrix.SyncStreamHandler{
+		Join: func(roomID id.RoomID, room *mautrix.SyncJoinedRoom) error {
+			return handlerErr
+		},
+	})
+	assert.ErrorIs(t, err, handlerErr)
+
+	_, err = mautrix.DecodeSyncStream(strings.NewReader(`{"rooms": {"join": []}}`), nil)
+	assert.Error(t, err)
+}
+
+func TestDefaultSyncer_StreamHandler(t *testing.T) {
+	var buffered, streamed []id.EventID
+	newSyncer := func(into *[]id.EventID) *mautrix.DefaultSyncer {
+		syncer := mautrix.NewDefaultSyncer()
+		syncer.OnEvent(func(source mautrix.EventSource, evt *event.Event) {
+			if evt.ID != "" {
+				*into = append(*into, evt.ID)
+			}
+		})
+		return syncer
+	}
+
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(sampleStreamSync), &resp))
+	require.NoError(t, newSyncer(&buffered).ProcessResponse(&resp, "s122"))
+
+	syncer := newSyncer(&streamed)
+	streamResp, err := mautrix.DecodeSyncStream(strings.NewReader(sampleStreamSync), syncer.StreamHandler("s122"))
+	require.NoError(t, err)
+	require.NoError(t, syncer.ProcessResponse(streamResp, "s122"))
+	assert.ElementsMatch(t, buffered, streamed)
+	assert.Len(t, streamed, 3)
+}
+
+func generateLargeSync(rooms, eventsPerRoom int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"next_batch":"s1","rooms":{"join":{`)
+	for i := 0; i < rooms; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		_, _ = fmt.Fprintf(&buf, `"!room%d:example.com":{"timeline":{"events":[`, i)
+		for j := 0; j < eventsPerRoom; j++ {
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+			_, _ = fmt.Fprintf(&buf, `{"type":"m.room.message","event_id":"$%d_%d","sender":"@user:example.com","origin_server_ts":%d,"content":{"msgtype":"m.text","body":"message number %d in room %d"}}`, i, j, j, j, i)
+		}
+		buf.WriteString(`]}}`)
+	}
+	buf.WriteString(`}}}`)
+	return buf.Bytes()
+}
+
+func heapAlloc() int64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapAlloc)
+}
+
+func decodeBufferedSync(b *testing.B, data []byte) *mautrix.RespSync {
+	var resp mautrix.RespSync
+	require.NoError(b, json.Unmarshal(data, &resp))
+	require.Len(b, resp.Rooms.Join, 1000)
+	return &resp
+}
+
+func decodeStreamedSync(b *testing.B, data []byte, onRoom func()) *mautrix.RespSync {
+	roomCount := 0
+	resp, err := mautrix.DecodeSyncStream(bytes.NewReader(data), &mautrix.SyncStreamHandler{
+		Join: func(roomID id.RoomID, room *mautrix.SyncJoinedRoom) error {
+			roomCount++
+			if onRoom != nil {
+				onRoom()
+			}
+			return nil
+		},
+	})
+	require.NoError(b, err)
+	require.Equal(b, 1000, roomCount)
+	require.Empty(b, resp.Rooms.Join)
+	return resp
+}
+
+// BenchmarkDecodeSync compares decoding a large /sync response into a RespSync with streaming it room by room.
+// In addition to the allocation stats, the peak live heap during decoding is reported as peak-heap-B/op.
+// The buffered response keeps every room in memory, while the streamed one only holds a single room at a time.
+func BenchmarkDecodeSync(b *testing.B) {
+	data := generateLargeSync(1000, 20)
+	b.Run("Buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			decodeBufferedSync(b, data)
+		}
+		b.StopTimer()
+		before := heapAlloc()
+		resp := decodeBufferedSync(b, data)
+		b.ReportMetric(float64(heapAlloc()-before), "peak-heap-B/op")
+		runtime.KeepAlive(resp)
+	})
+	b.Run("Streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			decodeStreamedSync(b, data, nil)
+		}
+		b.StopTimer()
+		var peak int64
+		roomCount := 0
+		before := heapAlloc()
+		decodeStreamedSync(b, data, func() {
+			// Sample the live heap while a room is being handled, which is when the most memory is in use
+			roomCount++
+			if roomCount%100 == 0 {
+				if usage := heapAlloc() - before; usage > peak {
+					peak = usage
+				}
+			}
+		})
+		b.ReportMetric(float64(peak), "peak-heap-B/op")
+	})
+}
+
+func TestClient_FullSyncRequest_StreamHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/sync", r.URL.Path)
+		_, _ = w.Write([]byte(sampleStreamSync))
+	}))
+	defer ts.Close()
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	var joined []id.RoomID
+	resp, err := cli.FullSyncRequest(mautrix.ReqSync{
+		Since: "s122",
+		StreamHandler: &mautrix.SyncStreamHandler{
+			Join: func(roomID id.RoomID, room *mautrix.SyncJoinedRoom) error {
+				joined = append(joined, roomID)
+				return nil
+			},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "s123", resp.NextBatch)
+	assert.ElementsMatch(t, []id.RoomID{"!a:example.com", "!b:example.com"}, joined)
+	assert.Empty(t, resp.Rooms.Join)
+	assert.Len(t, resp.Rooms.Invite, 1)
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// DefaultSentTransactionLimit is the number of transaction IDs remembered by the SentTransactions tracker
+// created in NewClient.
+const DefaultSentTransactionLimit = 1024
+
+// TransactionTracker remembers the transaction IDs of recently sent events, so that the remote echoes of those events
+// can be recognized using the transaction_id field in the unsigned data. Once the limit is reached, the oldest
+// transaction IDs are forgotten. The same tracker can be shared by multiple clients.
+type TransactionTracker struct {
+	lock  sync.RWMutex
+	ids   map[string]struct{}
+	order []string
+	next  int
+}
+
+// NewTransactionTracker creates a TransactionTracker that remembers up to the given number of transaction IDs.
+func NewTransactionTracker(limit int) *TransactionTracker {
+	if limit < 1 {
+		limit = 1
+	}
+	return &TransactionTracker{
+		ids:   make(map[string]struct{}, limit),
+		order: make([]string, limit),
+	}
+}
+
+// Add marks the given transaction ID as sent.
+func (tt *TransactionTracker) Add(txnID string) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	if _, exists := tt.ids[txnID]; exists {
+		return
+	}
+	if oldest := tt.order[tt.next]; oldest != "" {
+		delete(tt.ids, oldest)
+	}
+	tt.order[tt.next] = txnID
+	tt.ids[txnID] = struct{}{}
+	tt.next = (tt.next + 1) % len(tt.order)
+}
+
+// Has checks if the given transaction ID was sent recently.
+func (tt *TransactionTracker) Has(txnID string) bool {
+	tt.lock.RLock()
+	_, exists := tt.ids[txnID]
+	tt.lock.RUnlock()
+	return exists
+}
+
+func (cli *Client) trackSentTransaction(txnID string) {
+	if cli.SentTransactions != nil {
+		cli.SentTransactions.Add(txnID)
+	}
+}
+
+// IsOwnEvent checks if the given event was sent by this client, either because it was sent by the client's user,
+// or because its unsigned transaction_id matches an event sent with SendMessageEvent or SendRawEvent.
+//
+// Transaction IDs are only recorded if SentTransactions is set. Clients created with NewClient have a tracker by
+// default, and clones made with Clone share the tracker of the original client.
+func (cli *Client) IsOwnEvent(evt *event.Event) bool {
+	if evt.Sender == cli.UserID {
+		return true
+	}
+	txnID := evt.Unsigned.TransactionID
+	return txnID != "" && cli.SentTransactions != nil && cli.SentTransactions.Has(txnID)
+}
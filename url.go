@@ -88,6 +88,22 @@ func (mup MediaURLPath) FullPath() []any {
 	return append([]any{"_matrix", "media"}, []any(mup)...)
 }
 
+// DefaultMediaPrefix is the path prefix used for media endpoints if Client.MediaPrefix is not set.
+var DefaultMediaPrefix = []string{"_matrix", "media", "v3"}
+
+// mediaURLPath returns the given media endpoint path prefixed with the Client's MediaPrefix.
+func (cli *Client) mediaURLPath(urlPath ...any) BaseURLPath {
+	prefix := cli.MediaPrefix
+	if len(prefix) == 0 {
+		prefix = DefaultMediaPrefix
+	}
+	fullPath := make(BaseURLPath, 0, len(prefix)+len(urlPath))
+	for _, part := range prefix {
+		fullPath = append(fullPath, part)
+	}
+	return append(fullPath, urlPath...)
+}
+
 type SynapseAdminURLPath []any
 
 func (saup SynapseAdminURLPath) FullPath() []any {
@@ -110,3 +126,53 @@ func (cli *Client) BuildURLWithQuery(urlPath PrefixableURLPath, urlQuery map[str
 	hsURL.RawQuery = query.Encode()
 	return hsURL.String()
 }
+
+// NormalizePath replaces the variable parts of a Matrix API path, like room IDs, event IDs, user IDs and transaction IDs,
+// with placeholders. This is meant for grouping requests by endpoint, e.g. when recording metrics.
+//
+//	/_matrix/client/v3/rooms/!foo:example.com/send/m.room.message/123  =>  /_matrix/client/v3/rooms/{roomID}/send/m.room.message/{txnID}
+//
+// The path should be in escaped form (e.g. from url.URL.EscapedPath), as IDs can contain slashes
+// (like event IDs in room v3), which would otherwise be split into multiple segments.
+func NormalizePath(path string) string {
+	parts := strings.Split(path, "/")
+	normalized := make([]string, len(parts))
+	for i, part := range parts {
+		decoded, err := url.PathUnescape(part)
+		if err != nil {
+			decoded = part
+		}
+		var prev, prev2 string
+		if i >= 1 {
+			prev = parts[i-1]
+		}
+		if i >= 2 {
+			prev2 = parts[i-2]
+		}
+		switch {
+		case decoded == "":
+			normalized[i] = part
+		case decoded[0] == '!':
+			normalized[i] = "{roomID}"
+		case decoded[0] == '$':
+			normalized[i] = "{eventID}"
+		case decoded[0] == '@':
+			normalized[i] = "{userID}"
+		case decoded[0] == '#':
+			normalized[i] = "{roomAlias}"
+		case prev2 == "send" || prev2 == "sendToDevice" || prev2 == "redact":
+			normalized[i] = "{txnID}"
+		case prev2 == "state":
+			normalized[i] = "{stateKey}"
+		case prev == "filter":
+			normalized[i] = "{filterID}"
+		case prev == "download" || prev == "thumbnail":
+			normalized[i] = "{serverName}"
+		case prev2 == "download" || prev2 == "thumbnail":
+			normalized[i] = "{mediaID}"
+		default:
+			normalized[i] = part
+		}
+	}
+	return strings.Join(normalized, "/")
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
 )
 
 func TestClient_BuildURL(t *testing.T) {
@@ -63,3 +64,57 @@ func TestClient_BuildURL_MissingSchemeWithPath(t *testing.T) {
 	built := cli.BuildClientURL("v3", "foo/bar%2F🐈 1", "hello", "world")
 	assert.Equal(t, "https://example.com/base/_matrix/client/v3/foo%2Fbar%252F%F0%9F%90%88%201/hello/world", built)
 }
+
+func TestNormalizePath(t *testing.T) {
+	for input, expected := range map[string]string{
+		"/_matrix/client/v3/account/whoami":                                     "/_matrix/client/v3/account/whoami",
+		"/_matrix/client/v3/rooms/!foo:example.com/send/m.room.message/mautrix": "/_matrix/client/v3/rooms/{roomID}/send/m.room.message/{txnID}",
+		"/_matrix/client/v3/rooms/!foo:example.com/event/$bar":                  "/_matrix/client/v3/rooms/{roomID}/event/{eventID}",
+		"/_matrix/client/v3/rooms/!foo:example.com/redact/$bar/123":             "/_matrix/client/v3/rooms/{roomID}/redact/{eventID}/{txnID}",
+		"/_matrix/client/v3/rooms/!foo:example.com/state/m.room.member/@a:b.c":  "/_matrix/client/v3/rooms/{roomID}/state/m.room.member/{userID}",
+		"/_matrix/client/v3/rooms/!foo:example.com/state/m.room.name/":          "/_matrix/client/v3/rooms/{roomID}/state/m.room.name/",
+		"/_matrix/client/v3/directory/room/#alias:example.com":                  "/_matrix/client/v3/directory/room/{roomAlias}",
+		"/_matrix/client/v3/user/@a:b.c/filter/1234":                            "/_matrix/client/v3/user/{userID}/filter/{filterID}",
+		"/_matrix/media/v3/download/example.com/abcdef":                         "/_matrix/media/v3/download/{serverName}/{mediaID}",
+		"/_matrix/client/v3/rooms/%21foo:example.com/event/$ab%2Fcd+ef":         "/_matrix/client/v3/rooms/{roomID}/event/{eventID}",
+		"/_matrix/client/v3/rooms/%21foo:example.com/state/m.foo/a%2Fb":         "/_matrix/client/v3/rooms/{roomID}/state/m.foo/{stateKey}",
+		"/_matrix/client/v3/directory/room/%23alias:example.com":                "/_matrix/client/v3/directory/room/{roomAlias}",
+	} {
+		assert.Equal(t, expected, mautrix.NormalizePath(input), input)
+	}
+}
+
+func TestClient_BuildURLWithQuery_AppServiceUserID(t *testing.T) {
+	cli, err := mautrix.NewClient("https://example.com", "@ghost:example.com", "")
+	assert.NoError(t, err)
+	cli.SetAppServiceUserID = true
+	built := cli.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "rooms", "!room:example.com", "state", "m.room.name", ""}, map[string]string{"ts": "1234"})
+	assert.Equal(t, "https://example.com/_matrix/client/v3/rooms/%21room:example.com/state/m.room.name/?ts=1234&user_id=%40ghost%3Aexample.com", built)
+}
+
+func TestClient_MediaPrefix(t *testing.T) {
+	cli, err := mautrix.NewClient("https://example.com", "", "")
+	assert.NoError(t, err)
+	mxc := id.ContentURI{Homeserver: "example.com", FileID: "abc"}
+	assert.Equal(t, "https://example.com/_matrix/media/v3/download/example.com/abc?allow_redirect=true", cli.GetDownloadURL(mxc))
+	cli.MediaPrefix = []string{"_matrix", "client", "v1", "media"}
+	assert.Equal(t, "https://example.com/_matrix/client/v1/media/download/example.com/abc?allow_redirect=true", cli.GetDownloadURL(mxc))
+}
+
+func TestClient_ParseDownloadURL(t *testing.T) {
+	cli, err := mautrix.NewClient("https://example.com", "", "")
+	assert.NoError(t, err)
+	downloadURL, err := cli.ParseDownloadURL("mxc://example.com/abc")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/_matrix/media/v3/download/example.com/abc?allow_redirect=true", downloadURL)
+	thumbnailURL, err := cli.ParseThumbnailURL("mxc://example.com/abc", 64, 32, "crop")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/_matrix/media/v3/thumbnail/example.com/abc?allow_redirect=true&height=32&method=crop&width=64", thumbnailURL)
+
+	for _, invalid := range []string{"", "https://example.com/abc", "mxc://example.com", "mxc://example.com/abc/def", "mxc:///abc"} {
+		_, err = cli.ParseDownloadURL(invalid)
+		assert.ErrorIs(t, err, id.InvalidContentURI, invalid)
+		_, err = cli.ParseThumbnailURL(invalid, 64, 64, "scale")
+		assert.ErrorIs(t, err, id.InvalidContentURI, invalid)
+	}
+}
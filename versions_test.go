@@ -8,9 +8,13 @@ package mautrix_test
 
 import (
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"maunium.net/go/mautrix"
 )
@@ -100,3 +104,77 @@ func TestSpecVersion_GreaterThan(t *testing.T) {
 	assert.True(t, !mautrix.MustParseSpecVersion("r0.6.0").GreaterThan(mautrix.MustParseSpecVersion("r0.6.0")))
 	assert.True(t, !mautrix.MustParseSpecVersion("r0.6.0").LessThan(mautrix.MustParseSpecVersion("r0.6.0")))
 }
+
+func TestClient_CachedVersions(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/versions", r.URL.Path)
+		requests++
+		_, _ = w.Write([]byte(sampleVersions))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	supported, err := cli.SupportsVersion("v1.2")
+	require.NoError(t, err)
+	assert.True(t, supported)
+	supported, err = cli.SupportsVersion("v1.3")
+	require.NoError(t, err)
+	assert.False(t, supported)
+	supported, err = cli.SupportsUnstableFeature("org.matrix.label_based_filtering")
+	require.NoError(t, err)
+	assert.True(t, supported)
+	supported, err = cli.SupportsUnstableFeature("com.example.nonexistent")
+	require.NoError(t, err)
+	assert.False(t, supported)
+	assert.Equal(t, 1, requests)
+
+	cli.InvalidateVersionsCache()
+	_, err = cli.CachedVersions()
+	require.NoError(t, err)
+	assert.Equal(t, 2, requests)
+}
+
+func TestClient_SupportsVersion_Invalid(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unexpected request to", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	supported, err := cli.SupportsVersion("1.2")
+	assert.Error(t, err)
+	assert.False(t, supported)
+}
+
+func TestClient_CachedVersions_NoLockDuringFetch(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		_, _ = w.Write([]byte(sampleVersions))
+	}))
+	defer ts.Close()
+
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	fetched := make(chan error, 1)
+	go func() {
+		_, err := cli.CachedVersions()
+		fetched <- err
+	}()
+	invalidated := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cli.InvalidateVersionsCache()
+		close(invalidated)
+	}()
+	select {
+	case <-invalidated:
+	case <-time.After(2 * time.Second):
+		t.Error("InvalidateVersionsCache blocked while versions were being fetched")
+	}
+	close(release)
+	assert.NoError(t, <-fetched)
+}